@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Alert types
+const (
+	AlertWhale   = "whale"   // Order far above the product's usual size
+	AlertIceberg = "iceberg" // Level refilled with the same size right after fills
+)
+
+const (
+	alertHistorySize = 256 // Recent alerts kept for GET /api/alerts
+	webhookBuffer    = 64  // Alert batches queued for the webhook
+	webhookTimeout   = 5 * time.Second
+	webhookInboxSize = 100 // Payloads kept by the stand-in receiver
+)
+
+// Alert is a notable pattern found in the reconstructed book
+type Alert struct {
+	Seq        uint64          `json:"seq"` // Process-wide alert sequence
+	Type       string          `json:"type"`
+	Symbol     string          `json:"symbol"`
+	Side       string          `json:"side"` // bid or ask
+	Price      decimal.Decimal `json:"price"`
+	Size       int64           `json:"size"`               // Lots
+	Confidence float64         `json:"confidence"`         // 0..1
+	OrderID    uint64          `json:"order_id,omitempty"` // Synthetic order behind the alert, if any
+	RuleID     uint64          `json:"rule_id,omitempty"`  // User-defined rule that fired, if any
+	Timestamp  int64           `json:"timestamp"`          // Unix milliseconds
+	Message    string          `json:"message"`
+}
+
+// AlertHub fans alerts out to WebSocket subscribers and the webhook, and
+// keeps the most recent ones
+type AlertHub struct {
+	mu      sync.Mutex
+	seq     uint64
+	recent  []Alert // Oldest first, at most alertHistorySize
+	subs    map[chan []Alert]struct{}
+	webhook *WebhookSender
+	dropped atomic.Uint64 // Batches dropped for slow subscribers
+}
+
+// alerts is the process-wide alert hub
+var alerts = &AlertHub{subs: make(map[chan []Alert]struct{})}
+
+// Subscribe returns a channel of alert batches and a function that ends the
+// subscription and closes the channel
+func (h *AlertHub) Subscribe(buffer int) (<-chan []Alert, func()) {
+	ch := make(chan []Alert, buffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// SetWebhook posts all alerts to w, nil stops posting
+func (h *AlertHub) SetWebhook(w *WebhookSender) {
+	h.mu.Lock()
+	h.webhook = w
+	h.mu.Unlock()
+}
+
+// Publish numbers a batch and delivers it without blocking
+func (h *AlertHub) Publish(batch []Alert) {
+	if len(batch) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range batch {
+		h.seq++
+		batch[i].Seq = h.seq
+		engineLog.Info("alert", "type", batch[i].Type, "symbol", batch[i].Symbol, "side", batch[i].Side,
+			"price", batch[i].Price, "size", batch[i].Size, "confidence", batch[i].Confidence, "message", batch[i].Message)
+	}
+	h.recent = append(h.recent, batch...)
+	if n := len(h.recent) - alertHistorySize; n > 0 {
+		h.recent = append(h.recent[:0], h.recent[n:]...)
+	}
+
+	if h.webhook != nil {
+		h.webhook.Send(batch)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- batch:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// Recent returns the latest alerts, oldest first
+func (h *AlertHub) Recent() []Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Alert{}, h.recent...)
+}
+
+// WebhookSender posts alert batches as JSON to a URL from its own goroutine,
+// so a slow receiver never holds up the books
+type WebhookSender struct {
+	url     string
+	client  *http.Client
+	queue   chan []Alert
+	dropped atomic.Uint64 // Batches dropped while the queue was full
+}
+
+// NewWebhookSender starts a sender posting to url
+func NewWebhookSender(url string) *WebhookSender {
+	w := &WebhookSender{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan []Alert, webhookBuffer),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues a batch, dropping it when the receiver is behind
+func (w *WebhookSender) Send(batch []Alert) {
+	select {
+	case w.queue <- batch:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+func (w *WebhookSender) run() {
+	for batch := range w.queue {
+		if err := w.post(batch); err != nil {
+			engineLog.Warn("alert webhook failed", "url", w.url, "err", err)
+		}
+	}
+}
+
+func (w *WebhookSender) post(batch []Alert) error {
+	body, err := json.Marshal(map[string]any{"alerts": batch})
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookInbox is a stand-in webhook receiver for running without an
+// external service: it keeps the latest payloads for GET /api/webhook
+type WebhookInbox struct {
+	mu       sync.Mutex
+	received []json.RawMessage
+}
+
+// webhookInbox backs /api/webhook
+var webhookInbox = &WebhookInbox{}
+
+// Receive stores a payload
+func (in *WebhookInbox) Receive(payload json.RawMessage) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.received = append(in.received, payload)
+	if n := len(in.received) - webhookInboxSize; n > 0 {
+		in.received = append(in.received[:0], in.received[n:]...)
+	}
+}
+
+// Received returns the stored payloads, oldest first
+func (in *WebhookInbox) Received() []json.RawMessage {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]json.RawMessage{}, in.received...)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		wsLog.Warn("write JSON response failed", "err", err)
+	}
+}
+
+// frontStatsHandler serves per-front CTP connection statistics
+func frontStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appState.mu.RLock()
+		md := appState.md
+		appState.mu.RUnlock()
+
+		if md == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"error": "CTP market data not connected",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"fronts": md.FrontStats(),
+		})
+	}
+}
+
+// routingStatsHandler serves counts of routed, unknown and misrouted ticks
+func routingStatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, appState.router.Stats())
+	}
+}
+
+// historyHandler serves the persisted book of a symbol at ?at=, or the
+// recorded span when at is omitted
+func historyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if appState.history == nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+				"error": "snapshot history disabled",
+			})
+			return
+		}
+
+		symbol := r.PathValue("symbol")
+		at := r.URL.Query().Get("at")
+		if at == "" {
+			span, err := appState.history.Range(symbol)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, span)
+			return
+		}
+
+		t, err := parseHistoryTime(at)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		record, err := appState.history.At(symbol, t)
+		switch {
+		case errors.Is(err, ErrNoHistory):
+			writeJSON(w, http.StatusNotFound, map[string]any{
+				"error": fmt.Sprintf("no snapshot of %s at or before %s", symbol, t.Format(time.RFC3339Nano)),
+			})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, record)
+		}
+	}
+}
+
+// historyReply answers the get_history WebSocket command. symbol defaults to
+// the active book; without at the recorded span is returned.
+func historyReply(symbol, at string) map[string]any {
+	if appState.history == nil {
+		return map[string]any{"type": "error", "message": "snapshot history disabled"}
+	}
+	if symbol == "" {
+		symbol = appState.book.Load().Symbol()
+	}
+	if at == "" {
+		span, err := appState.history.Range(symbol)
+		if err != nil {
+			return map[string]any{"type": "error", "message": err.Error()}
+		}
+		return map[string]any{"type": "history_range", "range": span}
+	}
+
+	t, err := parseHistoryTime(at)
+	if err != nil {
+		return map[string]any{"type": "error", "message": err.Error()}
+	}
+	record, err := appState.history.At(symbol, t)
+	if err != nil {
+		return map[string]any{"type": "error", "message": fmt.Sprintf("history of %s at %s: %v", symbol, at, err)}
+	}
+	return map[string]any{"type": "history_snapshot", "record": record}
+}
+
+// ownOrdersHandler lists the tracked own orders of all books
+func ownOrdersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"orders": listOwnOrders()})
+	}
+}
+
+// registerOwnOrderHandler starts tracking the queue position of one of our
+// resting orders, given as an OwnOrderRequest body
+func registerOwnOrderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req OwnOrderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid order: " + err.Error()})
+			return
+		}
+		status, err := registerOwnOrder(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, status)
+	}
+}
+
+// cancelOwnOrderHandler stops tracking an own order
+func cancelOwnOrderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid order id"})
+			return
+		}
+		status, err := cancelOwnOrder(id)
+		switch {
+		case errors.Is(err, ErrUnknownOwnOrder):
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, status)
+		}
+	}
+}
+
+// fillEstimateHandler serves the predicted time to fill and fill probability
+// of the best ?levels= (default 5) levels of a symbol, within ?horizon=
+// seconds (default -fill-horizon)
+func fillEstimateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		levels := 5
+		if s := query.Get("levels"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid levels: " + s})
+				return
+			}
+			levels = n
+		}
+		horizon := fillHorizon.Seconds()
+		if s := query.Get("horizon"); s != "" {
+			h, err := strconv.ParseFloat(s, 64)
+			if err != nil || h <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid horizon: " + s})
+				return
+			}
+			horizon = h
+		}
+
+		symbol := r.PathValue("symbol")
+		bids, asks, err := fillEstimates(symbol, levels, horizon)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"symbol":  symbol,
+			"horizon": horizon,
+			"bids":    bids,
+			"asks":    asks,
+		})
+	}
+}
+
+// microstructureHandler serves the current metrics of a symbol and, with
+// ?from= (a time as for history) or ?limit=, the recorded series
+func microstructureHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var from int64
+		if s := query.Get("from"); s != "" {
+			t, err := parseHistoryTime(s)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+				return
+			}
+			from = t.UnixMilli()
+		}
+		limit := 0
+		if s := query.Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid limit: " + s})
+				return
+			}
+			limit = n
+		}
+
+		symbol := r.PathValue("symbol")
+		series := query.Has("from") || query.Has("limit")
+		current, samples, err := bookMetrics(symbol, series, from, limit)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+			return
+		}
+		resp := map[string]any{"symbol": symbol, "metrics": current}
+		if series {
+			resp["series"] = samples
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// resyncHandler rebuilds the book of a symbol from its latest L2 quantities
+func resyncHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		symbol := r.PathValue("symbol")
+		bidLevels, askLevels, err := resyncBookOf(symbol)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"symbol": symbol, "bid_levels": bidLevels, "ask_levels": askLevels})
+	}
+}
+
+// alertsHandler serves the most recent alerts
+func alertsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"alerts": alerts.Recent()})
+	}
+}
+
+// logLevelsHandler serves the log level of each subsystem
+func logLevelsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"levels": logLevels()})
+	}
+}
+
+// setLogLevelsHandler changes subsystem log levels, given as a body like
+// {"ctp": "debug", "*": "warn"} where "*" applies to all subsystems
+func setLogLevelsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var levels map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid levels: " + err.Error()})
+			return
+		}
+		if err := setLogLevels(levels); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		wsLog.Info("log levels changed", "levels", levels)
+		writeJSON(w, http.StatusOK, map[string]any{"levels": logLevels()})
+	}
+}
+
+// rulesHandler lists the user-defined alert rules
+func rulesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"rules": alertRules.List()})
+	}
+}
+
+// addRuleHandler defines an alert rule given as an AlertRule body
+func addRuleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var rule AlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid rule: " + err.Error()})
+			return
+		}
+		rule, err := alertRules.Add(rule)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	}
+}
+
+// deleteRuleHandler removes an alert rule
+func deleteRuleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid rule id"})
+			return
+		}
+		if err := alertRules.Remove(id); err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"deleted": id})
+	}
+}
+
+// surveillanceHandler serves the most recent spoofing and layering episodes
+func surveillanceHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"episodes": surveillance.Recent()})
+	}
+}
+
+// webhookReceiveHandler is the stand-in webhook receiver: point
+// -alert-webhook at /api/webhook to exercise delivery without another service
+func webhookReceiveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"error": "invalid payload: " + err.Error()})
+			return
+		}
+		webhookInbox.Receive(payload)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webhookInboxHandler lists the payloads the stand-in receiver got
+func webhookInboxHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"received": webhookInbox.Received()})
+	}
+}
+
+// instrumentHandler serves instrument metadata and resolved precision from
+// the local dictionary
+func instrumentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		inst, ok := precisionManager.Store().Get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]any{
+				"error": "instrument not found: " + id,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"instrument": inst,
+			"precision":  precisionManager.GetPrecisionInfo(id),
+		})
+	}
+}
+
+// instrumentRefreshHandler refreshes the local dictionary from the OpenCTP
+// API for the comma separated ?products= list
+func instrumentRefreshHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		products := splitList(r.URL.Query().Get("products"))
+		if len(products) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{
+				"error": "products query parameter is required, e.g. ?products=ag,au",
+			})
+			return
+		}
+		count, err := precisionManager.Store().Refresh(products)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]any{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"products":  strings.Join(products, ","),
+			"refreshed": count,
+			"total":     precisionManager.Store().Count(),
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+const (
+	benchSymbol = "bench"
+	benchTicks  = 4096
+)
+
+// benchDepthTicks generates a deterministic random-walk tick stream using the simulated front
+func benchDepthTicks() []*thost.CThostFtdcDepthMarketDataField {
+	api := NewSimMdApi(SimOptions{BasePrice: 5000, TickSize: 1, Seed: 1})
+	ticks := make([]*thost.CThostFtdcDepthMarketDataField, benchTicks)
+	for i := range ticks {
+		ticks[i] = api.nextSyntheticTick(benchSymbol).ToDepthMarketData()
+	}
+	return ticks
+}
+
+// newBenchBook returns a book warmed up with the whole tick stream
+func newBenchBook(ticks []*thost.CThostFtdcDepthMarketDataField) *L3OrderBook {
+	book := NewL3OrderBook(benchSymbol)
+	for _, f := range ticks {
+		book.applyDepthMarketData(f)
+	}
+	return book
+}
+
+// BenchmarkApplyDepthMarketData measures applying one CTP depth tick to the book
+func BenchmarkApplyDepthMarketData(b *testing.B) {
+	ticks := benchDepthTicks()
+	book := newBenchBook(ticks)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		book.applyDepthMarketData(ticks[i%len(ticks)])
+	}
+}
+
+// BenchmarkGetL3Snapshot measures building the 100-level snapshot sent to clients
+func BenchmarkGetL3Snapshot(b *testing.B) {
+	book := newBenchBook(benchDepthTicks())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		book.getL3Snapshot(100)
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+const (
+	snapshotInterval = 50 * time.Millisecond // Max rate at which snapshots are republished
+	snapshotLevels   = 100                   // Levels per side in published snapshots
+	actorTickBuffer  = 1024
+)
+
+// BookActor owns an L3OrderBook on a single goroutine. Feed updates and
+// commands are applied in order on that goroutine, and readers get immutable
+// snapshots through an atomic pointer, so they never block the feed.
+type BookActor struct {
+	book     *L3OrderBook // Only touched by the actor goroutine
+	symbol   string       // Instrument ID
+	exchange string       // Exchange ID, empty when unknown
+	ticks    chan queuedTick
+	cmds     chan func(ob *L3OrderBook)
+	snapshot atomic.Pointer[L3Snapshot]
+	first    chan struct{} // Closed once the first tick has been applied
+	stats    *bookStats
+	pending  []time.Time // Arrival of the ticks not yet in a snapshot, actor goroutine only
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// queuedTick is a tick waiting for the actor with the time it arrived
+type queuedTick struct {
+	field thost.CThostFtdcDepthMarketDataField
+	at    time.Time
+}
+
+// NewBookActor creates a book for symbol and starts its goroutine. symbol may
+// be exchange-qualified, e.g. "SHFE.ag2510"; otherwise the exchange is taken
+// from the instrument dictionary when known.
+func NewBookActor(symbol string) *BookActor {
+	exchange, instrumentID := parseSymbol(symbol)
+	book := NewL3OrderBook(instrumentID)
+	if known := book.precision.ExchangeID; exchange == "" {
+		exchange = known
+	} else if known != "" && known != exchange {
+		engineLog.Warn("instrument listed on another exchange, only ticks of the requested one will be accepted",
+			"instrument", instrumentID, "listed", known, "requested", exchange)
+	}
+
+	a := &BookActor{
+		book:     book,
+		symbol:   instrumentID,
+		exchange: exchange,
+		ticks:    make(chan queuedTick, actorTickBuffer),
+		cmds:     make(chan func(ob *L3OrderBook), 64),
+		first:    make(chan struct{}),
+		stats:    newBookStats(),
+		done:     make(chan struct{}),
+	}
+	a.publish()
+	go a.run()
+	return a
+}
+
+// run applies updates and republishes the snapshot when the book changed
+func (a *BookActor) run() {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	dirty := false
+	seen := false
+	for {
+		select {
+		case <-a.done:
+			return
+		case t := <-a.ticks:
+			start := time.Now()
+			a.book.applyDepthMarketData(&t.field)
+			a.applied(start, t.at)
+			a.flushEvents()
+			a.flushOwnOrders()
+			dirty = true
+			if !seen {
+				seen = true
+				a.publish()
+				close(a.first)
+			}
+		case fn := <-a.cmds:
+			fn(a.book)
+			a.flushEvents()
+			a.flushOwnOrders()
+			dirty = true
+		case <-ticker.C:
+			if dirty {
+				a.publish()
+				dirty = false
+			}
+		}
+	}
+}
+
+// flushEvents runs the detectors over the order events inferred by the last
+// update, publishes the events and enables recording only while the hub has
+// consumers or detectors need them. Must run on the actor goroutine.
+func (a *BookActor) flushEvents() {
+	alerts.Publish(a.book.DetectAlerts())
+	active := orderEvents.Active()
+	if active {
+		orderEvents.Publish(a.book.DrainEvents())
+	} else {
+		a.book.DiscardEvents()
+	}
+	a.book.SetEventsEnabled(active || a.book.Detecting())
+}
+
+// flushOwnOrders re-estimates our orders after an update and publishes the
+// statuses that changed. Must run on the actor goroutine.
+func (a *BookActor) flushOwnOrders() {
+	ownOrderUpdates.Publish(a.book.refreshOwnOrders())
+}
+
+// applied records an L2 update that started applying at start and arrived
+// at arrived. Must run on the actor goroutine.
+func (a *BookActor) applied(start, arrived time.Time) {
+	a.stats.applyDelta.observe(time.Since(start))
+	a.stats.ticks.Add(1)
+	a.pending = append(a.pending, arrived)
+}
+
+// publish builds a new snapshot from the book. Must run on the actor goroutine.
+func (a *BookActor) publish() {
+	snapshot := a.book.getL3Snapshot(snapshotLevels)
+	a.snapshot.Store(&snapshot)
+
+	now := time.Now()
+	for _, arrived := range a.pending {
+		a.stats.latency.observe(now.Sub(arrived))
+	}
+	a.pending = a.pending[:0]
+	a.stats.bidLevels.Store(int64(a.book.bids.len()))
+	a.stats.askLevels.Store(int64(a.book.asks.len()))
+	a.stats.bidOrders.Store(countOrders(a.book.bids))
+	a.stats.askOrders.Store(countOrders(a.book.asks))
+}
+
+// Symbol returns the instrument ID of the book
+func (a *BookActor) Symbol() string {
+	return a.symbol
+}
+
+// Exchange returns the exchange ID of the book, empty when unknown
+func (a *BookActor) Exchange() string {
+	return a.exchange
+}
+
+// QualifiedSymbol returns the exchange-qualified instrument, e.g. "SHFE.ag2510"
+func (a *BookActor) QualifiedSymbol() string {
+	if a.exchange == "" {
+		return a.symbol
+	}
+	return a.exchange + "." + a.symbol
+}
+
+// Accepts reports whether a tick belongs to this book. The instrument must
+// match; the exchange is checked when both the book and the tick carry one,
+// since several fronts leave ExchangeID empty in depth market data.
+func (a *BookActor) Accepts(f *thost.CThostFtdcDepthMarketDataField) bool {
+	if string(trimNul(f.InstrumentID[:])) != a.symbol {
+		return false
+	}
+	exchange := trimNul(f.ExchangeID[:])
+	return a.exchange == "" || len(exchange) == 0 || string(exchange) == a.exchange
+}
+
+// Snapshot returns the latest published snapshot. It must not be modified.
+func (a *BookActor) Snapshot() *L3Snapshot {
+	return a.snapshot.Load()
+}
+
+// FirstTick is closed once the first tick has been applied and published
+func (a *BookActor) FirstTick() <-chan struct{} {
+	return a.first
+}
+
+// ApplyDepthMarketData queues a CTP tick. The field is copied, so the caller
+// may reuse it. Blocks when the actor is behind rather than dropping ticks,
+// which would corrupt the queue reconstruction. Ticks the book does not
+// accept are rejected and false is returned.
+func (a *BookActor) ApplyDepthMarketData(f *thost.CThostFtdcDepthMarketDataField) bool {
+	if !a.Accepts(f) || a.stopped() {
+		return false
+	}
+	select {
+	case <-a.done:
+		return false
+	case a.ticks <- queuedTick{field: *f, at: time.Now()}:
+		return true
+	}
+}
+
+// post queues a command without waiting for it
+func (a *BookActor) post(fn func(ob *L3OrderBook)) bool {
+	if a.stopped() {
+		return false
+	}
+	select {
+	case <-a.done:
+		return false
+	case a.cmds <- fn:
+		return true
+	}
+}
+
+// Do runs fn on the actor goroutine, republishes the snapshot and waits for
+// completion. It returns false if the actor was stopped.
+func (a *BookActor) Do(fn func(ob *L3OrderBook)) bool {
+	finished := make(chan struct{})
+	ok := a.post(func(ob *L3OrderBook) {
+		fn(ob)
+		a.publish()
+		close(finished)
+	})
+	if !ok {
+		return false
+	}
+	select {
+	case <-finished:
+		return true
+	case <-a.done:
+		return false
+	}
+}
+
+// LoadSnapshot queues an L2 snapshot
+func (a *BookActor) LoadSnapshot(resp *binanceRESTResp) bool {
+	return a.post(func(ob *L3OrderBook) { ob.loadSnapshot(resp) })
+}
+
+// ApplyDelta queues an L2 delta update
+func (a *BookActor) ApplyDelta(update *binanceWSUpdate) bool {
+	arrived := time.Now()
+	return a.post(func(ob *L3OrderBook) {
+		start := time.Now()
+		ob.applyDelta(update)
+		a.applied(start, arrived)
+	})
+}
+
+// Stop terminates the actor goroutine. Pending updates are discarded.
+func (a *BookActor) Stop() {
+	a.stopOnce.Do(func() { close(a.done) })
+}
+
+// stopped reports whether Stop was called. Checked before queueing, since a
+// select with room in the buffer may pick the send over a closed done.
+func (a *BookActor) stopped() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// instrumentKey returns the InstrumentID of a tick without its NUL padding.
+// Comparing or indexing a map with string(key) does not allocate.
+func instrumentKey(f *thost.CThostFtdcDepthMarketDataField) []byte {
+	return trimNul(f.InstrumentID[:])
+}
+
+// trimNul cuts a fixed-size CTP string field at its first NUL
+func trimNul(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
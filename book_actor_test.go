@@ -0,0 +1,163 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// noDetectors turns off the built-in detectors for books created by the test
+func noDetectors(t *testing.T) {
+	t.Helper()
+	large, spoof := detectLargeOrders, detectSpoofing
+	detectLargeOrders, detectSpoofing = false, false
+	t.Cleanup(func() { detectLargeOrders, detectSpoofing = large, spoof })
+}
+
+// testTicks returns a deterministic tick stream of instrument "test"
+func testTicks(n int) []*thost.CThostFtdcDepthMarketDataField {
+	api := NewSimMdApi(SimOptions{BasePrice: 5000, TickSize: 1, Seed: 1})
+	ticks := make([]*thost.CThostFtdcDepthMarketDataField, n)
+	for i := range ticks {
+		ticks[i] = api.nextSyntheticTick("test").ToDepthMarketData()
+	}
+	return ticks
+}
+
+func TestBookActorAccepts(t *testing.T) {
+	tests := []struct {
+		book, instrument, exchange string
+		want                       bool
+	}{
+		{"test", "test", "", true},
+		{"test", "test", "SHFE", true},
+		{"SHFE.test", "test", "SHFE", true},
+		{"SHFE.test", "test", "", true}, // Fronts that leave ExchangeID empty
+		{"SHFE.test", "test", "INE", false},
+		{"test", "test2", "", false},
+		{"test2", "test", "", false},
+	}
+	for _, tt := range tests {
+		a := NewBookActor(tt.book)
+		f := &thost.CThostFtdcDepthMarketDataField{}
+		copy(f.InstrumentID[:], tt.instrument)
+		copy(f.ExchangeID[:], tt.exchange)
+		if got := a.Accepts(f); got != tt.want {
+			t.Errorf("book %s, tick %s.%s: accepts %v, want %v", tt.book, tt.exchange, tt.instrument, got, tt.want)
+		}
+		a.Stop()
+	}
+}
+
+func TestBookActorBackpressure(t *testing.T) {
+	a := newTestActor(t)
+	ticks := testTicks(actorTickBuffer + 1)
+
+	held, release := make(chan struct{}), make(chan struct{})
+	go a.Do(func(*L3OrderBook) {
+		close(held)
+		<-release
+	})
+	<-held
+	for _, f := range ticks[:actorTickBuffer] {
+		if !a.ApplyDepthMarketData(f) {
+			t.Fatal("tick rejected")
+		}
+	}
+
+	// The buffer is full: the next tick waits instead of being dropped
+	queued := make(chan bool)
+	go func() { queued <- a.ApplyDepthMarketData(ticks[actorTickBuffer]) }()
+	select {
+	case <-queued:
+		t.Fatal("tick queued past a full buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if !<-queued {
+		t.Fatal("waiting tick rejected")
+	}
+	// Commands may overtake queued ticks, so wait for the count
+	for deadline := time.Now().Add(5 * time.Second); a.stats.ticks.Load() < uint64(len(ticks)); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("applied %d ticks, want %d", a.stats.ticks.Load(), len(ticks))
+		}
+	}
+
+	// Stopping releases a producer blocked on a full buffer
+	held, release = make(chan struct{}), make(chan struct{})
+	go a.Do(func(*L3OrderBook) {
+		close(held)
+		<-release
+	})
+	<-held
+	defer close(release)
+	for range actorTickBuffer {
+		a.ApplyDepthMarketData(ticks[0])
+	}
+	go func() { queued <- a.ApplyDepthMarketData(ticks[0]) }()
+	a.Stop()
+	if <-queued {
+		t.Error("tick accepted by a stopped actor")
+	}
+}
+
+func TestBookActorRejectsAfterStop(t *testing.T) {
+	a := NewBookActor("test")
+	a.Stop()
+	for range 100 {
+		if a.ApplyDepthMarketData(testTicks(1)[0]) || a.LoadSnapshot(&binanceRESTResp{}) {
+			t.Fatal("update queued on a stopped actor")
+		}
+	}
+}
+
+func TestBookActorPublishes(t *testing.T) {
+	a := newTestActor(t)
+	if s := a.Snapshot(); s == nil || len(s.Bids) != 0 {
+		t.Fatal("no empty snapshot before the first tick")
+	}
+	a.ApplyDepthMarketData(testTicks(1)[0])
+	select {
+	case <-a.FirstTick():
+	case <-time.After(time.Second):
+		t.Fatal("first tick not published")
+	}
+	if s := a.Snapshot(); len(s.Bids) == 0 || len(s.Asks) == 0 {
+		t.Error("first tick missing from the snapshot")
+	}
+}
+
+func TestBookActorEventGating(t *testing.T) {
+	noDetectors(t)
+	a := newTestActor(t)
+	ticks := testTicks(3)
+
+	recording := func() (enabled bool) {
+		a.Do(func(ob *L3OrderBook) { enabled = ob.events.enabled })
+		return enabled
+	}
+	a.ApplyDepthMarketData(ticks[0])
+	if recording() {
+		t.Fatal("events recorded without consumers or detectors")
+	}
+
+	events, unsubscribe := orderEvents.Subscribe(16)
+	a.Do(func(*L3OrderBook) {}) // Recording starts after the next update
+	a.ApplyDepthMarketData(ticks[1])
+	select {
+	case batch := <-events:
+		if len(batch) == 0 || batch[0].Symbol != "test" {
+			t.Errorf("unexpected batch %+v", batch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no events published to a subscriber")
+	}
+
+	unsubscribe()
+	a.ApplyDepthMarketData(ticks[2])
+	if recording() {
+		t.Error("events still recorded after the last subscriber left")
+	}
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"fmt"
 	"math"
-
-	"github.com/shopspring/decimal"
 )
 
 // Color represents an RGB color
@@ -89,11 +87,11 @@ func GetClusterColor(cluster int, isBid bool) Color {
 }
 
 // GetSpecialOrderColor returns special colors for highlighted orders
-func GetSpecialOrderColor(orderQty, maxOrder, secondMaxOrder decimal.Decimal) *Color {
-	if orderQty.Equal(maxOrder) {
+func GetSpecialOrderColor(orderQty, maxOrder, secondMaxOrder int64) *Color {
+	if orderQty == maxOrder {
 		return &GoldColor
 	}
-	if orderQty.Equal(secondMaxOrder) {
+	if orderQty == secondMaxOrder {
 		return &DarkGoldColor
 	}
 	return nil // No special color
@@ -120,7 +118,7 @@ func BrightenColor(color Color, factor float32) Color {
 }
 
 // GenerateOrderColors generates colors for all orders in a price level
-func GenerateOrderColors(orders []decimal.Decimal, isBid bool, maxOrder, secondMaxOrder decimal.Decimal) []string {
+func GenerateOrderColors(orders []int64, isBid bool, maxOrder, secondMaxOrder int64) []string {
 	colors := make([]string, len(orders))
 	
 	for i, order := range orders {
@@ -139,7 +137,7 @@ func GenerateOrderColors(orders []decimal.Decimal, isBid bool, maxOrder, secondM
 }
 
 // GenerateClusteredOrderColors generates colors for clustered orders
-func GenerateClusteredOrderColors(clusteredOrders []*ClusteredOrder, isBid bool, maxOrder, secondMaxOrder decimal.Decimal) []string {
+func GenerateClusteredOrderColors(clusteredOrders []*ClusteredOrder, isBid bool, maxOrder, secondMaxOrder int64) []string {
 	colors := make([]string, len(clusteredOrders))
 	
 	for i, order := range clusteredOrders {
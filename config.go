@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// 覆盖配置文件取值的环境变量
+const (
+	envConfigPath = "CTP_CONFIG"
+	envProfile    = "CTP_PROFILE"
+	envBrokerID   = "CTP_BROKER_ID"
+	envUserID     = "CTP_USER_ID"
+	envPassword   = "CTP_PASSWORD"
+	envAppID      = "CTP_APP_ID"
+	envAuthCode   = "CTP_AUTH_CODE"
+	envMdFronts   = "CTP_MD_FRONTS" // 逗号分隔，按故障切换顺序
+	envTdFronts   = "CTP_TD_FRONTS" // 逗号分隔，按故障切换顺序
+	envFlowPath   = "CTP_FLOW_PATH"
+)
+
+const defaultConfigPath = "config.json"
+
+// CtpProfile 保存一个 CTP 账户的登录信息和前置地址
+type CtpProfile struct {
+	Name     string   `json:"name"`
+	BrokerID string   `json:"broker_id"`
+	UserID   string   `json:"user_id"`
+	Password string   `json:"password"`
+	AppID    string   `json:"app_id,omitempty"`
+	AuthCode string   `json:"auth_code,omitempty"`
+	MdFronts []string `json:"md_fronts"`           // 行情前置，按故障切换顺序
+	TdFronts []string `json:"td_fronts,omitempty"` // 交易前置，按故障切换顺序
+	FlowPath string   `json:"flow_path,omitempty"` // CTP 流文件目录
+}
+
+// AppConfig 是配置文件的内容
+type AppConfig struct {
+	DefaultProfile string        `json:"default_profile"`
+	Profiles       []*CtpProfile `json:"profiles"`
+}
+
+// defaultCtpProfile 在没有配置文件时使用
+func defaultCtpProfile() *CtpProfile {
+	return &CtpProfile{
+		Name:     "default",
+		BrokerID: "1080",
+		UserID:   "04500",
+		Password: "",
+		MdFronts: []string{"tcp://180.169.112.52:42213"},
+		FlowPath: "flows/",
+	}
+}
+
+// LoadConfig 读取 path 处的配置文件，文件不存在时只包含内置的默认档案
+func LoadConfig(path string) (*AppConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		ctpLog.Info("未找到配置文件，使用内置默认档案", "path", path)
+		return &AppConfig{
+			DefaultProfile: "default",
+			Profiles:       []*CtpProfile{defaultCtpProfile()},
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件 %s 失败: %w", path, err)
+	}
+
+	var cfg AppConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件 %s 失败: %w", path, err)
+	}
+	if len(cfg.Profiles) == 0 {
+		return nil, fmt.Errorf("配置文件 %s 中没有档案", path)
+	}
+	return &cfg, nil
+}
+
+// Profile 返回指定档案的副本并应用环境变量覆盖。名称为空时依次使用
+// $CTP_PROFILE 和默认档案
+func (cfg *AppConfig) Profile(name string) (*CtpProfile, error) {
+	if name == "" {
+		name = os.Getenv(envProfile)
+	}
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		name = cfg.Profiles[0].Name
+	}
+
+	for _, p := range cfg.Profiles {
+		if p.Name != name {
+			continue
+		}
+		profile := *p
+		profile.MdFronts = append([]string(nil), p.MdFronts...)
+		profile.TdFronts = append([]string(nil), p.TdFronts...)
+		profile.applyEnv()
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+		return &profile, nil
+	}
+
+	return nil, fmt.Errorf("未找到档案 %q（可用: %s）", name, strings.Join(cfg.ProfileNames(), ", "))
+}
+
+// ProfileNames 列出配置的档案名称
+func (cfg *AppConfig) ProfileNames() []string {
+	names := make([]string, 0, len(cfg.Profiles))
+	for _, p := range cfg.Profiles {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// applyEnv 用 CTP_* 环境变量覆盖档案字段
+func (p *CtpProfile) applyEnv() {
+	overrides := map[string]*string{
+		envBrokerID: &p.BrokerID,
+		envUserID:   &p.UserID,
+		envPassword: &p.Password,
+		envAppID:    &p.AppID,
+		envAuthCode: &p.AuthCode,
+		envFlowPath: &p.FlowPath,
+	}
+	for key, field := range overrides {
+		if v, ok := os.LookupEnv(key); ok {
+			*field = v
+		}
+	}
+	if v := os.Getenv(envMdFronts); v != "" {
+		p.MdFronts = splitList(v)
+	}
+	if v := os.Getenv(envTdFronts); v != "" {
+		p.TdFronts = splitList(v)
+	}
+	if p.FlowPath == "" {
+		p.FlowPath = "flows/"
+	}
+}
+
+// Validate 检查档案是否可用于连接
+func (p *CtpProfile) Validate() error {
+	if p.BrokerID == "" || p.UserID == "" {
+		return fmt.Errorf("档案 %q: 缺少 broker_id 或 user_id", p.Name)
+	}
+	if len(p.MdFronts) == 0 {
+		return fmt.Errorf("档案 %q: 至少需要一个行情前置", p.Name)
+	}
+	return nil
+}
+
+// String 描述档案，不包含密码等敏感信息
+func (p *CtpProfile) String() string {
+	return fmt.Sprintf("%s (broker=%s user=%s fronts=%v)", p.Name, p.BrokerID, p.UserID, p.MdFronts)
+}
+
+// LogValue 使结构化日志不输出密码和认证码，否则会输出所有字段
+func (p *CtpProfile) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", p.Name),
+		slog.String("broker_id", p.BrokerID),
+		slog.String("user_id", p.UserID),
+		slog.String("app_id", p.AppID),
+		slog.Any("md_fronts", p.MdFronts),
+		slog.Any("td_fronts", p.TdFronts),
+	)
+}
+
+// splitList 按逗号拆分列表，忽略空项
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envOrDefault 返回环境变量的值，未设置时返回 def
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestCtpProfileLogHidesSecrets(t *testing.T) {
+	p := &CtpProfile{Name: "sim", BrokerID: "9999", UserID: "u1", Password: "hunter2", AuthCode: "0000000000000000", MdFronts: []string{"tcp://md:1"}}
+	for _, json := range []bool{false, true} {
+		var buf bytes.Buffer
+		slog.New(newLogOutput(&buf, json)).Info("使用 CTP 配置档案", "profile", p)
+		out := buf.String()
+		if strings.Contains(out, p.Password) || strings.Contains(out, p.AuthCode) {
+			t.Errorf("json=%v: secrets in %s", json, out)
+		}
+		if !strings.Contains(out, "9999") {
+			t.Errorf("json=%v: broker missing from %s", json, out)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Book check modes
+const (
+	BookCheckOff    = "off"    // No checks beyond counting crossed books
+	BookCheckLog    = "log"    // Log and count violations
+	BookCheckRepair = "repair" // Also rebuild broken levels, or the whole book, from L2
+)
+
+// bookCheck is the mode of the invariant checks run after each update.
+// Repairs replace the inferred queue of a level, so they are opt-in.
+var bookCheck = BookCheckLog
+
+// resyncBookLevels is how many broken levels in one update rebuild the whole
+// book instead of level by level
+const resyncBookLevels = 3
+
+// l2Depth is the latest L2 quantity of each level of one side as the feed
+// reported it, best first. It follows the same updates as the reconstructed
+// side, so the two hold the same levels unless the reconstruction is broken.
+type l2Depth struct {
+	desc   bool
+	levels []depthLevel
+}
+
+func (d *l2Depth) search(tick int64) (int, bool) {
+	return slices.BinarySearchFunc(d.levels, tick, func(l depthLevel, t int64) int {
+		if d.desc {
+			return cmp.Compare(t, l.tick)
+		}
+		return cmp.Compare(l.tick, t)
+	})
+}
+
+// replace takes a full snapshot of the side
+func (d *l2Depth) replace(levels []depthLevel) {
+	d.levels = d.levels[:0]
+	for _, l := range levels {
+		if l.qty > 0 {
+			d.levels = append(d.levels, l)
+		}
+	}
+}
+
+// update applies L2 levels the way applyLevels does
+func (d *l2Depth) update(levels []depthLevel) {
+	for _, l := range levels {
+		i, ok := d.search(l.tick)
+		switch {
+		case l.qty <= 0 && ok:
+			d.levels = slices.Delete(d.levels, i, i+1)
+		case l.qty <= 0:
+		case ok:
+			d.levels[i].qty = l.qty
+		default:
+			d.levels = slices.Insert(d.levels, i, l)
+		}
+	}
+	if len(levels) > 0 {
+		i, _ := d.search(levels[0].tick)
+		d.levels = slices.Delete(d.levels, 0, i)
+	}
+}
+
+// crossed reports whether the best bid of bids reaches the best ask of asks
+func crossed(bids, asks []depthLevel) bool {
+	return len(bids) > 0 && len(asks) > 0 && bids[0].tick >= asks[0].tick
+}
+
+// levelFault is a level of an update breaking the book invariants
+type levelFault struct {
+	side  *bookSide
+	tick  int64
+	qty   int64  // L2 quantity
+	kinds uint16 // Bit per anomaly kind
+}
+
+// depthOf returns the L2 view of side
+func (ob *L3OrderBook) depthOf(side *bookSide) *l2Depth {
+	if side == ob.bids {
+		return &ob.bidDepth
+	}
+	return &ob.askDepth
+}
+
+// checkBook verifies the book after an update: the levels of the update must
+// hold their L2 quantity in both queue models, with no empty or negative
+// orders, and the book must not be crossed. Violations are logged and
+// counted; in repair mode broken levels are rebuilt from their L2 quantity,
+// and a crossed or widely broken book is rebuilt from the L2 view.
+func (ob *L3OrderBook) checkBook(bids, asks []depthLevel) {
+	isCrossed := ob.bids.len() > 0 && ob.asks.len() > 0 && ob.bids.levels[0].tick >= ob.asks.levels[0].tick
+	if isCrossed {
+		ob.anomalies.add(anomalyCrossedBook)
+	}
+	if bookCheck == BookCheckOff {
+		return
+	}
+	if isCrossed && !ob.crossed {
+		engineLog.Warn("book crossed", "symbol", ob.symbol,
+			"bid", ob.scale.price(ob.bids.levels[0].tick), "ask", ob.scale.price(ob.asks.levels[0].tick),
+			"l2_crossed", crossed(ob.bidDepth.levels, ob.askDepth.levels))
+	}
+	ob.crossed = isCrossed
+
+	ob.faults = ob.faults[:0]
+	ob.checkLevels(ob.bids, bids)
+	ob.checkLevels(ob.asks, asks)
+	for _, f := range ob.faults {
+		ob.reportFault(f)
+	}
+	if bookCheck != BookCheckRepair {
+		return
+	}
+
+	// A crossed L2 view comes from the feed itself and rebuilding cannot fix it
+	if len(ob.faults) >= resyncBookLevels || isCrossed && !crossed(ob.bidDepth.levels, ob.askDepth.levels) {
+		ob.resyncBook()
+		engineLog.Warn("book rebuilt from L2", "symbol", ob.symbol, "bid_levels", ob.bids.len(), "ask_levels", ob.asks.len())
+		return
+	}
+	for _, f := range ob.faults {
+		ob.resyncLevel(f.side, f.tick, f.qty)
+	}
+}
+
+// checkLevels records a fault for each level of an update that breaks the
+// invariants
+func (ob *L3OrderBook) checkLevels(side *bookSide, levels []depthLevel) {
+	for _, l := range levels {
+		if l.qty <= 0 {
+			if _, ok := side.get(l.tick); ok {
+				ob.faults = append(ob.faults, levelFault{side: side, tick: l.tick, kinds: 1 << anomalySumMismatch})
+			}
+			continue
+		}
+		level, ok := side.get(l.tick)
+		if !ok {
+			ob.faults = append(ob.faults, levelFault{side: side, tick: l.tick, qty: l.qty, kinds: 1 << anomalySumMismatch})
+			continue
+		}
+		if kinds := levelViolations(level, l.qty); kinds != 0 {
+			ob.faults = append(ob.faults, levelFault{side: side, tick: l.tick, qty: l.qty, kinds: kinds})
+		}
+	}
+}
+
+// levelViolations returns the anomaly kinds of a level expected to hold qty.
+// The two queue models take volume from different orders by design, so they
+// are compared on totals; each is checked on its own to be in arrival order:
+// the plain queue by its IDs, which are allocated in increasing order as
+// orders join the back, and the enhanced queue, whose IDs own orders rename,
+// by timestamps.
+func levelViolations(level *bookLevel, qty int64) uint16 {
+	var kinds uint16
+	var sum int64
+	for i, q := range level.queue.orders {
+		if q <= 0 {
+			kinds |= 1 << anomalyBadOrder
+		}
+		if i > 0 && level.queue.ids[i] <= level.queue.ids[i-1] {
+			kinds |= 1 << anomalyOrderSequence
+		}
+		sum += q
+	}
+	if len(level.queue.ids) != len(level.queue.orders) {
+		kinds |= 1 << anomalyOrderSequence
+	}
+	if sum != qty || level.queue.total != qty {
+		kinds |= 1 << anomalySumMismatch
+	}
+	if level.enhanced == nil {
+		return kinds
+	}
+	var enhanced int64
+	for i, o := range level.enhanced.orders {
+		if o.Qty <= 0 {
+			kinds |= 1 << anomalyBadOrder
+		}
+		if i > 0 && o.Timestamp < level.enhanced.orders[i-1].Timestamp {
+			kinds |= 1 << anomalyOrderSequence
+		}
+		enhanced += o.Qty
+	}
+	if enhanced != sum || level.enhanced.totalQty != enhanced {
+		kinds |= 1 << anomalyQueueDisagreement
+	}
+	return kinds
+}
+
+// reportFault counts and logs a broken level
+func (ob *L3OrderBook) reportFault(f levelFault) {
+	side := "ask"
+	if f.side == ob.bids {
+		side = "bid"
+	}
+	var names []string
+	for kind := range numAnomalies {
+		if f.kinds&(1<<kind) != 0 {
+			ob.anomalies.add(kind)
+			names = append(names, anomalyNames[kind])
+		}
+	}
+	args := []any{"symbol", ob.symbol, "side", side, "price", ob.scale.price(f.tick),
+		"l2_qty", f.qty, "violations", strings.Join(names, ",")}
+	if level, ok := f.side.get(f.tick); ok {
+		args = append(args, "orders", len(level.queue.orders), "queue_qty", level.queue.total)
+		if level.enhanced != nil {
+			args = append(args, "enhanced_orders", len(level.enhanced.orders), "enhanced_qty", level.enhanced.totalQty)
+		}
+	}
+	engineLog.Warn("book invariant violated", args...)
+}
+
+// resyncLevel rebuilds the level at tick from qty, or drops it when qty is
+// not positive
+func (ob *L3OrderBook) resyncLevel(side *bookSide, tick, qty int64) {
+	if qty <= 0 {
+		side.remove(tick, RuleResync)
+	} else {
+		old, _ := side.get(tick)
+		level := ob.rebuildLevel(side, old, tick, qty)
+		if old != nil {
+			old.release(RuleResync)
+		}
+		side.insert(level)
+	}
+	ob.levelResyncs.Add(1)
+}
+
+// resyncBook rebuilds both sides from the L2 view. Own orders at levels the
+// view no longer holds go back to pending.
+func (ob *L3OrderBook) resyncBook() {
+	for _, side := range []*bookSide{ob.bids, ob.asks} {
+		depth := ob.depthOf(side).levels
+		levels := make([]bookLevel, len(depth))
+		for i, l := range depth {
+			old, _ := side.get(l.tick)
+			levels[i] = ob.rebuildLevel(side, old, l.tick, l.qty)
+		}
+		side.clear(RuleResync)
+		for _, level := range levels {
+			side.insert(level)
+		}
+	}
+	ob.crossed = false
+	ob.bookResyncs.Add(1)
+}
+
+// rebuildLevel creates a level of qty lots from the L2 quantity alone, except
+// that our own orders in old keep their place: each is preceded by one order
+// for the volume that was ahead of it. When the level shrank, volume ahead is
+// trimmed from the front. The own orders carried over are handed from old to
+// the new level, so releasing old leaves them queued; when they no longer
+// fit, they stay with old and go back to pending.
+func (ob *L3OrderBook) rebuildLevel(side *bookSide, old *bookLevel, tick, qty int64) bookLevel {
+	if old == nil || old.enhanced == nil {
+		return ob.newBookLevel(side, tick, qty, RuleResync)
+	}
+	type ownSlot struct {
+		order *OrderInfo
+		gap   int64 // Volume between the previous own order and this one
+	}
+	var slots []ownSlot
+	var gap, gaps, own int64
+	for _, order := range old.enhanced.orders {
+		if !order.Own {
+			gap += order.Qty
+			continue
+		}
+		slots = append(slots, ownSlot{order, gap})
+		gaps += gap
+		own += order.Qty
+		gap = 0
+	}
+	if len(slots) == 0 || own > qty {
+		return ob.newBookLevel(side, tick, qty, RuleResync)
+	}
+	excess := gaps - (qty - own)
+	for i := range slots {
+		if excess <= 0 {
+			break
+		}
+		cut := min64(excess, slots[i].gap)
+		slots[i].gap -= cut
+		excess -= cut
+	}
+
+	level := bookLevel{
+		tick:     tick,
+		queue:    &OrderQueue{orders: make([]int64, 0, 2*len(slots)+1), ids: make([]uint64, 0, 2*len(slots)+1)},
+		enhanced: NewEnhancedOrderQueue(tick, side == ob.bids, &ob.queues),
+	}
+	// The plain queue knows nothing of own orders and keeps its IDs in
+	// allocation order, so it holds their volume under fresh IDs
+	add := func(id, plainID uint64, qty, ts int64) *OrderInfo {
+		level.queue.push(qty, plainID)
+		level.enhanced.addOrder(id, qty, RuleResync)
+		order := level.enhanced.orders[len(level.enhanced.orders)-1]
+		order.Timestamp = ts
+		return order
+	}
+	placed := int64(0)
+	for _, slot := range slots {
+		if slot.gap > 0 {
+			// Arrived no later than the own order behind it
+			id := ob.queues.ids.Next()
+			add(id, id, slot.gap, slot.order.Timestamp)
+		}
+		carried := add(slot.order.ID, ob.queues.ids.Next(), slot.order.Qty, slot.order.Timestamp)
+		carried.Own, carried.Anchored = true, slot.order.Anchored
+		// Released with old as an ordinary order
+		slot.order.Own, slot.order.Anchored = false, false
+		placed += slot.gap + slot.order.Qty
+	}
+	if rest := qty - placed; rest > 0 {
+		id := ob.queues.ids.Next()
+		add(id, id, rest, ob.queues.clock())
+	}
+	return level
+}
+
+// Resync rebuilds the book from the latest L2 quantities on demand
+func (ob *L3OrderBook) Resync() (bidLevels, askLevels int) {
+	ob.resyncBook()
+	engineLog.Info("book rebuilt from L2 on request", "symbol", ob.symbol, "bid_levels", ob.bids.len(), "ask_levels", ob.asks.len())
+	return ob.bids.len(), ob.asks.len()
+}
+
+// resyncBookOf rebuilds the book of symbol from its latest L2 quantities
+func resyncBookOf(symbol string) (bidLevels, askLevels int, err error) {
+	_, instrumentID := parseSymbol(symbol)
+	book := appState.router.book(instrumentID)
+	if book == nil {
+		return 0, 0, fmt.Errorf("no book for %s", symbol)
+	}
+	if !book.Do(func(ob *L3OrderBook) { bidLevels, askLevels = ob.Resync() }) {
+		return 0, 0, fmt.Errorf("book %s stopped", book.Symbol())
+	}
+	return bidLevels, askLevels, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// setBookCheck switches the check mode for one test
+func setBookCheck(t *testing.T, mode string) {
+	t.Helper()
+	prev := bookCheck
+	bookCheck = mode
+	t.Cleanup(func() { bookCheck = prev })
+}
+
+// applyTestDepth applies full-depth levels the way a CTP tick does
+func applyTestDepth(ob *L3OrderBook, bids, asks []depthLevel) {
+	ob.applyLevels(ob.bids, bids)
+	ob.applyLevels(ob.asks, asks)
+	ob.bidDepth.replace(bids)
+	ob.askDepth.replace(asks)
+	ob.checkBook(bids, asks)
+}
+
+var (
+	testBids = []depthLevel{{tick: 100, qty: 20}, {tick: 99, qty: 5}}
+	testAsks = []depthLevel{{tick: 101, qty: 7}, {tick: 102, qty: 3}}
+)
+
+func TestCheckBookHealthy(t *testing.T) {
+	setBookCheck(t, BookCheckRepair)
+	ob := newTestBook(t)
+	for _, qty := range []int64{20, 25, 13, 30, 1, 8} {
+		bids := []depthLevel{{tick: 100, qty: qty}, {tick: 99, qty: 5}}
+		applyTestDepth(ob, bids, testAsks)
+	}
+	for kind, name := range anomalyNames {
+		if n := ob.anomalies[kind].Load(); n != 0 {
+			t.Errorf("%s counted %d times", name, n)
+		}
+	}
+	if ob.levelResyncs.Load() != 0 || ob.bookResyncs.Load() != 0 {
+		t.Error("healthy book was rebuilt")
+	}
+}
+
+func TestCheckBookViolations(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(level *bookLevel)
+		kind    int
+	}{
+		{"plain sum", func(l *bookLevel) { l.queue.orders[0]-- }, anomalySumMismatch},
+		{"enhanced order size", func(l *bookLevel) { l.enhanced.orders[0].Qty-- }, anomalyQueueDisagreement},
+		{"zero order", func(l *bookLevel) { l.enhanced.orders = append(l.enhanced.orders, &OrderInfo{ID: 1, Timestamp: 2000}) }, anomalyBadOrder},
+		{"repeated id", func(l *bookLevel) {
+			l.queue.ids = append(l.queue.ids, l.queue.ids[0])
+			l.queue.orders = append(l.queue.orders, 0)
+		}, anomalyOrderSequence},
+		{"enhanced order", func(l *bookLevel) {
+			l.enhanced.orders = append(l.enhanced.orders, &OrderInfo{ID: 1, Qty: 1, Timestamp: 1})
+			l.enhanced.orders[0].Qty--
+		}, anomalyOrderSequence},
+	}
+	for _, mode := range []string{BookCheckLog, BookCheckRepair} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				setBookCheck(t, mode)
+				ob := newTestBook(t)
+				applyTestDepth(ob, testBids, testAsks)
+				level, _ := ob.bids.get(100)
+				tt.corrupt(level)
+				applyTestDepth(ob, testBids, testAsks)
+
+				if ob.anomalies[tt.kind].Load() == 0 {
+					t.Errorf("%s not counted", anomalyNames[tt.kind])
+				}
+				level, _ = ob.bids.get(100)
+				broken := levelViolations(level, 20) != 0
+				if mode == BookCheckLog && (!broken || ob.levelResyncs.Load() != 0) {
+					t.Error("log mode changed the level")
+				}
+				if mode == BookCheckRepair && (broken || ob.levelResyncs.Load() != 1) {
+					t.Errorf("repair left the level broken (%v) after %d resyncs", broken, ob.levelResyncs.Load())
+				}
+			})
+		}
+	}
+}
+
+func TestCheckBookRepairKeepsOwnOrders(t *testing.T) {
+	setBookCheck(t, BookCheckRepair)
+	ob := newTestBook(t)
+	applyTestDepth(ob, testBids, testAsks)
+	status, err := ob.RegisterOwnOrder(OwnOrderRequest{Symbol: "test", Side: "bid", Price: "100", Qty: 5, SubmitTime: "0"})
+	if err != nil || status.State != OwnQueued || status.VolumeAhead != 15 {
+		t.Fatalf("register: %v, %s behind %d", err, status.State, status.VolumeAhead)
+	}
+
+	// Broken plain queue while the level shrinks by 12: the rebuilt level keeps
+	// our order and trims the volume ahead of it
+	level, _ := ob.bids.get(100)
+	level.queue.orders[0]--
+	bids := []depthLevel{{tick: 100, qty: 8}, {tick: 99, qty: 5}}
+	applyTestDepth(ob, bids, testAsks)
+	ob.refreshOwnOrders()
+
+	own := ob.OwnOrders()[0]
+	if ob.levelResyncs.Load() != 1 || own.State != OwnQueued || own.VolumeAhead != 3 || own.ID != status.ID {
+		t.Errorf("after repair: %d resyncs, %s behind %d", ob.levelResyncs.Load(), own.State, own.VolumeAhead)
+	}
+	level, _ = ob.bids.get(100)
+	if kinds := levelViolations(level, 8); kinds != 0 {
+		t.Errorf("rebuilt level breaks invariants: %b", kinds)
+	}
+}
+
+func TestCheckBookCrossed(t *testing.T) {
+	setBookCheck(t, BookCheckRepair)
+	ob := newTestBook(t)
+	applyTestDepth(ob, testBids, testAsks)
+	// A stale ask the L2 view does not have
+	ob.asks.insert(ob.newBookLevel(ob.asks, 99, 4, RuleVolumeIncrease))
+	ob.checkBook(nil, nil)
+	if ob.anomalies[anomalyCrossedBook].Load() != 1 || ob.bookResyncs.Load() != 1 {
+		t.Fatalf("crossed %d, book resyncs %d", ob.anomalies[anomalyCrossedBook].Load(), ob.bookResyncs.Load())
+	}
+	if ob.asks.levels[0].tick != 101 {
+		t.Errorf("best ask %d after resync, want 101", ob.asks.levels[0].tick)
+	}
+
+	// Crossed in the feed itself: counted, nothing to rebuild from
+	applyTestDepth(ob, []depthLevel{{tick: 102, qty: 1}}, testAsks)
+	if ob.bookResyncs.Load() != 1 {
+		t.Error("rebuilt a book crossed in L2")
+	}
+}
+
+func TestL2DepthUpdate(t *testing.T) {
+	bids := l2Depth{desc: true}
+	bids.replace([]depthLevel{{100, 1}, {98, 2}, {97, 0}})
+	bids.update([]depthLevel{{99, 3}, {98, 0}, {97, 4}})
+	if want := []depthLevel{{99, 3}, {97, 4}}; !slices.Equal(bids.levels, want) {
+		t.Errorf("bids %v, want %v", bids.levels, want)
+	}
+	asks := l2Depth{}
+	asks.replace([]depthLevel{{100, 1}, {102, 2}})
+	asks.update([]depthLevel{{101, 3}})
+	if want := []depthLevel{{101, 3}, {102, 2}}; !slices.Equal(asks.levels, want) {
+		t.Errorf("asks %v, want %v", asks.levels, want)
+	}
+}
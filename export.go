@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// ExportOptions configures an export run
+type ExportOptions struct {
+	Source   string    // Tick replay file (JSON lines) or snapshot history database (.db)
+	Symbol   string    // Instrument, may be exchange-qualified
+	Out      string    // Output prefix, writes <out>.orders.<format> and <out>.levels.<format>
+	Formats  []string  // csv and/or parquet
+	From, To time.Time // Time range of exported snapshots, zero bounds are open
+	Levels   int       // Levels per side to export, 0 exports all
+	Clusters int       // K-means clusters when replaying ticks, 0 disables clustering
+}
+
+// OrderRow is one order of an exported snapshot
+type OrderRow struct {
+	Timestamp int64   `parquet:"timestamp,timestamp(millisecond)"`
+	Symbol    string  `parquet:"symbol,dict"`
+	Side      string  `parquet:"side,dict"`
+	Level     int32   `parquet:"level"` // Depth index, 0 is the best level
+	Price     float64 `parquet:"price"`
+	Position  int32   `parquet:"position"` // Queue position, 0 is the front
+	OrderID   uint64  `parquet:"order_id"` // Synthetic ID, 0 when enhanced queues are off
+	Qty       int64   `parquet:"qty"`
+	AgeMs     int64   `parquet:"age_ms"`
+	Cluster   int32   `parquet:"cluster"` // -1 when clustering is off
+	IsPartial bool    `parquet:"is_partial"`
+}
+
+var orderRowHeader = []string{"timestamp", "symbol", "side", "level", "price", "position", "order_id", "qty", "age_ms", "cluster", "is_partial"}
+
+func (r *OrderRow) csvRecord() []string {
+	return []string{
+		strconv.FormatInt(r.Timestamp, 10), r.Symbol, r.Side,
+		strconv.Itoa(int(r.Level)), strconv.FormatFloat(r.Price, 'f', -1, 64),
+		strconv.Itoa(int(r.Position)), strconv.FormatUint(r.OrderID, 10),
+		strconv.FormatInt(r.Qty, 10), strconv.FormatInt(r.AgeMs, 10),
+		strconv.Itoa(int(r.Cluster)), strconv.FormatBool(r.IsPartial),
+	}
+}
+
+// LevelRow aggregates one price level of an exported snapshot
+type LevelRow struct {
+	Timestamp     int64   `parquet:"timestamp,timestamp(millisecond)"`
+	Symbol        string  `parquet:"symbol,dict"`
+	Side          string  `parquet:"side,dict"`
+	Level         int32   `parquet:"level"`
+	Price         float64 `parquet:"price"`
+	TotalSize     int64   `parquet:"total_size"`
+	OrderCount    int32   `parquet:"order_count"`
+	MaxOrder      int64   `parquet:"max_order"`
+	AvgOrder      float64 `parquet:"avg_order"`
+	PartialOrders int32   `parquet:"partial_orders"`
+	AvgAgeMs      float64 `parquet:"avg_age_ms"`
+}
+
+var levelRowHeader = []string{"timestamp", "symbol", "side", "level", "price", "total_size", "order_count", "max_order", "avg_order", "partial_orders", "avg_age_ms"}
+
+func (r *LevelRow) csvRecord() []string {
+	return []string{
+		strconv.FormatInt(r.Timestamp, 10), r.Symbol, r.Side,
+		strconv.Itoa(int(r.Level)), strconv.FormatFloat(r.Price, 'f', -1, 64),
+		strconv.FormatInt(r.TotalSize, 10), strconv.Itoa(int(r.OrderCount)),
+		strconv.FormatInt(r.MaxOrder, 10), strconv.FormatFloat(r.AvgOrder, 'f', -1, 64),
+		strconv.Itoa(int(r.PartialOrders)), strconv.FormatFloat(r.AvgAgeMs, 'f', -1, 64),
+	}
+}
+
+// exportSink writes the rows of one table in one format
+type exportSink[T any] interface {
+	Write(rows []T) error
+	Close() error
+}
+
+// csvSink writes rows as CSV records
+type csvSink[T any] struct {
+	file   *os.File
+	w      *csv.Writer
+	record func(row *T) []string
+}
+
+func newCSVSink[T any](path string, header []string, record func(row *T) []string) (*csvSink[T], error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	w := csv.NewWriter(file)
+	if err := w.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &csvSink[T]{file: file, w: w, record: record}, nil
+}
+
+func (s *csvSink[T]) Write(rows []T) error {
+	for i := range rows {
+		if err := s.w.Write(s.record(&rows[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *csvSink[T]) Close() error {
+	s.w.Flush()
+	if err := s.w.Error(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// parquetSink writes rows to a zstd-compressed Parquet file
+type parquetSink[T any] struct {
+	file *os.File
+	w    *parquet.GenericWriter[T]
+}
+
+func newParquetSink[T any](path string) (*parquetSink[T], error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	return &parquetSink[T]{file: file, w: parquet.NewGenericWriter[T](file, parquet.Compression(&parquet.Zstd))}, nil
+}
+
+func (s *parquetSink[T]) Write(rows []T) error {
+	_, err := s.w.Write(rows)
+	return err
+}
+
+func (s *parquetSink[T]) Close() error {
+	if err := s.w.Close(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// Exporter flattens L3 snapshots into order and level rows
+type Exporter struct {
+	opts      ExportOptions
+	orders    []exportSink[OrderRow]
+	levels    []exportSink[LevelRow]
+	orderRows []OrderRow // Reused between snapshots
+	levelRows []LevelRow
+
+	snapshots, orderCount, levelCount int
+}
+
+// NewExporter creates the output files for every requested format
+func NewExporter(opts ExportOptions) (*Exporter, error) {
+	e := &Exporter{opts: opts}
+	for _, format := range opts.Formats {
+		ordersPath := opts.Out + ".orders." + format
+		levelsPath := opts.Out + ".levels." + format
+		switch format {
+		case "csv":
+			orders, err := newCSVSink(ordersPath, orderRowHeader, (*OrderRow).csvRecord)
+			if err != nil {
+				e.Close()
+				return nil, err
+			}
+			e.orders = append(e.orders, orders)
+			levels, err := newCSVSink(levelsPath, levelRowHeader, (*LevelRow).csvRecord)
+			if err != nil {
+				e.Close()
+				return nil, err
+			}
+			e.levels = append(e.levels, levels)
+		case "parquet":
+			orders, err := newParquetSink[OrderRow](ordersPath)
+			if err != nil {
+				e.Close()
+				return nil, err
+			}
+			e.orders = append(e.orders, orders)
+			levels, err := newParquetSink[LevelRow](levelsPath)
+			if err != nil {
+				e.Close()
+				return nil, err
+			}
+			e.levels = append(e.levels, levels)
+		default:
+			e.Close()
+			return nil, fmt.Errorf("unknown export format %q, use csv or parquet", format)
+		}
+	}
+	return e, nil
+}
+
+// inRange reports whether a snapshot time passes the time filter
+func (e *Exporter) inRange(ms int64) bool {
+	if !e.opts.From.IsZero() && ms < e.opts.From.UnixMilli() {
+		return false
+	}
+	return e.opts.To.IsZero() || ms <= e.opts.To.UnixMilli()
+}
+
+// Add writes the rows of one snapshot taken at ms
+func (e *Exporter) Add(ms int64, snapshot *L3Snapshot) error {
+	if !e.inRange(ms) {
+		return nil
+	}
+	e.orderRows = e.orderRows[:0]
+	e.levelRows = e.levelRows[:0]
+	e.addSide(ms, snapshot.Symbol, "bid", snapshot.Bids)
+	e.addSide(ms, snapshot.Symbol, "ask", snapshot.Asks)
+
+	for _, sink := range e.orders {
+		if err := sink.Write(e.orderRows); err != nil {
+			return fmt.Errorf("failed to write order rows: %w", err)
+		}
+	}
+	for _, sink := range e.levels {
+		if err := sink.Write(e.levelRows); err != nil {
+			return fmt.Errorf("failed to write level rows: %w", err)
+		}
+	}
+	e.snapshots++
+	e.orderCount += len(e.orderRows)
+	e.levelCount += len(e.levelRows)
+	return nil
+}
+
+func (e *Exporter) addSide(ms int64, symbol, side string, levels []L3Level) {
+	if e.opts.Levels > 0 && len(levels) > e.opts.Levels {
+		levels = levels[:e.opts.Levels]
+	}
+	for i := range levels {
+		level := &levels[i]
+		price := level.Price.InexactFloat64()
+
+		row := LevelRow{
+			Timestamp:  ms,
+			Symbol:     symbol,
+			Side:       side,
+			Level:      int32(i),
+			Price:      price,
+			TotalSize:  level.TotalSize,
+			OrderCount: int32(level.OrderCount),
+			MaxOrder:   level.MaxOrder,
+			AvgOrder:   level.AvgOrder,
+		}
+		if m := level.QueueMetrics; m != nil {
+			row.PartialOrders = int32(m.PartialOrders)
+			row.AvgAgeMs = m.AvgAge
+		}
+		e.levelRows = append(e.levelRows, row)
+
+		// Ages and partial fills live in the enhanced queue; without it fall
+		// back to the plain quantities and their IDs
+		if len(level.OrderDetails) > 0 {
+			for pos, order := range level.OrderDetails {
+				e.orderRows = append(e.orderRows, OrderRow{
+					Timestamp: ms,
+					Symbol:    symbol,
+					Side:      side,
+					Level:     int32(i),
+					Price:     price,
+					Position:  int32(pos),
+					OrderID:   order.ID,
+					Qty:       order.Qty,
+					AgeMs:     ms - order.Timestamp,
+					Cluster:   clusterAt(level.ClusteredOrders, pos, order.Qty),
+					IsPartial: order.IsPartial,
+				})
+			}
+			continue
+		}
+		for pos, qty := range level.Orders {
+			row := OrderRow{
+				Timestamp: ms,
+				Symbol:    symbol,
+				Side:      side,
+				Level:     int32(i),
+				Price:     price,
+				Position:  int32(pos),
+				Qty:       qty,
+				Cluster:   clusterAt(level.ClusteredOrders, pos, qty),
+			}
+			if pos < len(level.OrderIDs) {
+				row.OrderID = level.OrderIDs[pos]
+			}
+			e.orderRows = append(e.orderRows, row)
+		}
+	}
+}
+
+// clusterAt returns the cluster of the order at pos. Clusters are computed on
+// the plain queue, so they only apply when that queue holds the same quantity
+// at the same position.
+func clusterAt(clustered []*ClusteredOrder, pos int, qty int64) int32 {
+	if pos < len(clustered) && clustered[pos].Qty == qty {
+		return int32(clustered[pos].Cluster)
+	}
+	return -1
+}
+
+// Close flushes and closes all output files
+func (e *Exporter) Close() error {
+	var firstErr error
+	for _, sink := range e.orders {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, sink := range e.levels {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// tickTime returns the exchange time of a recorded tick in Unix milliseconds
+func tickTime(t *SimTick) (int64, bool) {
+	ts, err := time.ParseInLocation("20060102 15:04:05", t.TradingDay+" "+t.UpdateTime, exchangeLocation)
+	if err != nil {
+		return 0, false
+	}
+	return ts.UnixMilli() + int64(t.UpdateMillisec), true
+}
+
+// exportReplay rebuilds the book from recorded ticks and exports a snapshot
+// after every tick. Ticks before the time range still build up the queues.
+// Order timestamps and ages follow the tick time, not the wall clock.
+func exportReplay(e *Exporter, path string) error {
+	ticks, err := LoadSimTicks(path)
+	if err != nil {
+		return err
+	}
+
+	exchange, instrumentID := parseSymbol(e.opts.Symbol)
+	book := NewL3OrderBook(instrumentID)
+	if e.opts.Clusters > 0 {
+		book.SetKmeansMode(true)
+		book.SetNumClusters(e.opts.Clusters)
+	}
+	var now int64
+	book.SetClock(func() int64 { return now })
+
+	depth := e.opts.Levels
+	if depth <= 0 {
+		depth = math.MaxInt
+	}
+	for _, t := range ticks {
+		if t.InstrumentID != instrumentID || (exchange != "" && t.ExchangeID != "" && t.ExchangeID != exchange) {
+			continue
+		}
+		ms, ok := tickTime(t)
+		if !ok {
+			engineLog.Warn("skipping tick with invalid time", "trading_day", t.TradingDay, "update_time", t.UpdateTime)
+			continue
+		}
+		if !e.opts.To.IsZero() && ms > e.opts.To.UnixMilli() {
+			break
+		}
+		now = ms
+		book.applyDepthMarketData(t.ToDepthMarketData())
+		snapshot := book.getL3Snapshot(depth)
+		if err := e.Add(ms, &snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportHistory exports snapshots recorded in a snapshot history database
+func exportHistory(e *Exporter, path string) error {
+	history, err := OpenSnapshotHistory(path, 0)
+	if err != nil {
+		return err
+	}
+	defer history.Close()
+
+	_, instrumentID := parseSymbol(e.opts.Symbol)
+	return history.Scan(instrumentID, e.opts.From, e.opts.To, func(record *HistoryRecord) error {
+		var snapshot L3Snapshot
+		if err := json.Unmarshal(record.Snapshot, &snapshot); err != nil {
+			return fmt.Errorf("failed to parse snapshot at %d: %w", record.RecordedAt, err)
+		}
+		return e.Add(record.RecordedAt, &snapshot)
+	})
+}
+
+// runExport writes the L3 data of opts.Source to CSV and/or Parquet files
+func runExport(opts ExportOptions) error {
+	e, err := NewExporter(opts)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(opts.Source), ".db") {
+		err = exportHistory(e, opts.Source)
+	} else {
+		err = exportReplay(e, opts.Source)
+	}
+	if closeErr := e.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	engineLog.Info("export finished", "snapshots", e.snapshots, "symbol", opts.Symbol, "order_rows", e.orderCount,
+		"level_rows", e.levelCount, "out", opts.Out+".{orders,levels}.{"+strings.Join(opts.Formats, ",")+"}")
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	depletionWindow    = 30 * time.Second // Time constant of the depletion rate average
+	depletionMinWindow = time.Second      // Shortest span a young level's rate is averaged over
+)
+
+// fillHorizon is the horizon of the fill probabilities in published snapshots
+var fillHorizon = defaultFillHorizon
+
+// depletionRate tracks how fast volume leaves a price level, as exponentially
+// decaying sums of lots removed from the front of the queue (fills) and from
+// inside it (cancellations and large removals)
+type depletionRate struct {
+	front  float64 // Decayed lots filled at the front
+	inside float64 // Decayed lots removed elsewhere
+	last   int64   // Time of the last update, Unix milliseconds
+	since  int64   // Time the level appeared
+}
+
+// decayFactor is the weight a decaying sum keeps after the time from last
+// to now, in Unix milliseconds. Nothing decays before the first update.
+func decayFactor(last, now int64) float64 {
+	if dt := now - last; dt > 0 && last > 0 {
+		return math.Exp(-float64(dt) / float64(depletionWindow.Milliseconds()))
+	}
+	return 1
+}
+
+// rateSeconds is the span a decaying sum started at since is averaged over.
+// Sources younger than the window average over their age instead.
+func rateSeconds(since, now int64) float64 {
+	window := depletionWindow.Milliseconds()
+	if age := max64(now-since, depletionMinWindow.Milliseconds()); age < window {
+		window = age
+	}
+	return float64(window) / 1000
+}
+
+// frontRule reports whether volume removed under rule left from the front of
+// the queue, as fills do
+func frontRule(rule string) bool {
+	return rule == RuleFIFO || rule == RuleTradeAnchor
+}
+
+// record adds qty lots removed under rule
+func (d *depletionRate) record(qty int64, rule string, now int64) {
+	f := decayFactor(d.last, now)
+	d.front *= f
+	d.inside *= f
+	d.last = now
+	if frontRule(rule) {
+		d.front += float64(qty)
+	} else {
+		d.inside += float64(qty)
+	}
+}
+
+// rates returns the front and inside removal rates in lots per second
+func (d *depletionRate) rates(now int64) (front, inside float64) {
+	f := decayFactor(d.last, now) / rateSeconds(d.since, now)
+	return d.front * f, d.inside * f
+}
+
+// FillEstimate predicts when orders at a level fill, from the rate the level
+// has been depleting. Times are in seconds, -1 when the level has not traded
+// recently enough to tell.
+type FillEstimate struct {
+	FillRate       float64   `json:"fill_rate"`         // Lots per second filled at the front
+	CancelRate     float64   `json:"cancel_rate"`       // Lots per second removed from inside the queue
+	Horizon        float64   `json:"horizon"`           // Seconds the probabilities refer to
+	BackTimeToFill float64   `json:"back_time_to_fill"` // One lot joining the back of the queue
+	BackFillProb   float64   `json:"back_fill_prob"`
+	TimeToFill     []float64 `json:"time_to_fill,omitempty"` // Per order, aligned with order_details
+	FillProb       []float64 `json:"fill_prob,omitempty"`
+}
+
+// EstimateFill predicts time to fill and fill probability within horizon
+// seconds for each order in the queue and for one lot joining the back.
+//
+// Fills take volume from the front, while cancellations hit the volume ahead
+// of an order in proportion to its share of the level. With A lots ahead, q
+// lots of its own and a level of Q lots, the volume ahead drains at
+// fill + cancel*A/Q and the order itself only at the fill rate. The expected
+// time is the sum of both phases, and the probability treats the removals as
+// a Poisson process at the average rate over that time.
+func (eq *EnhancedOrderQueue) EstimateFill(horizon float64) FillEstimate {
+	now := eq.ctx.clock()
+	fill, cancel := eq.depletion.rates(now)
+	est := FillEstimate{
+		FillRate:   fill,
+		CancelRate: cancel,
+		Horizon:    horizon,
+		TimeToFill: make([]float64, len(eq.orders)),
+		FillProb:   make([]float64, len(eq.orders)),
+	}
+
+	total := eq.totalQty
+	var ahead int64
+	for i, order := range eq.orders {
+		est.TimeToFill[i], est.FillProb[i] = estimateFill(ahead, order.Qty, total, fill, cancel, horizon)
+		ahead += order.Qty
+	}
+	est.BackTimeToFill, est.BackFillProb = estimateFill(total, 1, total+1, fill, cancel, horizon)
+	return est
+}
+
+// estimateFill returns the expected time to fill of qty lots behind ahead
+// lots in a level of total lots, and the probability of filling within horizon
+func estimateFill(ahead, qty, total int64, fill, cancel, horizon float64) (timeToFill, prob float64) {
+	if fill <= 0 {
+		return -1, 0
+	}
+	timeToFill = float64(qty) / fill
+	if ahead > 0 {
+		timeToFill += float64(ahead) / (fill + cancel*float64(ahead)/float64(total))
+	}
+	need := ahead + qty
+	return timeToFill, fillProbability(need, float64(need)/timeToFill*horizon)
+}
+
+// LevelFillEstimate is the fill estimate of one price level
+type LevelFillEstimate struct {
+	Price     decimal.Decimal `json:"price"`
+	TotalSize int64           `json:"total_size"`
+	FillEstimate
+}
+
+// FillEstimates returns the estimates of the best levels of each side for a
+// horizon in seconds
+func (ob *L3OrderBook) FillEstimates(levels int, horizon float64) (bids, asks []LevelFillEstimate) {
+	side := func(bs *bookSide) []LevelFillEstimate {
+		out := []LevelFillEstimate{}
+		for _, bl := range bs.top(levels) {
+			if bl.enhanced == nil {
+				continue
+			}
+			out = append(out, LevelFillEstimate{
+				Price:        ob.scale.price(bl.tick),
+				TotalSize:    bl.enhanced.GetTotalQty(),
+				FillEstimate: bl.enhanced.EstimateFill(horizon),
+			})
+		}
+		return out
+	}
+	return side(ob.bids), side(ob.asks)
+}
+
+// fillEstimates returns the estimates of the book of symbol
+func fillEstimates(symbol string, levels int, horizon float64) (bids, asks []LevelFillEstimate, err error) {
+	_, instrumentID := parseSymbol(symbol)
+	book := appState.router.book(instrumentID)
+	if book == nil {
+		return nil, nil, fmt.Errorf("no book for %s", symbol)
+	}
+	if !book.Do(func(ob *L3OrderBook) { bids, asks = ob.FillEstimates(levels, horizon) }) {
+		return nil, nil, fmt.Errorf("book %s stopped", book.Symbol())
+	}
+	return bids, asks, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	frontProbeTimeout  = 3 * time.Second
+	failoverRetryDelay = 5 * time.Second
+)
+
+// FrontStats 记录单个前置地址的探测结果与连接统计
+type FrontStats struct {
+	Addr                 string  `json:"addr"`
+	Rank                 int     `json:"rank"` // 按探测延迟的排名，从 1 开始
+	Active               bool    `json:"active"`
+	ProbeLatencyMs       float64 `json:"probe_latency_ms"`
+	ProbeError           string  `json:"probe_error,omitempty"`
+	LastProbed           int64   `json:"last_probed,omitempty"`
+	Connects             int     `json:"connects"`
+	ConnectFailures      int     `json:"connect_failures"`
+	Disconnects          int     `json:"disconnects"`
+	HeartbeatWarnings    int     `json:"heartbeat_warnings"`
+	Failovers            int     `json:"failovers"` // 从该前置切走的次数
+	LastDisconnectReason int     `json:"last_disconnect_reason,omitempty"`
+	LastConnected        int64   `json:"last_connected,omitempty"`
+}
+
+// setFronts 重置前置列表
+func (mdctp *MdCtp) setFronts(frontAddrs []string) {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+
+	mdctp.fronts = make([]*FrontStats, len(frontAddrs))
+	mdctp.ranked = make([]int, len(frontAddrs))
+	for i, addr := range frontAddrs {
+		mdctp.fronts[i] = &FrontStats{Addr: addr, Rank: i + 1}
+		mdctp.ranked[i] = i
+	}
+}
+
+// probeFront 测量到前置地址的 TCP 连接耗时
+func probeFront(addr string) (time.Duration, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return 0, fmt.Errorf("解析前置地址失败: %w", err)
+	}
+	if u.Scheme == "sim" {
+		return 0, nil // 本地模拟前置
+	}
+	if u.Host == "" {
+		return 0, fmt.Errorf("前置地址缺少 host:port: %s", addr)
+	}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", u.Host, frontProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// ProbeFronts 并发探测所有前置的连接延迟，返回按延迟排序的前置索引。
+// 探测失败的前置排在最后，延迟相同时保持配置顺序。
+func (mdctp *MdCtp) ProbeFronts() []int {
+	mdctp.mu.Lock()
+	addrs := make([]string, len(mdctp.fronts))
+	for i, fs := range mdctp.fronts {
+		addrs[i] = fs.Addr
+	}
+	mdctp.mu.Unlock()
+
+	latencies := make([]time.Duration, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			latencies[i], errs[i] = probeFront(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	ranked := make([]int, len(addrs))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		ia, ib := ranked[a], ranked[b]
+		if (errs[ia] == nil) != (errs[ib] == nil) {
+			return errs[ia] == nil
+		}
+		return latencies[ia] < latencies[ib]
+	})
+
+	now := time.Now().UnixMilli()
+	mdctp.mu.Lock()
+	for i, fs := range mdctp.fronts {
+		fs.LastProbed = now
+		fs.ProbeLatencyMs = float64(latencies[i].Microseconds()) / 1000
+		fs.ProbeError = ""
+		if errs[i] != nil {
+			fs.ProbeError = errs[i].Error()
+		}
+	}
+	for rank, idx := range ranked {
+		mdctp.fronts[idx].Rank = rank + 1
+	}
+	mdctp.ranked = ranked
+	mdctp.mu.Unlock()
+
+	for _, idx := range ranked {
+		if errs[idx] != nil {
+			ctpLog.Warn("前置探测失败", "front", addrs[idx], "err", errs[idx])
+		} else {
+			ctpLog.Info("前置探测", "front", addrs[idx], "latency", latencies[idx])
+		}
+	}
+	return append([]int(nil), ranked...)
+}
+
+// connectFront 使用新的 MdApi 连接指定前置，等待 OnFrontConnected
+func (mdctp *MdCtp) connectFront(idx int) error {
+	mdctp.mu.Lock()
+	if mdctp.isClosed() {
+		mdctp.mu.Unlock()
+		return errMdUnavailable
+	}
+	addr := mdctp.fronts[idx].Addr
+	old := mdctp.mdapi
+	started := mdctp.started
+	if started {
+		mdctp.mdapi = nil // 由这里释放，Release 不再重复释放
+	}
+	mdctp.activeFront = -1
+	mdctp.connected = false
+	mdctp.mu.Unlock()
+
+	// 已初始化的 MdApi 无法更换前置，需要释放后重建
+	api := old
+	if started {
+		old.Release()
+		api = mdctp.newMdApi()
+	}
+
+	f := newRspFuture()
+	mdctp.mu.Lock()
+	if mdctp.isClosed() {
+		// 重建期间调用了 Release
+		mdctp.mu.Unlock()
+		if started {
+			api.Release()
+		}
+		return errMdUnavailable
+	}
+	mdctp.mdapi = api
+	mdctp.started = true
+	mdctp.connectF = f
+	mdctp.mu.Unlock()
+
+	ctpLog.Info("连接前置", "front", addr)
+	api.RegisterSpi(mdctp)
+	api.RegisterFront(addr)
+	api.Init()
+	err := f.wait(mdctp.RspTimeout)
+
+	mdctp.mu.Lock()
+	fs := mdctp.fronts[idx]
+	if err != nil {
+		fs.ConnectFailures++
+		mdctp.connectF = nil
+	} else {
+		fs.Connects++
+		fs.LastConnected = time.Now().UnixMilli()
+		mdctp.activeFront = idx
+	}
+	mdctp.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("前置 %s: %w", addr, err)
+	}
+	return nil
+}
+
+// recordFrontEvent 更新当前前置的统计信息
+func (mdctp *MdCtp) recordFrontEvent(update func(fs *FrontStats)) {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+	if mdctp.activeFront >= 0 {
+		update(mdctp.fronts[mdctp.activeFront])
+	}
+}
+
+// failoverOrder 返回故障切换时尝试的前置顺序：排名在当前前置之后的优先，当前前置放在最后
+func (mdctp *MdCtp) failoverOrder(active int) []int {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+
+	pos := 0
+	for i, idx := range mdctp.ranked {
+		if idx == active {
+			pos = i
+			break
+		}
+	}
+	order := make([]int, 0, len(mdctp.ranked))
+	order = append(order, mdctp.ranked[pos+1:]...)
+	order = append(order, mdctp.ranked[:pos+1]...)
+	return order
+}
+
+// failover 在心跳超时或前置断开时切换到下一个前置，并恢复登录和订阅
+func (mdctp *MdCtp) failover(reason string) {
+	mdctp.mu.Lock()
+	active := mdctp.activeFront
+	closed := mdctp.isClosed()
+	mdctp.mu.Unlock()
+
+	// 仅在已建立连接时切换，连接过程中的断开由 Connect 处理；Release 引起的断开不再切换
+	if active < 0 || closed || !mdctp.failingOver.CompareAndSwap(false, true) {
+		return
+	}
+
+	mdctp.recordFrontEvent(func(fs *FrontStats) {
+		fs.Failovers++
+	})
+	ctpLog.Warn("前置故障，开始切换", "reason", reason)
+
+	go func() {
+		defer mdctp.failingOver.Store(false)
+		for {
+			for _, idx := range mdctp.failoverOrder(active) {
+				if err := mdctp.connectFront(idx); errors.Is(err, errMdUnavailable) {
+					ctpLog.Info("MdCtp 已释放，停止故障切换")
+					return
+				} else if err != nil {
+					ctpLog.Warn("故障切换失败", "err", err)
+					continue
+				}
+				if err := mdctp.restoreSession(); err != nil {
+					ctpLog.Warn("故障切换后恢复会话失败", "err", err)
+					continue
+				}
+				ctpLog.Info("已切换到前置", "front", mdctp.fronts[idx].Addr)
+				return
+			}
+			ctpLog.Error("所有前置均不可用，稍后重试", "retry_in", failoverRetryDelay)
+			select {
+			case <-mdctp.closed:
+				ctpLog.Info("MdCtp 已释放，停止故障切换")
+				return
+			case <-time.After(failoverRetryDelay):
+			}
+		}
+	}()
+}
+
+// restoreSession 在新前置上重新登录并订阅之前的合约
+func (mdctp *MdCtp) restoreSession() error {
+	mdctp.mu.Lock()
+	loggedIn := mdctp.loggedIn
+	instrumentIDs := make([]string, 0, len(mdctp.subscribed))
+	for id := range mdctp.subscribed {
+		instrumentIDs = append(instrumentIDs, id)
+	}
+	mdctp.mu.Unlock()
+
+	if !loggedIn {
+		return nil
+	}
+	if err := mdctp.Login(); err != nil {
+		return err
+	}
+	if len(instrumentIDs) > 0 {
+		return mdctp.SubscribeMarketData(instrumentIDs...)
+	}
+	return nil
+}
+
+// FrontStats 返回所有前置的统计信息副本
+func (mdctp *MdCtp) FrontStats() []FrontStats {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+
+	stats := make([]FrontStats, len(mdctp.fronts))
+	for i, fs := range mdctp.fronts {
+		stats[i] = *fs
+		stats[i].Active = i == mdctp.activeFront
+	}
+	return stats
+}
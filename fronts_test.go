@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// silentMdApi is a simulated front that never connects or acknowledges
+// unsubscriptions
+type silentMdApi struct {
+	*SimMdApi
+	connect bool
+}
+
+func (api *silentMdApi) Init() {
+	if api.connect {
+		api.SimMdApi.Init()
+	}
+}
+
+func (api *silentMdApi) UnSubscribeMarketData(instrumentIDs ...string) int { return 0 }
+
+// newTestMdCtp returns a client whose first MdApi connects and later ones
+// never do, counting the MdApis created
+func newTestMdCtp(t *testing.T) (*MdCtp, *atomic.Int32) {
+	t.Helper()
+	var created atomic.Int32
+	mdctp := newMdCtp(func() thost.MdApi {
+		n := created.Add(1)
+		return &silentMdApi{SimMdApi: NewSimMdApi(SimOptions{Seed: 1}), connect: n == 1}
+	}, "u1", "9999")
+	mdctp.RspTimeout = 50 * time.Millisecond
+	if err := mdctp.Connect("sim://a", "sim://b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdctp.Login(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mdctp.Release)
+	return mdctp, &created
+}
+
+func TestMdCtpNoFailoverAfterRelease(t *testing.T) {
+	mdctp, created := newTestMdCtp(t)
+	mdctp.Release()
+	// The disconnect raised by Release itself
+	mdctp.OnFrontDisconnected(0x1001)
+	if mdctp.failingOver.Load() || created.Load() != 1 {
+		t.Errorf("failover started after Release, %d MdApis created", created.Load())
+	}
+	if err := mdctp.Login(); err == nil {
+		t.Error("login succeeded on a released client")
+	}
+}
+
+func TestMdCtpReleaseStopsFailover(t *testing.T) {
+	mdctp, _ := newTestMdCtp(t)
+	mdctp.OnHeartBeatWarning(30)
+	if !mdctp.failingOver.Load() {
+		t.Fatal("failover not started")
+	}
+	// Both fronts time out, the retry waits failoverRetryDelay
+	time.Sleep(3 * mdctp.RspTimeout)
+	mdctp.Release()
+	for deadline := time.Now().Add(time.Second); mdctp.failingOver.Load(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("failover still retrying after Release")
+		}
+	}
+}
+
+func TestMdCtpUnsubscribeKeepsUnacknowledged(t *testing.T) {
+	mdctp, _ := newTestMdCtp(t)
+	if err := mdctp.SubscribeMarketData("ag2510", "au2510"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdctp.UnsubscribeMarketData("ag2510"); err == nil {
+		t.Fatal("unacknowledged unsubscribe succeeded")
+	}
+	if _, ok := mdctp.subscribed["ag2510"]; !ok || len(mdctp.subscribed) != 2 {
+		t.Errorf("subscribed %v after a failed unsubscribe, want both kept", mdctp.subscribed)
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	tests := []struct {
+		ranked []int
+		active int
+		want   []int
+	}{
+		{[]int{0, 1, 2}, 0, []int{1, 2, 0}},
+		{[]int{0, 1, 2}, 1, []int{2, 0, 1}},
+		{[]int{0, 1, 2}, 2, []int{0, 1, 2}},
+		{[]int{2, 0, 1}, 2, []int{0, 1, 2}},
+		{[]int{2, 0, 1}, 1, []int{2, 0, 1}},
+		{[]int{0}, 0, []int{0}},
+	}
+	for _, tt := range tests {
+		mdctp := &MdCtp{ranked: tt.ranked}
+		if got := mdctp.failoverOrder(tt.active); !slices.Equal(got, tt.want) {
+			t.Errorf("ranked %v active %d: got %v, want %v", tt.ranked, tt.active, got, tt.want)
+		}
+	}
+}
+
+func TestProbeFrontsRanking(t *testing.T) {
+	// A port nothing listens on fails fast; invalid addresses fail to parse
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "tcp://" + ln.Addr().String()
+	ln.Close()
+
+	mdctp := newMdCtp(func() thost.MdApi { return NewSimMdApi(SimOptions{Seed: 1}) }, "u1", "9999")
+	mdctp.setFronts([]string{closed, "tcp://", "sim://a", "sim://b"})
+	ranked := mdctp.ProbeFronts()
+	if want := []int{2, 3, 0, 1}; !slices.Equal(ranked, want) {
+		t.Errorf("ranked %v, want reachable fronts first in config order: %v", ranked, want)
+	}
+	for rank, idx := range ranked {
+		fs := mdctp.fronts[idx]
+		if fs.Rank != rank+1 || (fs.ProbeError != "") != (idx < 2) {
+			t.Errorf("front %s: rank %d, probe error %q", fs.Addr, fs.Rank, fs.ProbeError)
+		}
+	}
+}
+
+func TestMdCtpFailoverSwitchesFront(t *testing.T) {
+	mdctp := CreateSimMdCtp("u1", "9999", SimOptions{Seed: 1})
+	mdctp.RspTimeout = time.Second
+	if err := mdctp.Connect("sim://a", "sim://b"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mdctp.Release)
+	if err := mdctp.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mdctp.SubscribeMarketData("ag2510"); err != nil {
+		t.Fatal(err)
+	}
+	first := mdctp.api()
+
+	mdctp.OnHeartBeatWarning(30)
+	for deadline := time.Now().Add(2 * time.Second); mdctp.failingOver.Load(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("failover did not finish")
+		}
+	}
+	stats := mdctp.FrontStats()
+	if stats[0].Failovers != 1 || stats[0].Active || !stats[1].Active || stats[1].Connects != 1 {
+		t.Errorf("after failover: %+v", stats)
+	}
+	api, ok := mdctp.api().(*SimMdApi)
+	if !ok || api == first {
+		t.Fatal("failover kept the old MdApi")
+	}
+	api.mu.Lock()
+	subscribed := api.subscribed["ag2510"]
+	api.mu.Unlock()
+	if !subscribed || !mdctp.LoggedIn() {
+		t.Error("session not restored on a new MdApi")
+	}
+}
@@ -3,14 +3,18 @@ module goctp_l3_estimate
 go 1.22.4
 
 require (
-	github.com/gookit/goutil v0.7.0
 	github.com/gorilla/websocket v1.5.3
+	github.com/parquet-go/parquet-go v0.25.1
 	github.com/pseudocodes/go2ctp v0.0.0-20250619052923-425680661560
 	github.com/shopspring/decimal v1.4.0
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	golang.org/x/sys v0.30.0 // indirect
-	golang.org/x/term v0.29.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultHistoryPath      = "history.db"
+	defaultHistoryKeyframe  = 5 * time.Second
+	defaultHistoryRetention = 24 * time.Hour
+	historyPruneInterval    = time.Hour
+)
+
+// ErrNoHistory is returned when no snapshot was recorded at or before the requested time
+var ErrNoHistory = errors.New("no snapshot recorded")
+
+// SnapshotHistory persists L3 snapshots in a local bbolt database so the
+// book can be inspected at past timestamps. Each symbol has a bucket keyed by
+// the big-endian recording time in milliseconds; values are gzip-compressed
+// snapshot JSON.
+type SnapshotHistory struct {
+	db        *bolt.DB
+	retention time.Duration // Records older than this are pruned, 0 keeps everything
+}
+
+// HistoryRecord is one persisted snapshot
+type HistoryRecord struct {
+	Symbol     string          `json:"symbol"`
+	RecordedAt int64           `json:"recorded_at"` // Unix milliseconds
+	Snapshot   json.RawMessage `json:"data"`        // L3Snapshot JSON
+}
+
+// HistoryRange describes the recorded span of a symbol
+type HistoryRange struct {
+	Symbol string `json:"symbol"`
+	First  int64  `json:"first"` // Unix milliseconds, 0 when empty
+	Last   int64  `json:"last"`
+	Count  int    `json:"count"`
+}
+
+// OpenSnapshotHistory opens or creates the history database at path
+func OpenSnapshotHistory(path string, retention time.Duration) (*SnapshotHistory, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot history %s: %w", path, err)
+	}
+	return &SnapshotHistory{db: db, retention: retention}, nil
+}
+
+// historyKey encodes a recording time as a sortable key
+func historyKey(ms int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(ms))
+	return key
+}
+
+// Put stores a snapshot recorded at the given time
+func (h *SnapshotHistory) Put(at time.Time, snapshot *L3Snapshot) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snapshot); err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(snapshot.Symbol))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(historyKey(at.UnixMilli()), buf.Bytes())
+	})
+}
+
+// At returns the latest snapshot of symbol recorded at or before the given time
+func (h *SnapshotHistory) At(symbol string, at time.Time) (*HistoryRecord, error) {
+	var record *HistoryRecord
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(symbol))
+		if bucket == nil {
+			return ErrNoHistory
+		}
+
+		c := bucket.Cursor()
+		target := historyKey(at.UnixMilli())
+		k, v := c.Seek(target)
+		if k == nil || !bytes.Equal(k, target) {
+			// Seek lands on the first key after the target, step back to the one before it
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return ErrNoHistory
+		}
+
+		data, err := gunzip(v)
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot: %w", err)
+		}
+		record = &HistoryRecord{
+			Symbol:     symbol,
+			RecordedAt: int64(binary.BigEndian.Uint64(k)),
+			Snapshot:   data,
+		}
+		return nil
+	})
+	return record, err
+}
+
+// Scan calls fn for each snapshot of symbol recorded in [from, to], oldest
+// first. Zero bounds are open. Iteration stops at the first error.
+func (h *SnapshotHistory) Scan(symbol string, from, to time.Time, fn func(record *HistoryRecord) error) error {
+	return h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(symbol))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		k, v := c.First()
+		if !from.IsZero() {
+			k, v = c.Seek(historyKey(from.UnixMilli()))
+		}
+		for ; k != nil; k, v = c.Next() {
+			recordedAt := int64(binary.BigEndian.Uint64(k))
+			if !to.IsZero() && recordedAt > to.UnixMilli() {
+				break
+			}
+			data, err := gunzip(v)
+			if err != nil {
+				return fmt.Errorf("failed to decode snapshot at %d: %w", recordedAt, err)
+			}
+			if err := fn(&HistoryRecord{Symbol: symbol, RecordedAt: recordedAt, Snapshot: data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// gunzip decompresses a stored value. bbolt values are only valid inside the
+// transaction, so the result is always a fresh copy.
+func gunzip(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Range returns the recorded span of symbol
+func (h *SnapshotHistory) Range(symbol string) (HistoryRange, error) {
+	r := HistoryRange{Symbol: symbol}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(symbol))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		if k, _ := c.First(); k != nil {
+			r.First = int64(binary.BigEndian.Uint64(k))
+		}
+		if k, _ := c.Last(); k != nil {
+			r.Last = int64(binary.BigEndian.Uint64(k))
+		}
+		r.Count = bucket.Stats().KeyN
+		return nil
+	})
+	return r, err
+}
+
+// Prune deletes records older than the retention and returns how many were removed
+func (h *SnapshotHistory) Prune(now time.Time) (int, error) {
+	if h.retention <= 0 {
+		return 0, nil
+	}
+	cutoff := historyKey(now.Add(-h.retention).UnixMilli())
+
+	removed := 0
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			c := bucket.Cursor()
+			// Deleting under a cursor can skip the next key, so restart from the first each time
+			for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				removed++
+			}
+			return nil
+		})
+	})
+	return removed, err
+}
+
+// Record stores the active book's snapshot whenever it changes, and at least
+// every keyframe interval while unchanged, until done is closed. Snapshots
+// are immutable and only republished when the book changed, so a new pointer
+// means a new state.
+func (h *SnapshotHistory) Record(active func() *BookActor, keyframe time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	var last *L3Snapshot
+	var lastWrite, lastPrune time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			snapshot := active().Snapshot()
+			if snapshot != last || now.Sub(lastWrite) >= keyframe {
+				if err := h.Put(now, snapshot); err != nil {
+					engineLog.Error("record snapshot history failed", "err", err)
+				}
+				last, lastWrite = snapshot, now
+			}
+
+			if now.Sub(lastPrune) >= historyPruneInterval {
+				if n, err := h.Prune(now); err != nil {
+					engineLog.Error("prune snapshot history failed", "err", err)
+				} else if n > 0 {
+					engineLog.Info("pruned snapshot history", "snapshots", n, "retention", h.retention)
+				}
+				lastPrune = now
+			}
+		}
+	}
+}
+
+// Close closes the database
+func (h *SnapshotHistory) Close() error {
+	return h.db.Close()
+}
+
+// exchangeLocation is the time zone of CTP feed timestamps (China Standard Time)
+var exchangeLocation = time.FixedZone("CST", 8*3600)
+
+// parseHistoryTime parses a point in time given as Unix milliseconds, RFC 3339,
+// "2006-01-02 15:04:05[.000]" or a time of day such as "10:31:05.250", which
+// refers to today. Times without a zone are exchange time (UTC+8).
+func parseHistoryTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", s, exchangeLocation); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("15:04:05.999999999", s, exchangeLocation); err == nil {
+		now := time.Now().In(exchangeLocation)
+		return time.Date(now.Year(), now.Month(), now.Day(),
+			t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), exchangeLocation), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use Unix milliseconds, RFC 3339, YYYY-MM-DD HH:MM:SS or HH:MM:SS[.mmm]", s)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestHistory opens an empty history in a temporary directory and stores
+// a snapshot of symbol at each of the given Unix milliseconds
+func newTestHistory(t *testing.T, records map[string][]int64) *SnapshotHistory {
+	t.Helper()
+	h, err := OpenSnapshotHistory(filepath.Join(t.TempDir(), "history.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	h.db.NoSync = true // A sync per Put only slows the test down
+
+	for symbol, times := range records {
+		for _, ms := range times {
+			if err := h.Put(time.UnixMilli(ms), &L3Snapshot{Symbol: symbol, Timestamp: ms}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return h
+}
+
+func TestSnapshotHistoryAt(t *testing.T) {
+	// Enough records to span several leaf pages, so the cursor steps back
+	// across page boundaries
+	many := make([]int64, 500)
+	for i := range many {
+		many[i] = 10_000 + int64(i)*10
+	}
+	h := newTestHistory(t, map[string][]int64{
+		"test":  {1000, 2000, 3000},
+		"other": {500, 5000},
+		"many":  many,
+	})
+
+	tests := []struct {
+		symbol string
+		at     int64
+		want   int64 // Recording time of the expected snapshot, 0 for ErrNoHistory
+	}{
+		{"test", 999, 0}, // Before the first snapshot
+		{"test", 1000, 1000},
+		{"test", 1500, 1000},
+		{"test", 2000, 2000},
+		{"test", 2999, 2000},
+		{"test", 3000, 3000},
+		{"test", 3001, 3000}, // After the last snapshot
+		{"test", 1 << 50, 3000},
+		{"other", 1000, 500}, // Other symbols' records do not leak in
+		{"other", 4999, 500},
+		{"missing", 1000, 0},
+		{"many", 9_999, 0},
+		{"many", 10_000, 10_000},
+		{"many", 12_345, 12_340},
+		{"many", 14_990, 14_990},
+		{"many", 1 << 50, 14_990},
+	}
+	for _, tt := range tests {
+		record, err := h.At(tt.symbol, time.UnixMilli(tt.at))
+		if tt.want == 0 {
+			if !errors.Is(err, ErrNoHistory) {
+				t.Errorf("%s at %d: got %v, %v, want ErrNoHistory", tt.symbol, tt.at, record, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s at %d: %v", tt.symbol, tt.at, err)
+			continue
+		}
+		var snapshot L3Snapshot
+		if err := json.Unmarshal(record.Snapshot, &snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if record.RecordedAt != tt.want || snapshot.Timestamp != tt.want || snapshot.Symbol != tt.symbol {
+			t.Errorf("%s at %d: snapshot of %s recorded at %d, want %d",
+				tt.symbol, tt.at, snapshot.Symbol, record.RecordedAt, tt.want)
+		}
+	}
+}
+
+func TestSnapshotHistoryScanAndPrune(t *testing.T) {
+	h := newTestHistory(t, map[string][]int64{"test": {1000, 2000, 3000, 4000}})
+
+	scan := func(from, to int64) []int64 {
+		var got []int64
+		var fromT, toT time.Time
+		if from > 0 {
+			fromT = time.UnixMilli(from)
+		}
+		if to > 0 {
+			toT = time.UnixMilli(to)
+		}
+		err := h.Scan("test", fromT, toT, func(record *HistoryRecord) error {
+			got = append(got, record.RecordedAt)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	tests := []struct {
+		from, to int64
+		want     []int64
+	}{
+		{0, 0, []int64{1000, 2000, 3000, 4000}},
+		{2000, 3000, []int64{2000, 3000}},
+		{1500, 3500, []int64{2000, 3000}},
+		{4001, 0, nil},
+		{0, 999, nil},
+	}
+	for _, tt := range tests {
+		if got := scan(tt.from, tt.to); !slices.Equal(got, tt.want) {
+			t.Errorf("scan [%d, %d] = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	h.retention = time.Second
+	if n, err := h.Prune(time.UnixMilli(3500)); err != nil || n != 2 {
+		t.Fatalf("pruned %d, %v, want 2", n, err)
+	}
+	r, err := h.Range("test")
+	if err != nil || r.First != 3000 || r.Last != 4000 || r.Count != 2 {
+		t.Errorf("range after pruning %+v, %v", r, err)
+	}
+}
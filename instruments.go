@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultInstrumentStorePath = "instruments.json"
+
+// InstrumentStore 是持久化的本地合约字典。可以从磁盘加载、从 JSON/CSV 文件导入
+// 或从 OpenCTP 字典 API 刷新，查询时不需要网络
+type InstrumentStore struct {
+	path        string
+	instruments map[string]*Instrument // InstrumentID -> 合约
+	lowerIndex  map[string]string      // 小写 InstrumentID -> InstrumentID
+	updatedAt   int64
+	mu          sync.RWMutex
+}
+
+// instrumentStoreFile 是字典文件的格式
+type instrumentStoreFile struct {
+	UpdatedAt   int64        `json:"updated_at"`
+	Instruments []Instrument `json:"instruments"`
+}
+
+// NewInstrumentStore 创建保存在 path 的合约字典，path 为空时只保存在内存中
+func NewInstrumentStore(path string) *InstrumentStore {
+	return &InstrumentStore{
+		path:        path,
+		instruments: make(map[string]*Instrument),
+		lowerIndex:  make(map[string]string),
+	}
+}
+
+// Load 读取字典文件，文件不存在时字典为空
+func (s *InstrumentStore) Load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取合约字典 %s 失败: %w", s.path, err)
+	}
+
+	var file instrumentStoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("解析合约字典 %s 失败: %w", s.path, err)
+	}
+	s.Put(file.Instruments)
+
+	s.mu.Lock()
+	s.updatedAt = file.UpdatedAt
+	s.mu.Unlock()
+	precisionLog.Info("已加载合约字典", "count", len(file.Instruments), "path", s.path)
+	return nil
+}
+
+// Save 原子地写入字典文件
+func (s *InstrumentStore) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	file := instrumentStoreFile{
+		UpdatedAt:   s.updatedAt,
+		Instruments: make([]Instrument, 0, len(s.instruments)),
+	}
+	for _, inst := range s.instruments {
+		file.Instruments = append(file.Instruments, *inst)
+	}
+	s.mu.RUnlock()
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("编码合约字典失败: %w", err)
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("创建合约字典目录失败: %w", err)
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("写入合约字典失败: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// validPriceTick 判断最小变动价位能否用于换算价格
+func validPriceTick(tick float64) bool {
+	return tick > 0 && !math.IsInf(tick, 1)
+}
+
+// Put 添加或替换合约，返回保存的数量。最小变动价位不为正的合约被跳过，
+// 查询时使用默认精度
+func (s *InstrumentStore) Put(instruments []Instrument) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored int
+	var invalid []string
+	for i := range instruments {
+		inst := instruments[i]
+		if inst.InstrumentID == "" {
+			continue
+		}
+		if !validPriceTick(inst.PriceTick) {
+			invalid = append(invalid, inst.InstrumentID)
+			continue
+		}
+		s.instruments[inst.InstrumentID] = &inst
+		s.lowerIndex[strings.ToLower(inst.InstrumentID)] = inst.InstrumentID
+		stored++
+	}
+	if len(invalid) > 0 {
+		precisionLog.Warn("跳过最小变动价位无效的合约", "count", len(invalid), "instruments", invalid)
+	}
+	s.updatedAt = time.Now().Unix()
+	return stored
+}
+
+// Get 按合约代码查询，找不到时忽略大小写匹配
+func (s *InstrumentStore) Get(instrumentID string) (*Instrument, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	inst, ok := s.instruments[instrumentID]
+	if !ok {
+		if id, found := s.lowerIndex[strings.ToLower(instrumentID)]; found {
+			inst, ok = s.instruments[id]
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	copied := *inst
+	return &copied, true
+}
+
+// Count 返回字典中的合约数量
+func (s *InstrumentStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.instruments)
+}
+
+// UpdatedAt 返回最后修改时间（Unix 秒）
+func (s *InstrumentStore) UpdatedAt() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.updatedAt
+}
+
+// Refresh 从字典 API 拉取指定品种的期货和期权，保存并写入字典文件
+func (s *InstrumentStore) Refresh(products []string) (int, error) {
+	resp, err := GetInstruments(
+		[]string{"futures", "option"},
+		[]string{}, // 所有国家/地区
+		[]string{}, // 所有交易所
+		products,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("获取合约信息失败: %w", err)
+	}
+
+	stored := s.Put(resp.Data)
+	if err := s.Save(); err != nil {
+		precisionLog.Error("保存合约字典失败", "err", err)
+	}
+	precisionLog.Info("已刷新合约字典", "count", stored, "products", products)
+	return stored, nil
+}
+
+// ImportFile 从 JSON 或 CSV 文件导入合约并写入字典文件。JSON 可以是合约数组
+// 或字典 API 的应答；CSV 首行为列名，使用 Instrument 的 JSON 字段名
+func (s *InstrumentStore) ImportFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("打开 %s 失败: %w", path, err)
+	}
+	defer file.Close()
+
+	var instruments []Instrument
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		instruments, err = parseInstrumentsCSV(file)
+	} else {
+		instruments, err = parseInstrumentsJSON(file)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("导入 %s 失败: %w", path, err)
+	}
+
+	stored := s.Put(instruments)
+	if err := s.Save(); err != nil {
+		return stored, err
+	}
+	precisionLog.Info("已导入合约", "count", stored, "skipped", len(instruments)-stored, "path", path)
+	return stored, nil
+}
+
+// parseInstrumentsJSON 解析合约数组、字典 API 应答或字典文件
+func parseInstrumentsJSON(r io.Reader) ([]Instrument, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Instrument
+	if err := json.Unmarshal(data, &list); err == nil {
+		return list, nil
+	}
+
+	var wrapped struct {
+		Data        []Instrument `json:"data"`
+		Instruments []Instrument `json:"instruments"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, err
+	}
+	return append(wrapped.Data, wrapped.Instruments...), nil
+}
+
+// parseInstrumentsCSV 按 JSON 字段名把 CSV 列映射到 Instrument 字段
+func parseInstrumentsCSV(r io.Reader) ([]Instrument, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("读取 CSV 列名失败: %w", err)
+	}
+
+	fieldByName := make(map[string]int)
+	instType := reflect.TypeOf(Instrument{})
+	for i := 0; i < instType.NumField(); i++ {
+		name := strings.Split(instType.Field(i).Tag.Get("json"), ",")[0]
+		fieldByName[strings.ToLower(name)] = i
+	}
+	columns := make([]int, len(header))
+	for i, name := range header {
+		idx, ok := fieldByName[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			idx = -1
+		}
+		columns[i] = idx
+	}
+
+	var instruments []Instrument
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", line, err)
+		}
+
+		var inst Instrument
+		v := reflect.ValueOf(&inst).Elem()
+		for i, value := range record {
+			if i >= len(columns) || columns[i] < 0 || value == "" {
+				continue
+			}
+			if err := setInstrumentField(v.Field(columns[i]), value); err != nil {
+				return nil, fmt.Errorf("第 %d 行 %s 列: %w", line, header[i], err)
+			}
+		}
+		instruments = append(instruments, inst)
+	}
+	return instruments, nil
+}
+
+// setInstrumentField 把 CSV 值解析到 string、int、float64 或 *float64 字段
+func setInstrumentField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Ptr:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(&f))
+	}
+	return nil
+}
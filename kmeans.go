@@ -4,16 +4,6 @@ import (
 	"math"
 	"math/rand"
 	"sort"
-	"sync"
-
-	"github.com/shopspring/decimal"
-)
-
-// Global K-means instances for persistent centroids
-var (
-	globalBidKMeans  *MiniBatchKMeans
-	globalAskKMeans  *MiniBatchKMeans
-	kmeansInitMutex  sync.Mutex
 )
 
 // Point structure for clustering (using qty only for simplicity)
@@ -21,13 +11,13 @@ type Point struct {
 	qty float64
 }
 
-// MiniBatchKMeans implements the mini-batch K-means algorithm for order clustering
+// MiniBatchKMeans implements the mini-batch K-means algorithm for order clustering.
+// Each book side keeps its own instance so centroids persist between snapshots.
 type MiniBatchKMeans struct {
 	numClusters int
 	batchSize   int
 	maxIter     int
 	centroids   []Point
-	mu          sync.RWMutex
 }
 
 // NewMiniBatchKMeans creates a new MiniBatchKMeans instance
@@ -127,30 +117,16 @@ func (kmeans *MiniBatchKMeans) closestCentroid(p Point) int {
 }
 
 // Fit performs mini-batch K-means clustering on the order book data
-func (kmeans *MiniBatchKMeans) Fit(orderBook map[string]*OrderQueue) []int {
-	kmeans.mu.Lock()
-	defer kmeans.mu.Unlock()
-
+func (kmeans *MiniBatchKMeans) Fit(levels []bookLevel) []int {
 	var points []Point
-	var orderList []struct {
-		price string
-		qty   decimal.Decimal
-	}
 
-	// Extract points from order book
-	for price, queue := range orderBook {
-		queue.mu.RLock()
-		for _, qty := range queue.orders {
-			if qty.GreaterThan(decimal.Zero) {
-				qtyFloat, _ := qty.Float64()
-				points = append(points, Point{qty: qtyFloat})
-				orderList = append(orderList, struct {
-					price string
-					qty   decimal.Decimal
-				}{price: price, qty: qty})
+	// Extract points from order book, in level order so labels line up with ClusterOrderBook
+	for _, level := range levels {
+		for _, qty := range level.orderSizes(nil) {
+			if qty > 0 {
+				points = append(points, Point{qty: float64(qty)})
 			}
 		}
-		queue.mu.RUnlock()
 	}
 
 	if len(points) == 0 {
@@ -234,39 +210,23 @@ func (kmeans *MiniBatchKMeans) Fit(orderBook map[string]*OrderQueue) []int {
 
 // ClusteredOrder represents an order with its cluster assignment
 type ClusteredOrder struct {
-	Qty     decimal.Decimal `json:"qty"`
-	Cluster int             `json:"cluster"`
+	Qty     int64 `json:"qty"`
+	Cluster int   `json:"cluster"`
 }
 
-// ClusterOrderBook applies K-means clustering to an order book
-func ClusterOrderBook(orderBook map[string]*OrderQueue, numClusters int, isBid bool) map[string][]*ClusteredOrder {
-	kmeansInitMutex.Lock()
-	var kmeans *MiniBatchKMeans
-	
-	if isBid {
-		if globalBidKMeans == nil || globalBidKMeans.numClusters != numClusters {
-			globalBidKMeans = NewMiniBatchKMeans(numClusters, 1024, 1024)
-		}
-		kmeans = globalBidKMeans
-	} else {
-		if globalAskKMeans == nil || globalAskKMeans.numClusters != numClusters {
-			globalAskKMeans = NewMiniBatchKMeans(numClusters, 1024, 1024)
-		}
-		kmeans = globalAskKMeans
-	}
-	kmeansInitMutex.Unlock()
-	
-	labels := kmeans.Fit(orderBook)
+// ClusterOrderBook applies K-means clustering to one side of an order book
+func ClusterOrderBook(kmeans *MiniBatchKMeans, levels []bookLevel) map[int64][]*ClusteredOrder {
+	labels := kmeans.Fit(levels)
 
-	clusteredOrders := make(map[string][]*ClusteredOrder)
+	clusteredOrders := make(map[int64][]*ClusteredOrder)
 	labelIdx := 0
 
-	for price, queue := range orderBook {
-		queue.mu.RLock()
-		orders := make([]*ClusteredOrder, 0, len(queue.orders))
+	for _, level := range levels {
+		sizes := level.orderSizes(nil)
+		orders := make([]*ClusteredOrder, 0, len(sizes))
 		
-		for _, qty := range queue.orders {
-			if qty.GreaterThan(decimal.Zero) {
+		for _, qty := range sizes {
+			if qty > 0 {
 				cluster := 0
 				if labelIdx < len(labels) {
 					cluster = labels[labelIdx]
@@ -281,9 +241,8 @@ func ClusterOrderBook(orderBook map[string]*OrderQueue, numClusters int, isBid b
 		}
 		
 		if len(orders) > 0 {
-			clusteredOrders[price] = orders
+			clusteredOrders[level.tick] = orders
 		}
-		queue.mu.RUnlock()
 	}
 
 	return clusteredOrders
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	sizeWindow          = 2048            // Recent order sizes per product
+	sizeMinSamples      = 200             // Sizes needed before flagging outliers
+	icebergRefillWindow = 2 * time.Second // Max delay from a fill to its refill
+	icebergIdle         = time.Minute     // Refill pattern forgotten after this long
+)
+
+var (
+	detectLargeOrders = true // Run the whale and iceberg detector on new books
+	whaleZ            = 3.0  // Standard deviations of log size above the mean that make a whale
+	icebergRefills    = 3    // Identical refills that make an iceberg
+)
+
+// orderDetector inspects the order events of a book after each update and
+// returns the alerts they raise. scores holds the size score of each ADD
+// event. Detectors run on the book's actor goroutine.
+type orderDetector interface {
+	detect(ob *L3OrderBook, events []rawOrderEvent, scores []sizeScore) []Alert
+}
+
+// sizeScore rates an added order against its product's recent sizes
+type sizeScore struct {
+	z     float64 // Standard deviations of log size above the mean
+	share float64 // Share of recent orders with the same size
+	ready bool    // Enough sizes were seen to judge
+}
+
+// sizeStats is a rolling distribution of order sizes shared by the books of
+// a product. Sizes are heavy tailed, so outliers are judged on log size.
+type sizeStats struct {
+	mu     sync.Mutex
+	logs   [sizeWindow]float64 // Ring of log sizes
+	sizes  [sizeWindow]int64
+	next   int
+	n      int
+	sum    float64 // Of logs in the ring
+	sumSq  float64
+	counts map[int64]int // Sizes in the ring
+}
+
+var (
+	productSizesMu sync.Mutex
+	productSizes   = make(map[string]*sizeStats)
+)
+
+// productSizeStats returns the shared size distribution of a product
+func productSizeStats(product string) *sizeStats {
+	productSizesMu.Lock()
+	defer productSizesMu.Unlock()
+	s := productSizes[product]
+	if s == nil {
+		s = &sizeStats{counts: make(map[int64]int)}
+		productSizes[product] = s
+	}
+	return s
+}
+
+// observe scores qty against the sizes seen so far and then adds it
+func (s *sizeStats) observe(qty int64) sizeScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var score sizeScore
+	l := math.Log(float64(qty))
+	if s.n >= sizeMinSamples {
+		mean := s.sum / float64(s.n)
+		variance := s.sumSq/float64(s.n) - mean*mean
+		if variance > 1e-9 {
+			score.z = (l - mean) / math.Sqrt(variance)
+		}
+		score.share = float64(s.counts[qty]) / float64(s.n)
+		score.ready = true
+	}
+
+	if s.n == sizeWindow {
+		old := s.logs[s.next]
+		s.sum -= old
+		s.sumSq -= old * old
+		if s.counts[s.sizes[s.next]]--; s.counts[s.sizes[s.next]] == 0 {
+			delete(s.counts, s.sizes[s.next])
+		}
+	} else {
+		s.n++
+	}
+	s.logs[s.next], s.sizes[s.next] = l, qty
+	s.sum += l
+	s.sumSq += l * l
+	s.counts[qty]++
+	s.next = (s.next + 1) % sizeWindow
+	return score
+}
+
+// refillState follows the fills and refills of one price level
+type refillState struct {
+	lastFill   int64 // Time of the last front fill not yet refilled, 0 when none
+	lastRefill int64
+	clip       int64 // Size of the refills
+	refills    int
+	alerted    int // Refill count at the last alert
+}
+
+type levelKey struct {
+	bid  bool
+	tick int64
+}
+
+// largeOrderDetector flags whale orders against the product's size
+// distribution and iceberg-like refill patterns at a level
+type largeOrderDetector struct {
+	levels map[levelKey]*refillState
+}
+
+func newLargeOrderDetector() *largeOrderDetector {
+	return &largeOrderDetector{levels: make(map[levelKey]*refillState)}
+}
+
+func (d *largeOrderDetector) detect(ob *L3OrderBook, events []rawOrderEvent, scores []sizeScore) []Alert {
+	var out []Alert
+	for i, ev := range events {
+		key := levelKey{ev.bid, ev.tick}
+		switch ev.kind {
+		case EventAdd:
+			if ev.rule == RuleResync {
+				continue
+			}
+			if score := scores[i]; score.ready && score.z >= whaleZ {
+				// 0.5 at the threshold, approaching 1 further out
+				confidence := 0.5 * math.Erfc(-(score.z-whaleZ)/math.Sqrt2)
+				out = append(out, ob.alert(AlertWhale, ev, ev.qty, confidence,
+					fmt.Sprintf("order of %d lots is %.1f standard deviations above the usual size", ev.qty, score.z)))
+			}
+			if a, ok := d.refilled(ob, key, ev, scores[i].share); ok {
+				out = append(out, a)
+			}
+
+		case EventFill, EventPartialFill:
+			if frontRule(ev.rule) {
+				st := d.levels[key]
+				if st == nil {
+					st = &refillState{}
+					d.levels[key] = st
+				}
+				st.lastFill = ev.ts
+			}
+
+		case EventLevelCleared:
+			delete(d.levels, key)
+		}
+	}
+	return out
+}
+
+// refilled tracks an add at a level and reports an iceberg once the level has
+// been refilled with the same size icebergRefills times right after fills.
+// share is how common the size is, which makes chance repeats likelier.
+func (d *largeOrderDetector) refilled(ob *L3OrderBook, key levelKey, ev rawOrderEvent, share float64) (Alert, bool) {
+	st := d.levels[key]
+	if st == nil || st.lastFill == 0 || ev.ts-st.lastFill > icebergRefillWindow.Milliseconds() {
+		return Alert{}, false
+	}
+	st.lastFill = 0
+	if ev.qty != st.clip || ev.ts-st.lastRefill > icebergIdle.Milliseconds() {
+		st.clip, st.refills, st.alerted = ev.qty, 0, 0
+	}
+	st.refills++
+	st.lastRefill = ev.ts
+
+	// Alert at the threshold and again each time the pattern doubles
+	if st.refills < icebergRefills || (st.alerted > 0 && st.refills < 2*st.alerted) {
+		return Alert{}, false
+	}
+	st.alerted = st.refills
+	confidence := 1 - math.Pow(math.Max(share, 0.05), float64(st.refills-1))
+	return ob.alert(AlertIceberg, ev, st.clip, confidence,
+		fmt.Sprintf("refilled %d times with %d lots right after fills, %d lots shown so far", st.refills, st.clip, int64(st.refills)*st.clip)), true
+}
+
+// alert builds an alert about the level of ev
+func (ob *L3OrderBook) alert(kind string, ev rawOrderEvent, size int64, confidence float64, message string) Alert {
+	side := "ask"
+	if ev.bid {
+		side = "bid"
+	}
+	return Alert{
+		Type:       kind,
+		Symbol:     ob.symbol,
+		Side:       side,
+		Price:      ob.scale.price(ev.tick),
+		Size:       size,
+		Confidence: confidence,
+		OrderID:    ev.id,
+		Timestamp:  ev.ts,
+		Message:    message,
+	}
+}
+
+// productOf returns the product code of a book, e.g. "ag" for ag2510
+func (ob *L3OrderBook) productOf() string {
+	if ob.precision != nil && ob.precision.ProductID != "" {
+		return ob.precision.ProductID
+	}
+	return ExtractContractPrefix(ob.symbol)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// subsystem is a named logger with its own level, adjustable at runtime
+type subsystem struct {
+	name   string
+	level  slog.LevelVar
+	out    atomic.Pointer[slog.Handler] // Output handler tagged with the subsystem
+	logger *slog.Logger
+}
+
+// subsystems by name, fixed at init
+var subsystems = map[string]*subsystem{}
+
+// Subsystem loggers
+var (
+	ctpLog       = newSubsystem("ctp")       // CTP market data and trader connections, simulated fronts
+	engineLog    = newSubsystem("engine")    // Books, detectors, recorders and history
+	wsLog        = newSubsystem("ws")        // HTTP API and WebSocket clients
+	kmeansLog    = newSubsystem("kmeans")    // Order size clustering
+	precisionLog = newSubsystem("precision") // Instrument dictionary and tick sizes
+)
+
+func newSubsystem(name string) *slog.Logger {
+	s := &subsystem{name: name}
+	s.logger = slog.New(&subsystemHandler{sub: s})
+	subsystems[name] = s
+	s.setOutput(newLogOutput(os.Stderr, false))
+	return s.logger
+}
+
+func (s *subsystem) setOutput(h slog.Handler) {
+	h = h.WithAttrs([]slog.Attr{slog.String("subsys", s.name)})
+	s.out.Store(&h)
+}
+
+// subsystemHandler filters records by the level of its subsystem and hands
+// them to the current output, so outputs and levels can change after loggers
+// were handed out
+type subsystemHandler struct {
+	sub *subsystem
+	ops []func(slog.Handler) slog.Handler // WithAttrs and WithGroup calls, replayed on the output
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.sub.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := *h.sub.out.Load()
+	for _, op := range h.ops {
+		out = op(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) *subsystemHandler {
+	return &subsystemHandler{sub: h.sub, ops: append(slices.Clip(h.ops), op)}
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler { return out.WithGroup(name) })
+}
+
+// newLogOutput returns a text or JSON handler writing every level to w, with
+// sources shortened to file:line
+func newLogOutput(w io.Writer, json bool) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelDebug - 4, // Subsystems filter
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.SourceKey && len(groups) == 0 {
+				if src, ok := a.Value.Any().(*slog.Source); ok {
+					return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(src.File), src.Line))
+				}
+			}
+			return a
+		},
+	}
+	if json {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging selects the output format and levels. levels is the default
+// level, optionally followed by subsystem=level pairs, e.g. "info,ctp=debug".
+// Messages of the standard log package go to the engine logger.
+func setupLogging(json bool, levels string) error {
+	out := newLogOutput(os.Stderr, json)
+	for _, s := range subsystems {
+		s.setOutput(out)
+	}
+	if err := setLogLevels(parseLogLevels(levels)); err != nil {
+		return err
+	}
+	log.SetFlags(0)
+	log.SetOutput(slogWriter{engineLog})
+	return nil
+}
+
+// parseLogLevels splits "info,ctp=debug" into {"*": "info", "ctp": "debug"}
+func parseLogLevels(spec string) map[string]string {
+	levels := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if name, level, ok := strings.Cut(part, "="); ok {
+			levels[strings.TrimSpace(name)] = strings.TrimSpace(level)
+		} else {
+			levels["*"] = part
+		}
+	}
+	return levels
+}
+
+// setLogLevels sets subsystem levels by name; "*" sets all subsystems and is
+// applied first. Nothing changes when a name or level is invalid.
+func setLogLevels(levels map[string]string) error {
+	parsed := make(map[string]slog.Level, len(levels))
+	for name, text := range levels {
+		if _, ok := subsystems[name]; !ok && name != "*" {
+			return fmt.Errorf("unknown log subsystem %q", name)
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(text)); err != nil {
+			return fmt.Errorf("invalid log level %q for %s", text, name)
+		}
+		parsed[name] = level
+	}
+	if level, ok := parsed["*"]; ok {
+		for _, s := range subsystems {
+			s.level.Set(level)
+		}
+	}
+	for name, level := range parsed {
+		if name != "*" {
+			subsystems[name].level.Set(level)
+		}
+	}
+	return nil
+}
+
+// logLevels returns the level of each subsystem
+func logLevels() map[string]string {
+	levels := make(map[string]string, len(subsystems))
+	for name, s := range subsystems {
+		levels[name] = s.level.Level().String()
+	}
+	return levels
+}
+
+// fatal logs an error and exits, like log.Fatal
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:]) // Report the caller, not fatal
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	logger.Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
+
+// slogWriter turns lines of the standard log package into info records
+type slogWriter struct {
+	logger *slog.Logger
+}
+
+func (w slogWriter) Write(p []byte) (int, error) {
+	ctx := context.Background()
+	if !w.logger.Enabled(ctx, slog.LevelInfo) {
+		return len(p), nil
+	}
+	// Report the code that called the log package, not Write
+	var pcs [8]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	frame, more := frames.Next()
+	for more && strings.HasPrefix(frame.Function, "log.") {
+		frame, more = frames.Next()
+	}
+	// When log.Println and friends are inlined, the caller's PC resolves to
+	// them first, so the caller's position is added as the source instead
+	var pc uintptr
+	var source *slog.Source
+	if first, _ := runtime.CallersFrames([]uintptr{frame.PC}).Next(); first.Function == frame.Function {
+		pc = frame.PC
+	} else {
+		source = &slog.Source{Function: frame.Function, File: frame.File, Line: frame.Line}
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelInfo, strings.TrimSuffix(string(p), "\n"), pc)
+	if source != nil {
+		r.AddAttrs(slog.Any(slog.SourceKey, source))
+	}
+	w.logger.Handler().Handle(ctx, r)
+	return len(p), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogWriterSource(t *testing.T) {
+	var buf bytes.Buffer
+	prev, flags := log.Writer(), log.Flags()
+	log.SetFlags(0)
+	log.SetOutput(slogWriter{slog.New(newLogOutput(&buf, false))})
+	t.Cleanup(func() {
+		log.SetOutput(prev)
+		log.SetFlags(flags)
+	})
+
+	log.Printf("printf %d", 1)
+	log.Println("println")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "source=logging_test.go:") {
+			t.Errorf("source not the caller: %s", line)
+		}
+	}
+	if want := fmt.Sprintf("msg=%q", "printf 1"); !strings.Contains(lines[0], want) {
+		t.Errorf("got %s, want %s", lines[0], want)
+	}
+}
@@ -1,38 +1,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"os"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gookit/goutil/dump"
 	"github.com/gorilla/websocket"
 	"github.com/pseudocodes/go2ctp/thost"
 	"github.com/shopspring/decimal"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-}
-
 // L3 Order Queue Structure
 type OrderQueue struct {
-	orders []decimal.Decimal // Individual orders in FIFO sequence
-	mu     sync.RWMutex
+	orders []int64  // Individual orders in FIFO sequence, in lots
+	ids    []uint64 // Synthetic ID of each order, parallel to orders
+	total  int64    // Cached sum of orders
 }
 
-func (oq *OrderQueue) sum() decimal.Decimal {
-	total := decimal.Zero
-	for _, order := range oq.orders {
-		total = total.Add(order)
-	}
-	return total
+func (oq *OrderQueue) sum() int64 {
+	return oq.total
+}
+
+// push appends an order to the back of the queue
+func (oq *OrderQueue) push(qty int64, id uint64) {
+	oq.orders = append(oq.orders, qty)
+	oq.ids = append(oq.ids, id)
+	oq.total += qty
+}
+
+// removeAt removes the order at index i
+func (oq *OrderQueue) removeAt(i int) {
+	oq.total -= oq.orders[i]
+	oq.orders = append(oq.orders[:i], oq.orders[i+1:]...)
+	oq.ids = append(oq.ids[:i], oq.ids[i+1:]...)
 }
 
 func (oq *OrderQueue) largestOrderIndex() int {
@@ -42,7 +49,7 @@ func (oq *OrderQueue) largestOrderIndex() int {
 	maxIdx := 0
 	maxOrder := oq.orders[0]
 	for i := 1; i < len(oq.orders); i++ {
-		if oq.orders[i].GreaterThan(maxOrder) {
+		if oq.orders[i] > maxOrder {
 			maxOrder = oq.orders[i]
 			maxIdx = i
 		}
@@ -50,20 +57,36 @@ func (oq *OrderQueue) largestOrderIndex() int {
 	return maxIdx
 }
 
-// L3 Order Book Engine
+// L3 Order Book Engine. A book is owned by a single BookActor goroutine and
+// is not safe for concurrent use; readers use the actor's published snapshots.
 type L3OrderBook struct {
-	bids             map[string]*OrderQueue         // price -> order queue (legacy)
-	asks             map[string]*OrderQueue         // price -> order queue (legacy)
-	enhancedBids     map[string]*EnhancedOrderQueue // price -> enhanced order queue
-	enhancedAsks     map[string]*EnhancedOrderQueue // price -> enhanced order queue
+	bids             *bookSide // price levels sorted high to low
+	asks             *bookSide // price levels sorted low to high
+	scale            tickScale // price <-> tick index conversion from the symbol's tick size
 	symbol           string
 	lastID           int64
-	mu               sync.RWMutex
-	kmeansMode       bool           // Whether to enable K-means clustering
-	numClusters      int            // Number of clusters for K-means
-	precision        *PrecisionInfo // Symbol precision information
-	useEnhancedMode  bool           // Whether to use enhanced queue management
-	lastOptimization int64          // Last queue optimization timestamp
+	kmeansMode       bool             // Whether to enable K-means clustering
+	numClusters      int              // Number of clusters for K-means
+	bidKMeans        *MiniBatchKMeans // Per-side clustering state, kept across snapshots
+	askKMeans        *MiniBatchKMeans
+	precision        *PrecisionInfo  // Symbol precision information
+	useEnhancedMode  bool            // Whether to use enhanced queue management
+	lastOptimization int64           // Last queue optimization timestamp
+	queues           queueContext    // Clock, event log and order IDs shared by the queues
+	events           orderEventLog   // Order events inferred since the last drain
+	own              OwnOrderTracker // Our orders placed in the queues
+	metrics          metricsSeries   // Microstructure metrics after each update
+	detectors        []orderDetector // Raise alerts from the order events of each update
+	rules            *ruleDetector   // User-defined alert rules, run while any are defined
+	sizes            *sizeStats      // Product order sizes the detectors judge against
+	sizeScores       []sizeScore     // Scores of the events being inspected, reused
+	anomalies        anomalyCounts   // Read concurrently by /metrics
+	bidDepth         l2Depth         // Latest L2 quantities the checks and resyncs go by
+	askDepth         l2Depth
+	faults           []levelFault  // Broken levels of the update being checked, reused
+	crossed          bool          // Whether the book was crossed after the last update
+	levelResyncs     atomic.Uint64 // Levels rebuilt from L2, read by /metrics
+	bookResyncs      atomic.Uint64 // Whole-book rebuilds from L2, read by /metrics
 }
 
 func NewL3OrderBook(symbol string) *L3OrderBook {
@@ -72,267 +95,292 @@ func NewL3OrderBook(symbol string) *L3OrderBook {
 		InitializePrecisionManager()
 	}
 
-	return &L3OrderBook{
-		bids:             make(map[string]*OrderQueue),
-		asks:             make(map[string]*OrderQueue),
-		enhancedBids:     make(map[string]*EnhancedOrderQueue),
-		enhancedAsks:     make(map[string]*EnhancedOrderQueue),
+	precision := precisionManager.GetPrecisionInfo(symbol)
+	ob := &L3OrderBook{
+		bids:             newBookSide(true),
+		asks:             newBookSide(false),
+		bidDepth:         l2Depth{desc: true},
+		scale:            newTickScale(precision.TickSize),
 		symbol:           symbol,
 		kmeansMode:       false, // Default to disabled
 		numClusters:      10,    // Default number of clusters
-		precision:        precisionManager.GetPrecisionInfo(symbol),
+		precision:        precision,
 		useEnhancedMode:  true, // Enable enhanced mode by default
-		lastOptimization: time.Now().UnixMilli(),
+		lastOptimization: wallClock(),
+	}
+	ob.queues = queueContext{clock: wallClock, events: &ob.events, ids: orderIDs, own: &ob.own, flow: &ob.metrics.flow}
+	if detectLargeOrders {
+		ob.detectors = append(ob.detectors, newLargeOrderDetector())
+	}
+	if detectSpoofing {
+		ob.detectors = append(ob.detectors, newSpoofDetector())
 	}
+	if len(ob.detectors) > 0 {
+		ob.sizes = productSizeStats(ob.productOf())
+	}
+	ob.rules = newRuleDetector()
+	return ob
 }
 
-// Apply L2 snapshot to initialize L3 queues
-func (ob *L3OrderBook) loadSnapshot(resp *binanceRESTResp) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-
-	// Clear existing queues
-	ob.bids = make(map[string]*OrderQueue)
-	ob.asks = make(map[string]*OrderQueue)
-	ob.enhancedBids = make(map[string]*EnhancedOrderQueue)
-	ob.enhancedAsks = make(map[string]*EnhancedOrderQueue)
-
-	// Initialize bid queues
-	for _, bid := range resp.Bids {
-		if len(bid) < 2 {
-			continue
-		}
-		price := bid[0]
-		qty, err := decimal.NewFromString(bid[1])
-		if err != nil || qty.IsZero() {
-			continue
-		}
-
-		// Legacy queue
-		ob.bids[price] = &OrderQueue{
-			orders: []decimal.Decimal{qty}, // Start with single order
-		}
-
-		// Enhanced queue
-		if ob.useEnhancedMode {
-			enhancedQueue := NewEnhancedOrderQueue(price)
-			enhancedQueue.AddOrder(qty)
-			ob.enhancedBids[price] = enhancedQueue
-		}
+// SetEventsEnabled turns recording of order lifecycle events on or off
+func (ob *L3OrderBook) SetEventsEnabled(enabled bool) {
+	ob.events.enabled = enabled
+	if !enabled {
+		ob.events.events = ob.events.events[:0]
 	}
+}
 
-	// Initialize ask queues
-	for _, ask := range resp.Asks {
-		if len(ask) < 2 {
-			continue
-		}
-		price := ask[0]
-		qty, err := decimal.NewFromString(ask[1])
-		if err != nil || qty.IsZero() {
-			continue
-		}
+// DrainEvents returns the order events inferred since the last call
+func (ob *L3OrderBook) DrainEvents() []OrderEvent {
+	return ob.events.drain(ob.symbol, ob.scale)
+}
 
-		// Legacy queue
-		ob.asks[price] = &OrderQueue{
-			orders: []decimal.Decimal{qty}, // Start with single order
-		}
+// DiscardEvents drops the order events inferred since the last drain
+func (ob *L3OrderBook) DiscardEvents() {
+	ob.events.events = ob.events.events[:0]
+}
+
+// Detecting reports whether the book runs detectors or alert rules, which
+// need order events
+func (ob *L3OrderBook) Detecting() bool {
+	return len(ob.detectors) > 0 || len(alertRules.current()) > 0
+}
 
-		// Enhanced queue
-		if ob.useEnhancedMode {
-			enhancedQueue := NewEnhancedOrderQueue(price)
-			enhancedQueue.AddOrder(qty)
-			ob.enhancedAsks[price] = enhancedQueue
+// DetectAlerts runs the detectors over the order events of the last update.
+// Each added order is scored against the product's sizes once for all of them.
+func (ob *L3OrderBook) DetectAlerts() []Alert {
+	if !ob.Detecting() {
+		return nil
+	}
+	events := ob.events.events
+	ob.sizeScores = ob.sizeScores[:0]
+	for _, ev := range events {
+		var score sizeScore
+		if ev.kind == EventAdd && ev.rule != RuleResync && ob.sizes != nil {
+			score = ob.sizes.observe(ev.qty)
 		}
+		ob.sizeScores = append(ob.sizeScores, score)
 	}
 
-	ob.lastID = resp.LastUpdateID
-	log.Printf("L3 Order Book initialized with %d bid levels, %d ask levels",
-		len(ob.bids), len(ob.asks))
+	var out []Alert
+	for _, d := range ob.detectors {
+		out = append(out, d.detect(ob, events, ob.sizeScores)...)
+	}
+	return append(out, ob.rules.detect(ob, events, ob.sizeScores)...)
 }
 
-// Apply L2 delta update to reconstruct L3 queues
-func (ob *L3OrderBook) applyDelta(update *binanceWSUpdate) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
+// SetClock replaces the time source used for order timestamps and snapshots.
+// Replays set it to the time of the tick being applied.
+func (ob *L3OrderBook) SetClock(clock func() int64) {
+	ob.queues.clock = clock
+	ob.lastOptimization = clock()
+}
 
-	// Process bid updates
-	for _, bid := range update.B {
-		if len(bid) < 2 {
+// parseLevels converts string [price, qty] pairs into tick-indexed levels.
+// Quantities are rounded to whole lots.
+func (ob *L3OrderBook) parseLevels(raw [][]string) []depthLevel {
+	levels := make([]depthLevel, 0, len(raw))
+	for _, level := range raw {
+		if len(level) < 2 {
 			continue
 		}
-		price := bid[0]
-		newQty, err := decimal.NewFromString(bid[1])
+		tick, err := ob.scale.fromString(level[0])
 		if err != nil {
+			engineLog.Warn("invalid price", "symbol", ob.symbol, "price", level[0], "err", err)
+			ob.anomalies.add(anomalyInvalidPrice)
 			continue
 		}
-
-		if newQty.IsZero() {
-			// Remove entire price level
-			delete(ob.bids, price)
-			if ob.useEnhancedMode {
-				delete(ob.enhancedBids, price)
-			}
-		} else {
-			ob.updateQueue(ob.bids, price, newQty)
-			if ob.useEnhancedMode {
-				ob.updateEnhancedQueue(ob.enhancedBids, price, newQty)
-			}
-		}
-	}
-
-	tempPriceQueue := []string{}
-	for bidPrice := range ob.bids {
-		// log.Printf("bid: %s, %s", bid.price, bid.qty)
-
-		pb, err := decimal.NewFromString(bidPrice)
+		qty, err := decimal.NewFromString(level[1])
 		if err != nil {
-			log.Printf("create decimal from `%s` error: %s", bidPrice, err)
 			continue
 		}
+		levels = append(levels, depthLevel{tick: tick, qty: qty.Round(0).IntPart()})
+	}
+	return levels
+}
 
-		bid0, err := decimal.NewFromString(update.B[0][0])
-		if err != nil {
-			log.Printf("create decimal from `%s` error: %s", update.B[0][0], err)
-			continue
-		}
-		if pb.GreaterThan(bid0) {
-			tempPriceQueue = append(tempPriceQueue, bidPrice)
-		}
+// newBookLevel creates a level of side holding a single order of qty, added
+// under rule
+func (ob *L3OrderBook) newBookLevel(side *bookSide, tick int64, qty int64, rule string) bookLevel {
+	id := ob.queues.ids.Next()
+	queue := &OrderQueue{orders: make([]int64, 0, 4), ids: make([]uint64, 0, 4)}
+	queue.push(qty, id)
+	level := bookLevel{
+		tick:  tick,
+		queue: queue,
 	}
-	for _, p := range tempPriceQueue {
-		delete(ob.bids, p)
+	if ob.useEnhancedMode {
+		level.enhanced = NewEnhancedOrderQueue(tick, side == ob.bids, &ob.queues)
+		level.enhanced.addOrder(id, qty, rule)
 	}
+	return level
+}
 
-	// Process ask updates
-	for _, ask := range update.A {
-		if len(ask) < 2 {
-			continue
+// Apply L2 snapshot to initialize L3 queues
+func (ob *L3OrderBook) loadSnapshot(resp *binanceRESTResp) {
+	// Clear existing queues
+	ob.bids.clear(RuleBookReset)
+	ob.asks.clear(RuleBookReset)
+
+	bids, asks := ob.parseLevels(resp.Bids), ob.parseLevels(resp.Asks)
+	for _, bid := range bids {
+		if bid.qty > 0 {
+			ob.bids.insert(ob.newBookLevel(ob.bids, bid.tick, bid.qty, RuleVolumeIncrease))
 		}
-		price := ask[0]
-		newQty, err := decimal.NewFromString(ask[1])
-		if err != nil {
-			continue
+	}
+	for _, ask := range asks {
+		if ask.qty > 0 {
+			ob.asks.insert(ob.newBookLevel(ob.asks, ask.tick, ask.qty, RuleVolumeIncrease))
 		}
+	}
+	ob.bidDepth.replace(bids)
+	ob.askDepth.replace(asks)
 
-		if newQty.IsZero() {
-			// Remove entire price level
-			delete(ob.asks, price)
-			if ob.useEnhancedMode {
-				delete(ob.enhancedAsks, price)
+	ob.lastID = resp.LastUpdateID
+	engineLog.Info("L3 order book initialized", "symbol", ob.symbol, "bid_levels", ob.bids.len(), "ask_levels", ob.asks.len())
+}
+
+// Apply L2 delta update to reconstruct L3 queues
+func (ob *L3OrderBook) applyDelta(update *binanceWSUpdate) {
+	bids, asks := ob.parseLevels(update.B), ob.parseLevels(update.A)
+	ob.applyLevels(ob.bids, bids)
+	ob.applyLevels(ob.asks, asks)
+	ob.bidDepth.update(bids)
+	ob.askDepth.update(asks)
+	ob.checkBook(bids, asks)
+	ob.recordMetrics()
+}
+
+// applyDepthMarketData applies the five CTP depth levels without going through strings
+func (ob *L3OrderBook) applyDepthMarketData(f *thost.CThostFtdcDepthMarketDataField) {
+	bidPrices, bidVolumes, askPrices, askVolumes := depthLevels(f)
+
+	var bids, asks [5]depthLevel
+	nb, na := 0, 0
+	for i := 0; i < 5; i++ {
+		if tick, ok := ob.scale.fromFloat(bidPrices[i]); ok {
+			if !ob.scale.onGrid(bidPrices[i], tick) {
+				ob.anomalies.add(anomalyOffGridPrice)
 			}
-		} else {
-			ob.updateQueue(ob.asks, price, newQty)
-			if ob.useEnhancedMode {
-				ob.updateEnhancedQueue(ob.enhancedAsks, price, newQty)
+			bids[nb] = depthLevel{tick: tick, qty: int64(bidVolumes[i])}
+			nb++
+		}
+		if tick, ok := ob.scale.fromFloat(askPrices[i]); ok {
+			if !ob.scale.onGrid(askPrices[i], tick) {
+				ob.anomalies.add(anomalyOffGridPrice)
 			}
+			asks[na] = depthLevel{tick: tick, qty: int64(askVolumes[i])}
+			na++
 		}
 	}
+	ob.applyLevels(ob.bids, bids[:nb])
+	ob.applyLevels(ob.asks, asks[:na])
+	// Each tick carries the full visible depth
+	ob.bidDepth.replace(bids[:nb])
+	ob.askDepth.replace(asks[:na])
+	ob.checkBook(bids[:nb], asks[:na])
+	ob.recordMetrics()
+}
 
-	tempPriceQueue = []string{}
-	for askPrice := range ob.asks {
-		// log.Printf("bid: %s, %s", bid.price, bid.qty)
-
-		pb, err := decimal.NewFromString(askPrice)
-		if err != nil {
-			log.Printf("create decimal from `%s` error: %s", askPrice, err)
+// applyLevels updates one side with L2 levels. Levels ranked ahead of the
+// first level of the update are stale and get dropped.
+func (ob *L3OrderBook) applyLevels(side *bookSide, levels []depthLevel) {
+	for _, l := range levels {
+		if l.qty <= 0 {
+			if l.qty < 0 {
+				ob.anomalies.add(anomalyNegativeQty)
+			}
+			// Remove entire price level
+			side.remove(l.tick, RuleZeroQty)
 			continue
 		}
 
-		ask0, err := decimal.NewFromString(update.A[0][0])
-		if err != nil {
-			log.Printf("create decimal from `%s` error: %s", update.A[0][0], err)
+		level, exists := side.get(l.tick)
+		if !exists {
+			// New price level - create initial queue
+			side.insert(ob.newBookLevel(side, l.tick, l.qty, RuleVolumeIncrease))
 			continue
 		}
-		if pb.LessThan(ask0) {
-			tempPriceQueue = append(tempPriceQueue, askPrice)
+		// An increase is one new arrival; both queue models record it under the same ID
+		var id uint64
+		if l.qty > level.queue.sum() {
+			id = ob.queues.ids.Next()
+		}
+		ob.updateQueue(level.queue, l.qty, id)
+		if level.enhanced != nil {
+			ob.updateEnhancedQueue(level.enhanced, l.qty, id)
 		}
 	}
-	for _, p := range tempPriceQueue {
-		delete(ob.asks, p)
+
+	if len(levels) > 0 {
+		side.removeBetterThan(levels[0].tick)
 	}
 }
 
 // Core L3 Queue Reconstruction Algorithm (based on Rust implementation)
-func (ob *L3OrderBook) updateQueue(side map[string]*OrderQueue, price string, newQty decimal.Decimal) {
-	queue, exists := side[price]
-
-	if !exists {
-		// New price level - create initial queue
-		side[price] = &OrderQueue{
-			orders: []decimal.Decimal{newQty},
-		}
-		return
-	}
-
-	queue.mu.Lock()
-	defer queue.mu.Unlock()
-
+func (ob *L3OrderBook) updateQueue(queue *OrderQueue, newQty int64, id uint64) {
 	oldSum := queue.sum()
 
-	if newQty.GreaterThan(oldSum) {
+	if newQty > oldSum {
 		// Quantity increased - new order added to back of queue (FIFO)
-		diff := newQty.Sub(oldSum)
-		queue.orders = append(queue.orders, diff)
+		queue.push(newQty-oldSum, id)
 
-	} else if newQty.LessThan(oldSum) {
+	} else if newQty < oldSum {
 		// Quantity decreased - remove from largest order first
-		diff := oldSum.Sub(newQty)
+		diff := oldSum - newQty
 
 		// Find exact match for cancellation (Rust logic)
 		removed := false
 		for i := len(queue.orders) - 1; i >= 0; i-- {
-			if queue.orders[i].Equal(diff) {
+			if queue.orders[i] == diff {
 				// Remove exact matching order
-				queue.orders = append(queue.orders[:i], queue.orders[i+1:]...)
+				queue.removeAt(i)
 				removed = true
 				break
 			}
 		}
 
-		if !removed {
-			// No exact match - reduce largest order
+		// No exact match - take from the largest orders until the decrease is covered
+		for !removed && diff > 0 {
 			largestIdx := queue.largestOrderIndex()
-			if largestIdx >= 0 {
-				if queue.orders[largestIdx].GreaterThan(diff) {
-					// Partial reduction of largest order
-					queue.orders[largestIdx] = queue.orders[largestIdx].Sub(diff)
-				} else {
-					// Remove entire largest order
-					queue.orders = append(queue.orders[:largestIdx], queue.orders[largestIdx+1:]...)
-				}
+			if largestIdx < 0 {
+				break
+			}
+			if queue.orders[largestIdx] > diff {
+				// Partial reduction of largest order
+				queue.orders[largestIdx] -= diff
+				queue.total -= diff
+				diff = 0
+			} else {
+				// Remove entire largest order
+				diff -= queue.orders[largestIdx]
+				queue.removeAt(largestIdx)
 			}
 		}
 	}
 	// If quantities are equal, no change needed
 }
 
-// updateEnhancedQueue updates enhanced queue with improved algorithms
-func (ob *L3OrderBook) updateEnhancedQueue(side map[string]*EnhancedOrderQueue, price string, newQty decimal.Decimal) {
-	queue, exists := side[price]
-
-	if !exists {
-		// New price level - create initial queue
-		newQueue := NewEnhancedOrderQueue(price)
-		newQueue.AddOrder(newQty)
-		side[price] = newQueue
-		return
-	}
-
+// updateEnhancedQueue updates enhanced queue with improved algorithms. id
+// names the order added when the quantity increased.
+func (ob *L3OrderBook) updateEnhancedQueue(queue *EnhancedOrderQueue, newQty int64, id uint64) {
 	oldSum := queue.GetTotalQty()
 
-	if newQty.GreaterThan(oldSum) {
-		// Quantity increased - new order added
-		diff := newQty.Sub(oldSum)
-		queue.AddOrder(diff)
-	} else if newQty.LessThan(oldSum) {
+	if newQty > oldSum {
+		// Quantity increased - new order added. The queue can be behind the
+		// plain one after a trade anchor, in which case it needs its own ID.
+		if id == 0 {
+			id = ob.queues.ids.Next()
+		}
+		queue.addOrder(id, newQty-oldSum, RuleVolumeIncrease)
+	} else if newQty < oldSum {
 		// Quantity decreased - remove using enhanced algorithm
-		diff := oldSum.Sub(newQty)
-		queue.RemoveQty(diff)
+		queue.RemoveQty(oldSum - newQty)
 	}
 	// If quantities are equal, no change needed
 
 	// Periodic optimization
-	if time.Now().UnixMilli()-ob.lastOptimization > 30000 { // Every 30 seconds
+	if ob.queues.clock()-ob.lastOptimization > 30000 { // Every 30 seconds
 		ob.optimizeAllQueues()
 	}
 }
@@ -340,30 +388,32 @@ func (ob *L3OrderBook) updateEnhancedQueue(side map[string]*EnhancedOrderQueue,
 // optimizeAllQueues performs maintenance on all enhanced queues
 func (ob *L3OrderBook) optimizeAllQueues() {
 	// Update ages for all orders
-	for _, queue := range ob.enhancedBids {
-		queue.UpdateAge()
-		queue.OptimizeQueue()
-	}
-	for _, queue := range ob.enhancedAsks {
-		queue.UpdateAge()
-		queue.OptimizeQueue()
+	for _, side := range []*bookSide{ob.bids, ob.asks} {
+		for _, level := range side.levels {
+			if level.enhanced != nil {
+				level.enhanced.UpdateAge()
+				level.enhanced.OptimizeQueue()
+			}
+		}
 	}
 
-	ob.lastOptimization = time.Now().UnixMilli()
-	log.Printf("Optimized %d bid queues and %d ask queues", len(ob.enhancedBids), len(ob.enhancedAsks))
+	ob.lastOptimization = ob.queues.clock()
+	engineLog.Debug("optimized queues", "symbol", ob.symbol, "bid_levels", ob.bids.len(), "ask_levels", ob.asks.len())
 }
 
 // Enhanced L3 snapshot with queue details
 type L3Level struct {
 	Price           decimal.Decimal   `json:"price"`
-	TotalSize       decimal.Decimal   `json:"total_size"`
+	TotalSize       int64             `json:"total_size"`
 	OrderCount      int               `json:"order_count"`
-	Orders          []decimal.Decimal `json:"orders,omitempty"`           // Individual orders for top levels
+	Orders          []int64           `json:"orders,omitempty"`           // Individual orders for top levels
+	OrderIDs        []uint64          `json:"order_ids,omitempty"`        // Synthetic ID of each order in Orders, stable across frames
 	ClusteredOrders []*ClusteredOrder `json:"clustered_orders,omitempty"` // Orders with cluster information
-	MaxOrder        decimal.Decimal   `json:"max_order"`
-	AvgOrder        decimal.Decimal   `json:"avg_order"`
+	MaxOrder        int64             `json:"max_order"`
+	AvgOrder        float64           `json:"avg_order"`
 	Colors          []string          `json:"colors,omitempty"`        // Color information for visualization
 	QueueMetrics    *QueueMetrics     `json:"queue_metrics,omitempty"` // Enhanced queue metrics
+	FillEstimate    *FillEstimate     `json:"fill_estimate,omitempty"` // Predicted fills from the level's depletion rate
 	OrderDetails    []*OrderInfo      `json:"order_details,omitempty"` // Detailed order information
 }
 
@@ -375,237 +425,124 @@ type L3Snapshot struct {
 	KmeansMode  bool           `json:"kmeans_mode"`  // Whether clustering is enabled
 	NumClusters int            `json:"num_clusters"` // Number of clusters used
 	Precision   *PrecisionInfo `json:"precision"`    // Symbol precision information
+	Metrics     *BookMetrics   `json:"metrics"`      // Imbalance, microprice and order flow
 }
 
 func (ob *L3OrderBook) getL3Snapshot(topLevels int) L3Snapshot {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
-
-	// Get sorted bid prices (high to low)
-	bidPrices := make([]string, 0, len(ob.bids))
-	for price := range ob.bids {
-		bidPrices = append(bidPrices, price)
-	}
-	sort.Slice(bidPrices, func(i, j int) bool {
-		pi, _ := decimal.NewFromString(bidPrices[i])
-		pj, _ := decimal.NewFromString(bidPrices[j])
-		return pi.GreaterThan(pj)
-	})
-
-	// Get sorted ask prices (low to high)
-	askPrices := make([]string, 0, len(ob.asks))
-	for price := range ob.asks {
-		askPrices = append(askPrices, price)
-	}
-	sort.Slice(askPrices, func(i, j int) bool {
-		pi, _ := decimal.NewFromString(askPrices[i])
-		pj, _ := decimal.NewFromString(askPrices[j])
-		return pi.LessThan(pj)
-	})
-
 	// Perform clustering if enabled
-	var clusteredBids, clusteredAsks map[string][]*ClusteredOrder
+	var clusteredBids, clusteredAsks map[int64][]*ClusteredOrder
 	if ob.kmeansMode {
-		clusteredBids = ClusterOrderBook(ob.bids, ob.numClusters, true)
-		clusteredAsks = ClusterOrderBook(ob.asks, ob.numClusters, false)
-	}
-
-	// Calculate max orders for special highlighting across all levels
-	maxBidOrder := decimal.Zero
-	secondMaxBidOrder := decimal.Zero
-	maxAskOrder := decimal.Zero
-	secondMaxAskOrder := decimal.Zero
-
-	// Find max bid orders
-	var allBidOrders []decimal.Decimal
-	for _, queue := range ob.bids {
-		queue.mu.RLock()
-		for _, order := range queue.orders {
-			if order.GreaterThan(decimal.Zero) {
-				allBidOrders = append(allBidOrders, order)
-			}
-		}
-		queue.mu.RUnlock()
-	}
-	if len(allBidOrders) > 0 {
-		// Sort to find max and second max
-		for _, order := range allBidOrders {
-			if order.GreaterThan(maxBidOrder) {
-				secondMaxBidOrder = maxBidOrder
-				maxBidOrder = order
-			} else if order.GreaterThan(secondMaxBidOrder) && !order.Equal(maxBidOrder) {
-				secondMaxBidOrder = order
-			}
+		if ob.bidKMeans == nil || ob.bidKMeans.numClusters != ob.numClusters {
+			ob.bidKMeans = NewMiniBatchKMeans(ob.numClusters, 1024, 1024)
+			ob.askKMeans = NewMiniBatchKMeans(ob.numClusters, 1024, 1024)
 		}
+		clusteredBids = ClusterOrderBook(ob.bidKMeans, ob.bids.levels)
+		clusteredAsks = ClusterOrderBook(ob.askKMeans, ob.asks.levels)
 	}
 
-	// Find max ask orders
-	var allAskOrders []decimal.Decimal
-	for _, queue := range ob.asks {
-		queue.mu.RLock()
-		for _, order := range queue.orders {
-			if order.GreaterThan(decimal.Zero) {
-				allAskOrders = append(allAskOrders, order)
-			}
-		}
-		queue.mu.RUnlock()
-	}
-	if len(allAskOrders) > 0 {
-		// Sort to find max and second max
-		for _, order := range allAskOrders {
-			if order.GreaterThan(maxAskOrder) {
-				secondMaxAskOrder = maxAskOrder
-				maxAskOrder = order
-			} else if order.GreaterThan(secondMaxAskOrder) && !order.Equal(maxAskOrder) {
-				secondMaxAskOrder = order
-			}
-		}
+	metrics := ob.Metrics()
+	return L3Snapshot{
+		Bids:        ob.buildLevels(ob.bids, topLevels, clusteredBids, true),
+		Asks:        ob.buildLevels(ob.asks, topLevels, clusteredAsks, false),
+		Timestamp:   ob.queues.clock(),
+		Symbol:      ob.symbol,
+		KmeansMode:  ob.kmeansMode,
+		NumClusters: ob.numClusters,
+		Precision:   ob.precision,
+		Metrics:     &metrics,
 	}
+}
 
-	// Build L3 bid levels
-	bids := make([]L3Level, 0, min(topLevels, len(bidPrices)))
-	for i := 0; i < min(topLevels, len(bidPrices)); i++ {
-		price := bidPrices[i]
-		queue := ob.bids[price]
-		queue.mu.RLock()
-
-		priceDecimal, _ := decimal.NewFromString(price)
-		totalSize := queue.sum()
-		orderCount := len(queue.orders)
-
-		var maxOrder, avgOrder decimal.Decimal
-		if orderCount > 0 {
-			maxOrder = queue.orders[0]
-			for _, order := range queue.orders {
-				if order.GreaterThan(maxOrder) {
-					maxOrder = order
-				}
+// largestOrders returns the largest and second largest orders across a side
+// for special highlighting
+func largestOrders(side *bookSide) (maxOrder, secondMaxOrder int64) {
+	var orders []int64
+	for i := range side.levels {
+		orders = side.levels[i].orderSizes(orders[:0])
+		for _, order := range orders {
+			if order > maxOrder {
+				secondMaxOrder = maxOrder
+				maxOrder = order
+			} else if order > secondMaxOrder && order != maxOrder {
+				secondMaxOrder = order
 			}
-			avgOrder = totalSize.Div(decimal.NewFromInt(int64(orderCount)))
 		}
+	}
+	return maxOrder, secondMaxOrder
+}
 
-		level := L3Level{
-			Price:      priceDecimal,
-			TotalSize:  totalSize,
-			OrderCount: orderCount,
-			MaxOrder:   maxOrder,
-			AvgOrder:   avgOrder,
-		}
+// buildLevels builds the L3 levels of the best topLevels prices of a side
+func (ob *L3OrderBook) buildLevels(side *bookSide, topLevels int, clustered map[int64][]*ClusteredOrder, isBid bool) []L3Level {
+	maxOrder, secondMaxOrder := largestOrders(side)
 
-		// Include individual orders and clustering for all visible levels
-		if i < topLevels {
-			level.Orders = make([]decimal.Decimal, len(queue.orders))
-			copy(level.Orders, queue.orders)
-
-			// Include enhanced queue information if available
-			if ob.useEnhancedMode {
-				if enhancedQueue, exists := ob.enhancedBids[price]; exists {
-					metrics := enhancedQueue.GetMetrics()
-					level.QueueMetrics = &metrics
-					level.OrderDetails = enhancedQueue.GetOrders()
-				}
-			}
+	top := side.top(topLevels)
+	levels := make([]L3Level, 0, len(top))
+	for _, bl := range top {
+		orders := bl.orderSizes(nil)
 
-			// Generate colors based on mode
-			if ob.kmeansMode {
-				// Add clustered orders if clustering is enabled
-				if clusteredOrders, exists := clusteredBids[price]; exists {
-					level.ClusteredOrders = clusteredOrders
-					level.Colors = GenerateClusteredOrderColors(clusteredOrders, true, maxBidOrder, secondMaxBidOrder)
-				}
-			} else {
-				// Generate age-based colors for normal mode
-				level.Colors = GenerateOrderColors(queue.orders, true, maxBidOrder, secondMaxBidOrder)
-			}
+		var totalSize int64
+		for _, order := range orders {
+			totalSize += order
 		}
+		orderCount := len(orders)
 
-		bids = append(bids, level)
-		queue.mu.RUnlock()
-	}
-
-	// Build L3 ask levels
-	asks := make([]L3Level, 0, min(topLevels, len(askPrices)))
-	for i := 0; i < min(topLevels, len(askPrices)); i++ {
-		price := askPrices[i]
-		queue := ob.asks[price]
-		queue.mu.RLock()
-
-		priceDecimal, _ := decimal.NewFromString(price)
-		totalSize := queue.sum()
-		orderCount := len(queue.orders)
-
-		var maxOrder, avgOrder decimal.Decimal
+		var levelMax int64
+		var avgOrder float64
 		if orderCount > 0 {
-			maxOrder = queue.orders[0]
-			for _, order := range queue.orders {
-				if order.GreaterThan(maxOrder) {
-					maxOrder = order
+			levelMax = orders[0]
+			for _, order := range orders {
+				if order > levelMax {
+					levelMax = order
 				}
 			}
-			avgOrder = totalSize.Div(decimal.NewFromInt(int64(orderCount)))
+			avgOrder = float64(totalSize) / float64(orderCount)
 		}
 
 		level := L3Level{
-			Price:      priceDecimal,
+			Price:      ob.scale.price(bl.tick),
 			TotalSize:  totalSize,
 			OrderCount: orderCount,
-			MaxOrder:   maxOrder,
+			MaxOrder:   levelMax,
 			AvgOrder:   avgOrder,
 		}
 
 		// Include individual orders and clustering for all visible levels
-		if i < topLevels {
-			level.Orders = make([]decimal.Decimal, len(queue.orders))
-			copy(level.Orders, queue.orders)
-
-			// Include enhanced queue information if available
-			if ob.useEnhancedMode {
-				if enhancedQueue, exists := ob.enhancedAsks[price]; exists {
-					metrics := enhancedQueue.GetMetrics()
-					level.QueueMetrics = &metrics
-					level.OrderDetails = enhancedQueue.GetOrders()
-				}
-			}
+		level.Orders = orders
+		level.OrderIDs = bl.orderIDs(make([]uint64, 0, orderCount))
+
+		// Include enhanced queue information if available
+		if bl.enhanced != nil {
+			metrics := bl.enhanced.GetMetrics()
+			level.QueueMetrics = &metrics
+			estimate := bl.enhanced.EstimateFill(fillHorizon.Seconds())
+			level.FillEstimate = &estimate
+			level.OrderDetails = bl.enhanced.GetOrders()
+		}
 
-			// Generate colors based on mode
-			if ob.kmeansMode {
-				// Add clustered orders if clustering is enabled
-				if clusteredOrders, exists := clusteredAsks[price]; exists {
-					level.ClusteredOrders = clusteredOrders
-					level.Colors = GenerateClusteredOrderColors(clusteredOrders, false, maxAskOrder, secondMaxAskOrder)
-				}
-			} else {
-				// Generate age-based colors for normal mode
-				level.Colors = GenerateOrderColors(queue.orders, false, maxAskOrder, secondMaxAskOrder)
+		// Generate colors based on mode
+		if ob.kmeansMode {
+			// Add clustered orders if clustering is enabled
+			if clusteredOrders, exists := clustered[bl.tick]; exists {
+				level.ClusteredOrders = clusteredOrders
+				level.Colors = GenerateClusteredOrderColors(clusteredOrders, isBid, maxOrder, secondMaxOrder)
 			}
+		} else {
+			// Generate age-based colors for normal mode
+			level.Colors = GenerateOrderColors(orders, isBid, maxOrder, secondMaxOrder)
 		}
 
-		asks = append(asks, level)
-		queue.mu.RUnlock()
-	}
-
-	return L3Snapshot{
-		Bids:        bids,
-		Asks:        asks,
-		Timestamp:   time.Now().UnixMilli(),
-		Symbol:      ob.symbol,
-		KmeansMode:  ob.kmeansMode,
-		NumClusters: ob.numClusters,
-		Precision:   ob.precision,
+		levels = append(levels, level)
 	}
+	return levels
 }
 
 // SetKmeansMode enables or disables K-means clustering
 func (ob *L3OrderBook) SetKmeansMode(enabled bool) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
 	ob.kmeansMode = enabled
 }
 
 // SetNumClusters sets the number of clusters for K-means
 func (ob *L3OrderBook) SetNumClusters(clusters int) {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
 	if clusters > 0 && clusters <= 20 { // Reasonable limits
 		ob.numClusters = clusters
 	}
@@ -613,26 +550,31 @@ func (ob *L3OrderBook) SetNumClusters(clusters int) {
 
 // GetClusteringInfo returns current clustering configuration
 func (ob *L3OrderBook) GetClusteringInfo() (bool, int) {
-	ob.mu.RLock()
-	defer ob.mu.RUnlock()
 	return ob.kmeansMode, ob.numClusters
 }
 
-// RefreshPrecision refreshes precision information for the symbol
-func (ob *L3OrderBook) RefreshPrecision() {
-	ob.mu.Lock()
-	defer ob.mu.Unlock()
-	if precisionManager != nil {
-		ob.precision = precisionManager.GetPrecisionInfo(ob.symbol)
+// SetPrecision replaces the precision information of the symbol. The lookup
+// itself may hit the network, so callers resolve it outside the book actor.
+func (ob *L3OrderBook) SetPrecision(precision *PrecisionInfo) {
+	ob.precision = precision
+	// Tick indexes depend on the tick size; rebuild from the next update if it changed
+	if scale := newTickScale(precision.TickSize); !scale.size.Equal(ob.scale.size) {
+		precisionLog.Warn("tick size changed, resetting book", "symbol", ob.symbol, "from", ob.scale.size, "to", scale.size)
+		ob.anomalies.add(anomalyTickSizeReset)
+		ob.scale = scale
+		ob.bids.clear(RuleBookReset)
+		ob.asks.clear(RuleBookReset)
+		ob.bidDepth.replace(nil)
+		ob.askDepth.replace(nil)
 	}
 }
 
 // Rest of the implementation (WebSocket, HTTP handlers) remains the same
 type binanceWSUpdate struct {
-	U int64      `json:"U"`
-	u int64      `json:"u"`
-	B [][]string `json:"b"`
-	A [][]string `json:"a"`
+	U             int64      `json:"U"` // First update ID in event
+	FinalUpdateID int64      `json:"u"` // Final update ID in event
+	B             [][]string `json:"b"`
+	A             [][]string `json:"a"`
 }
 
 type binanceRESTResp struct {
@@ -650,20 +592,26 @@ func min(a, b int) int {
 
 // Global state for symbol switching
 type AppState struct {
-	book          *L3OrderBook
+	book          atomic.Pointer[BookActor] // Swapped on symbol switch; readers never take mu
+	router        tickRouter                // Dispatches feed ticks to books by instrument
 	currentSymbol string
 	binanceCancel chan bool
-	symbolC       chan string
+	md            *MdCtp           // CTP market data connection, nil until created
+	history       *SnapshotHistory // Persisted snapshots, nil when disabled
+	switchMu      sync.Mutex       // Serializes symbol switches
 	mu            sync.RWMutex
 }
 
 var appState *AppState
 
 type WSMessage struct {
-	Type        string `json:"type"`
-	Symbol      string `json:"symbol,omitempty"`
-	KmeansMode  *bool  `json:"kmeans_mode,omitempty"`
-	NumClusters *int   `json:"num_clusters,omitempty"`
+	Type        string           `json:"type"`
+	Symbol      string           `json:"symbol,omitempty"`
+	KmeansMode  *bool            `json:"kmeans_mode,omitempty"`
+	NumClusters *int             `json:"num_clusters,omitempty"`
+	At          string           `json:"at,omitempty"`    // Point in time for get_history
+	Order       *OwnOrderRequest `json:"order,omitempty"` // Order for register_order
+	ID          uint64           `json:"id,omitempty"`    // Own order ID for cancel_order
 }
 
 func wsHandler() http.HandlerFunc {
@@ -674,7 +622,7 @@ func wsHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Println("upgrade err:", err)
+			wsLog.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
 			return
 		}
 		defer conn.Close()
@@ -682,12 +630,67 @@ func wsHandler() http.HandlerFunc {
 		ticker := time.NewTicker(100 * time.Millisecond) // 10 FPS for L3 data
 		defer ticker.Stop()
 
+		// Replies from the reader goroutine are written here so only one goroutine writes to conn
+		replies := make(chan map[string]any, 16)
+		wsClients.add(replies)
+		defer wsClients.remove(replies)
+		readerDone := make(chan struct{})
+		writerDone := make(chan struct{})
+		defer close(writerDone)
+
 		// Handle incoming messages for symbol switching
 		go func() {
+			defer close(readerDone)
+			reply := func(msg map[string]any) {
+				select {
+				case replies <- msg:
+				case <-writerDone:
+				}
+			}
+
+			// Order event subscription of this client, forwarded through reply
+			var cancelEvents func()
+			defer func() {
+				if cancelEvents != nil {
+					cancelEvents()
+				}
+			}()
+
+			// Alert subscription of this client
+			var cancelAlerts func()
+			defer func() {
+				if cancelAlerts != nil {
+					cancelAlerts()
+				}
+			}()
+
+			// Own order updates, subscribed on the first register_order or subscribe_orders
+			var cancelOwn func()
+			defer func() {
+				if cancelOwn != nil {
+					cancelOwn()
+				}
+			}()
+			subscribeOwn := func() {
+				if cancelOwn != nil {
+					return
+				}
+				updates, cancel := ownOrderUpdates.Subscribe(64)
+				cancelOwn = cancel
+				go func() {
+					for batch := range updates {
+						reply(map[string]any{
+							"type":   "own_orders",
+							"orders": batch,
+						})
+					}
+				}()
+			}
+
 			for {
 				var msg WSMessage
 				if err := conn.ReadJSON(&msg); err != nil {
-					log.Println("WebSocket read error:", err)
+					wsLog.Info("WebSocket client gone", "remote", r.RemoteAddr, "err", err)
 					return
 				}
 
@@ -695,92 +698,189 @@ func wsHandler() http.HandlerFunc {
 				case "switch_symbol":
 					if msg.Symbol != "" {
 						newSymbol := msg.Symbol
-						log.Printf("Switching to symbol: %s", newSymbol)
+						wsLog.Info("switching symbol", "symbol", newSymbol)
 
-						// Switch symbol
-						if err := switchSymbol(newSymbol); err != nil {
-							errorMsg := map[string]any{
+						// Switch symbol, reporting each stage of the hand-off
+						err := switchSymbol(newSymbol, func(stage string) {
+							reply(map[string]any{
+								"type":   "switch_progress",
+								"symbol": newSymbol,
+								"stage":  stage,
+							})
+						})
+						if err != nil {
+							reply(map[string]any{
 								"type":    "error",
 								"message": err.Error(),
-							}
-							conn.WriteJSON(errorMsg)
+							})
 						} else {
-							// Notify successful switch
-							switchMsg := map[string]any{
-								"type":   "symbol_switched",
-								"symbol": newSymbol,
-							}
-							conn.WriteJSON(switchMsg)
+							// Notify successful switch with the resolved instrument
+							book := appState.book.Load()
+							reply(map[string]any{
+								"type":     "symbol_switched",
+								"symbol":   book.Symbol(),
+								"exchange": book.Exchange(),
+							})
 						}
 					}
 
 				case "toggle_kmeans":
-					appState.mu.Lock()
-					if msg.KmeansMode != nil {
-						appState.book.SetKmeansMode(*msg.KmeansMode)
-						log.Printf("K-means mode set to: %t", *msg.KmeansMode)
-					}
-					if msg.NumClusters != nil {
-						appState.book.SetNumClusters(*msg.NumClusters)
-						log.Printf("Number of clusters set to: %d", *msg.NumClusters)
-					}
-
-					enabled, clusters := appState.book.GetClusteringInfo()
-					appState.mu.Unlock()
+					var enabled bool
+					var clusters int
+					appState.book.Load().Do(func(ob *L3OrderBook) {
+						if msg.KmeansMode != nil {
+							ob.SetKmeansMode(*msg.KmeansMode)
+							kmeansLog.Info("K-means mode set", "enabled", *msg.KmeansMode)
+						}
+						if msg.NumClusters != nil {
+							ob.SetNumClusters(*msg.NumClusters)
+							kmeansLog.Info("number of clusters set", "clusters", *msg.NumClusters)
+						}
+						enabled, clusters = ob.GetClusteringInfo()
+					})
 
 					// Send confirmation
-					responseMsg := map[string]any{
+					reply(map[string]any{
 						"type":         "kmeans_updated",
 						"kmeans_mode":  enabled,
 						"num_clusters": clusters,
-					}
-					conn.WriteJSON(responseMsg)
+					})
 
 				case "get_clustering_info":
-					appState.mu.RLock()
-					enabled, clusters := appState.book.GetClusteringInfo()
-					appState.mu.RUnlock()
-
-					responseMsg := map[string]any{
+					snapshot := appState.book.Load().Snapshot()
+					reply(map[string]any{
 						"type":         "clustering_info",
-						"kmeans_mode":  enabled,
-						"num_clusters": clusters,
-					}
-					conn.WriteJSON(responseMsg)
+						"kmeans_mode":  snapshot.KmeansMode,
+						"num_clusters": snapshot.NumClusters,
+					})
 
 				case "refresh_precision":
-					appState.mu.Lock()
-					appState.book.RefreshPrecision()
-					appState.mu.Unlock()
+					book := appState.book.Load()
+					if precisionManager != nil {
+						precision := precisionManager.RefreshPrecisionInfo(book.Symbol())
+						book.Do(func(ob *L3OrderBook) { ob.SetPrecision(precision) })
+					}
 
-					responseMsg := map[string]any{
+					reply(map[string]any{
 						"type":    "precision_refreshed",
 						"message": "Precision information updated",
-					}
-					conn.WriteJSON(responseMsg)
+					})
 
-				case "get_precision_info":
+				case "get_front_stats":
 					appState.mu.RLock()
-					precision := appState.book.precision
+					md := appState.md
 					appState.mu.RUnlock()
 
-					responseMsg := map[string]any{
-						"type":      "precision_info",
-						"precision": precision,
+					var stats []FrontStats
+					if md != nil {
+						stats = md.FrontStats()
+					}
+					reply(map[string]any{
+						"type":   "front_stats",
+						"fronts": stats,
+					})
+
+				case "get_routing_stats":
+					reply(map[string]any{
+						"type":  "routing_stats",
+						"stats": appState.router.Stats(),
+					})
+
+				case "get_history":
+					reply(historyReply(msg.Symbol, msg.At))
+
+				case "subscribe_events":
+					if cancelEvents == nil {
+						events, cancel := orderEvents.Subscribe(64)
+						cancelEvents = cancel
+						go func() {
+							for batch := range events {
+								reply(map[string]any{
+									"type":   "order_events",
+									"events": batch,
+								})
+							}
+						}()
+					}
+					reply(map[string]any{"type": "events_subscribed"})
+
+				case "unsubscribe_events":
+					if cancelEvents != nil {
+						cancelEvents()
+						cancelEvents = nil
 					}
-					conn.WriteJSON(responseMsg)
+					reply(map[string]any{"type": "events_unsubscribed"})
+
+				case "subscribe_alerts":
+					if cancelAlerts == nil {
+						batches, cancel := alerts.Subscribe(64)
+						cancelAlerts = cancel
+						go func() {
+							for batch := range batches {
+								reply(map[string]any{
+									"type":   "alerts",
+									"alerts": batch,
+								})
+							}
+						}()
+					}
+					reply(map[string]any{"type": "alerts", "alerts": alerts.Recent()})
+
+				case "unsubscribe_alerts":
+					if cancelAlerts != nil {
+						cancelAlerts()
+						cancelAlerts = nil
+					}
+					reply(map[string]any{"type": "alerts_unsubscribed"})
+
+				case "register_order":
+					if msg.Order == nil {
+						reply(map[string]any{"type": "error", "message": "register_order requires an order"})
+						break
+					}
+					status, err := registerOwnOrder(*msg.Order)
+					if err != nil {
+						reply(map[string]any{"type": "error", "message": err.Error()})
+						break
+					}
+					subscribeOwn()
+					reply(map[string]any{"type": "order_registered", "order": status})
+
+				case "cancel_order":
+					status, err := cancelOwnOrder(msg.ID)
+					if err != nil {
+						reply(map[string]any{"type": "error", "message": err.Error()})
+						break
+					}
+					reply(map[string]any{"type": "order_cancelled", "order": status})
+
+				case "subscribe_orders":
+					subscribeOwn()
+					reply(map[string]any{"type": "own_orders", "orders": listOwnOrders()})
+
+				case "get_orders":
+					reply(map[string]any{"type": "own_orders", "orders": listOwnOrders()})
+
+				case "get_precision_info":
+					reply(map[string]any{
+						"type":      "precision_info",
+						"precision": appState.book.Load().Snapshot().Precision,
+					})
 				}
 			}
 		}()
 
-		for range ticker.C {
-			appState.mu.RLock()
-			snapshot := appState.book.getL3Snapshot(100)
-			appState.mu.RUnlock()
-
-			message := map[string]any{
-				"type": "l3_update",
-				"data": snapshot,
+		for {
+			var message map[string]any
+			select {
+			case <-readerDone:
+				return
+			case message = <-replies:
+			case <-ticker.C:
+				message = map[string]any{
+					"type": "l3_update",
+					"data": appState.book.Load().Snapshot(),
+				}
 			}
 
 			if err := conn.WriteJSON(message); err != nil {
@@ -791,36 +891,15 @@ func wsHandler() http.HandlerFunc {
 
 }
 
-func switchSymbol(newSymbol string) error {
-	appState.mu.Lock()
-	defer appState.mu.Unlock()
-
-	if appState.currentSymbol == newSymbol {
-		return nil // Already on this symbol
-	}
-
-	// Create new book and start new connection
-	appState.book = NewL3OrderBook(newSymbol)
-	appState.currentSymbol = newSymbol
-	// appState.binanceCancel = make(chan bool, 1)
-	select {
-	case appState.symbolC <- fmt.Sprintf("symbol: %s", newSymbol):
-	default:
-	}
-	// go runBinanceSync(newSymbol, appState.book, appState.binanceCancel)
-
-	return nil
-}
-
-func runBinanceSync(symbol string, book *L3OrderBook, cancel chan bool) {
+func runBinanceSync(symbol string, book *BookActor, cancel chan bool) {
 	for {
 		select {
 		case <-cancel:
-			log.Printf("Cancelling Binance sync for %s", strings.ToUpper(symbol))
+			engineLog.Info("cancelling Binance sync", "symbol", strings.ToUpper(symbol))
 			return
 		default:
 			if err := connectAndSync(symbol, book, cancel); err != nil {
-				log.Printf("Connection failed for %s: %v, retrying in 5s...", strings.ToUpper(symbol), err)
+				engineLog.Warn("Binance connection failed, retrying in 5s", "symbol", strings.ToUpper(symbol), "err", err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
@@ -828,8 +907,7 @@ func runBinanceSync(symbol string, book *L3OrderBook, cancel chan bool) {
 	}
 }
 
-func connectAndSync(symbol string, book *L3OrderBook, cancel chan bool) error {
-
+func connectAndSync(symbol string, book *BookActor, cancel chan bool) error {
 	// targetHost = "tcp://182.254.243.31:30011"
 	wsURL := fmt.Sprintf("wss://fstream.binance.com/ws/%s@depth@100ms", symbol)
 
@@ -839,7 +917,7 @@ func connectAndSync(symbol string, book *L3OrderBook, cancel chan bool) error {
 	}
 	defer ws.Close()
 
-	log.Println("Connected Binance WS:", wsURL)
+	engineLog.Info("connected Binance WS", "url", wsURL)
 
 	// Fetch initial snapshot
 	snapURL := fmt.Sprintf("https://fapi.binance.com/fapi/v1/depth?symbol=%s&limit=1000",
@@ -867,14 +945,14 @@ func connectAndSync(symbol string, book *L3OrderBook, cancel chan bool) error {
 	}
 
 snapshotLoaded:
-	book.loadSnapshot(&snapResp)
-	log.Printf("L3 Order Book snapshot loaded: %d", snapResp.LastUpdateID)
+	book.LoadSnapshot(&snapResp)
+	engineLog.Info("L3 order book snapshot loaded", "last_update_id", snapResp.LastUpdateID)
 
 	// Process real-time updates
 	for {
 		select {
 		case <-cancel:
-			log.Printf("Cancelling Binance sync for %s", strings.ToUpper(symbol))
+			engineLog.Info("cancelling Binance sync", "symbol", strings.ToUpper(symbol))
 			return fmt.Errorf("cancelled")
 		default:
 			// Set a reasonable read deadline
@@ -893,109 +971,313 @@ snapshotLoaded:
 
 			var update binanceWSUpdate
 			if err := json.Unmarshal(msg, &update); err != nil {
-				log.Printf("Failed to unmarshal update: %v", err)
+				engineLog.Warn("unmarshal Binance update failed", "err", err)
 				continue
 			}
-			dump.P(update)
+			engineLog.Debug("Binance update", "first", update.U, "final", update.FinalUpdateID, "bids", len(update.B), "asks", len(update.A))
 
-			book.applyDelta(&update)
+			book.ApplyDelta(&update)
 		}
 	}
 }
 
-func connectCtpAsync(symbol string, appState *AppState) error {
-	mdctp := CreateMdCtp("04500", "1080")
+func connectCtpAsync(mdctp *MdCtp, profile *CtpProfile, appState *AppState) error {
+	appState.mu.Lock()
+	appState.md = mdctp
+	appState.mu.Unlock()
 
 	mdctp.OnRtnDepthMarketDataCallback = func(f *thost.CThostFtdcDepthMarketDataField) {
+		if ctpLog.Enabled(context.Background(), slog.LevelDebug) {
+			ctpLog.Debug("行情数据", "instrument", f.InstrumentID.String(), "last", float64(f.LastPrice),
+				"bid", float64(f.BidPrice1), "bid_volume", int(f.BidVolume1),
+				"ask", float64(f.AskPrice1), "ask_volume", int(f.AskVolume1),
+				"volume", int(f.Volume), "time", f.UpdateTime.String())
+		}
 
-		log.Printf("行情数据: %s | 最新价:%.4f | 买1:%.4f/%d | 卖1:%.4f/%d | 成交量:%d | 时间:%s",
-			f.InstrumentID,
-			f.LastPrice,
-			f.BidPrice1, f.BidVolume1,
-			f.AskPrice1, f.AskVolume1,
-			f.Volume,
-			f.UpdateTime)
-
-		appState.book.applyDelta(&binanceWSUpdate{
-			A: [][]string{
-				{decimal.NewFromFloat(float64(f.AskPrice1)).String(), decimal.NewFromFloat(float64(f.AskVolume1)).String()},
-				{decimal.NewFromFloat(float64(f.AskPrice2)).String(), decimal.NewFromFloat(float64(f.AskVolume2)).String()},
-				{decimal.NewFromFloat(float64(f.AskPrice3)).String(), decimal.NewFromFloat(float64(f.AskVolume3)).String()},
-				{decimal.NewFromFloat(float64(f.AskPrice4)).String(), decimal.NewFromFloat(float64(f.AskVolume4)).String()},
-				{decimal.NewFromFloat(float64(f.AskPrice5)).String(), decimal.NewFromFloat(float64(f.AskVolume5)).String()},
-			},
-			B: [][]string{
-				{decimal.NewFromFloat(float64(f.BidPrice1)).String(), decimal.NewFromFloat(float64(f.BidVolume1)).String()},
-				{decimal.NewFromFloat(float64(f.BidPrice2)).String(), decimal.NewFromFloat(float64(f.BidVolume2)).String()},
-				{decimal.NewFromFloat(float64(f.BidPrice3)).String(), decimal.NewFromFloat(float64(f.BidVolume3)).String()},
-				{decimal.NewFromFloat(float64(f.BidPrice4)).String(), decimal.NewFromFloat(float64(f.BidVolume4)).String()},
-				{decimal.NewFromFloat(float64(f.BidPrice5)).String(), decimal.NewFromFloat(float64(f.BidVolume5)).String()},
-			},
-		})
-	}
-
-	if err := mdctp.Connect("tcp://180.169.112.52:42213"); err != nil {
-		log.Printf("Connect failed: %v", err)
+		appState.router.dispatch(f)
+	}
+
+	if err := mdctp.Connect(profile.MdFronts...); err != nil {
+		ctpLog.Error("连接失败", "err", err)
 		return err
 	}
 
 	if err := mdctp.Login(); err != nil {
-		log.Printf("Login failed: %v", err)
+		ctpLog.Error("登录失败", "err", err)
 		return err
 	}
 
-	if err := mdctp.SubscribeMarketData(symbol); err != nil {
-		log.Printf("SubscribeMarketData failed: %v", err)
+	if err := subscribeActiveSymbol(mdctp); err != nil {
+		ctpLog.Error("订阅行情失败", "err", err)
 		return err
 	}
 
-	var lastSymbol = symbol // 记录上一次的symbol
-	for s := range appState.symbolC {
-		if strings.Contains(s, "symbol: ") {
-			switchSymbol := strings.TrimPrefix(s, "symbol: ")
-			log.Printf("Switching to symbol: %s", switchSymbol)
-			if err := mdctp.UnsubscribeMarketData(lastSymbol); err != nil {
-				log.Printf("UnsubscribeMarketData failed: %v", err)
-				return err
+	return nil
+}
+
+func realMain() {
+	configPath := flag.String("config", envOrDefault(envConfigPath, defaultConfigPath), "path to the CTP config file")
+	profileName := flag.String("profile", "", "CTP profile name (default: $CTP_PROFILE or the config default)")
+	simMode := flag.Bool("sim", false, "use the local simulated market data front instead of CTP")
+	simFile := flag.String("sim-file", "", "replay recorded ticks (JSON lines) through the simulated front")
+	simSpeed := flag.Float64("sim-speed", 1, "replay speed factor for -sim-file (0 replays at -sim-interval)")
+	simInterval := flag.Duration("sim-interval", 500*time.Millisecond, "tick interval of the simulated front")
+	simPrice := flag.Float64("sim-price", 5000, "starting price of synthetic ticks")
+	simTick := flag.Float64("sim-tick", 1, "tick size of synthetic ticks")
+	recordPath := flag.String("record", "", "append received ticks to this file (JSON lines)")
+	instrumentsPath := flag.String("instruments", defaultInstrumentStorePath, "local instrument dictionary cache file")
+	importInstruments := flag.String("import-instruments", "", "import instruments from a JSON or CSV file into the local dictionary")
+	offline := flag.Bool("offline", false, "never query the online instrument dictionary")
+	traderQuery := flag.Bool("trader-query", false, "query exact instrument info through the CTP trader API (td_fronts)")
+	traderOrdersOn := flag.Bool("trader-orders", false, "track our live orders from the CTP trader API (OnRtnOrder/OnRtnTrade) in the queues")
+	simOrders := flag.Duration("sim-orders", 0, "with -sim and -trader-orders, place simulated orders at this interval (0 disables)")
+	historyPath := flag.String("history", defaultHistoryPath, "snapshot history database (empty disables history)")
+	historyKeyframe := flag.Duration("history-keyframe", defaultHistoryKeyframe, "record a snapshot at least this often while the book is unchanged")
+	exportSource := flag.String("export", "", "export L3 data from a tick replay file or snapshot history database (.db) and exit")
+	exportOut := flag.String("export-out", "l3export", "export output prefix, writes <prefix>.orders.<format> and <prefix>.levels.<format>")
+	exportFormats := flag.String("export-format", "csv", "comma separated export formats: csv, parquet")
+	exportFrom := flag.String("export-from", "", "export snapshots at or after this time")
+	exportTo := flag.String("export-to", "", "export snapshots at or before this time")
+	exportLevels := flag.Int("export-levels", 10, "levels per side to export (0 exports all)")
+	exportClusters := flag.Int("export-clusters", 0, "K-means clusters when exporting a tick replay (0 disables)")
+	eventLogPath := flag.String("event-log", "", "append inferred order lifecycle events to this file (JSON lines)")
+	historyRetention := flag.Duration("history-retention", defaultHistoryRetention, "prune history older than this (0 keeps everything)")
+	flag.DurationVar(&fillHorizon, "fill-horizon", defaultFillHorizon, "horizon of the per-level fill probabilities in snapshots")
+	flag.BoolVar(&detectLargeOrders, "detect-large", true, "alert on whale orders and iceberg refills")
+	flag.Float64Var(&whaleZ, "whale-z", whaleZ, "log-size standard deviations above the product mean that make a whale order")
+	flag.IntVar(&icebergRefills, "iceberg-refills", icebergRefills, "identical refills after fills that make an iceberg")
+	flag.BoolVar(&detectSpoofing, "detect-spoofing", true, "flag spoofing and layering episodes")
+	flag.Float64Var(&spoofZ, "spoof-z", spoofZ, "log-size standard deviations above the product mean of a possible spoof order")
+	spoofLogPath := flag.String("spoof-log", "", "append spoofing and layering episodes to this file for review (JSON lines)")
+	logLevel := flag.String("log-level", "info", "log level, optionally followed by subsystem=level pairs, e.g. info,ctp=debug (subsystems: ctp, engine, ws, kmeans, precision)")
+	logJSON := flag.Bool("log-json", false, "write logs as JSON lines")
+	alertWebhook := flag.String("alert-webhook", "", "POST alerts as JSON to this URL")
+	flag.StringVar(&bookCheck, "book-check", bookCheck, "invariant checks after each update: off, log (log and count violations) or repair (also rebuild broken levels from L2, keeping own orders in place)")
+	flag.Parse()
+
+	if err := setupLogging(*logJSON, *logLevel); err != nil {
+		fatal(engineLog, "invalid -log-level", "err", err)
+	}
+	switch bookCheck {
+	case BookCheckOff, BookCheckLog, BookCheckRepair:
+	default:
+		fatal(engineLog, "invalid -book-check", "mode", bookCheck)
+	}
+
+	symbol := "ag2510" // Default symbol, may be exchange-qualified, e.g. SHFE.ag2510
+	if flag.NArg() > 0 {
+		symbol = flag.Arg(0)
+	}
+
+	store := NewInstrumentStore(*instrumentsPath)
+	if err := store.Load(); err != nil {
+		fatal(precisionLog, "load instrument store failed", "err", err)
+	}
+	if *importInstruments != "" {
+		if _, err := store.ImportFile(*importInstruments); err != nil {
+			fatal(precisionLog, "import instruments failed", "err", err)
+		}
+	}
+	precisionManager = NewPrecisionManager(store)
+	precisionManager.SetOffline(*offline)
+
+	if *exportSource != "" {
+		opts := ExportOptions{
+			Source:   *exportSource,
+			Symbol:   symbol,
+			Out:      *exportOut,
+			Formats:  splitList(*exportFormats),
+			Levels:   *exportLevels,
+			Clusters: *exportClusters,
+		}
+		var err error
+		if *exportFrom != "" {
+			if opts.From, err = parseHistoryTime(*exportFrom); err != nil {
+				fatal(engineLog, "invalid -export-from", "err", err)
 			}
-			time.Sleep(1 * time.Second)
-			if err := mdctp.SubscribeMarketData(switchSymbol); err != nil {
-				log.Printf("SubscribeMarketData failed: %v", err)
-				return err
+		}
+		if *exportTo != "" {
+			if opts.To, err = parseHistoryTime(*exportTo); err != nil {
+				fatal(engineLog, "invalid -export-to", "err", err)
+			}
+		}
+		if err := runExport(opts); err != nil {
+			fatal(engineLog, "export failed", "err", err)
+		}
+		return
+	}
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fatal(ctpLog, "load config failed", "err", err)
+	}
+	profile, err := cfg.Profile(*profileName)
+	if err != nil {
+		fatal(ctpLog, "select profile failed", "err", err)
+	}
+
+	var mdctp *MdCtp
+	var simTd *SimTraderApi // Simulated trader, also matches orders against the simulated ticks
+	if *simMode || *simFile != "" {
+		simTd = NewSimTraderApi(*simTick)
+		opts := SimOptions{
+			Speed:     *simSpeed,
+			Loop:      true,
+			Interval:  *simInterval,
+			BasePrice: *simPrice,
+			TickSize:  *simTick,
+			Trader:    simTd,
+		}
+		if *simFile != "" {
+			if opts.Ticks, err = LoadSimTicks(*simFile); err != nil {
+				fatal(ctpLog, "load sim ticks failed", "err", err)
 			}
-			lastSymbol = switchSymbol
+			ctpLog.Info("回放录制的行情", "ticks", len(opts.Ticks), "path", *simFile)
+		}
+		profile.MdFronts = []string{simFrontAddr}
+		mdctp = CreateSimMdCtp(profile.UserID, profile.BrokerID, opts)
+		ctpLog.Info("使用模拟行情前置")
+	} else {
+		mdctp = CreateMdCtpFromProfile(profile)
+		ctpLog.Info("使用 CTP 配置档案", "profile", profile)
+	}
+
+	if *traderQuery || *traderOrdersOn {
+		var tdctp *TdCtp
+		if simTd != nil {
+			tdctp = NewTdCtp(simTd, profile)
 		} else {
+			tdctp = CreateTdCtpFromProfile(profile)
+		}
+		if *traderOrdersOn {
+			// Registered before login, which replays the day's orders
+			traderOrders = NewTraderOrderBridge()
+			tdctp.OnRtnOrderCallback = traderOrders.OnRtnOrder
+			tdctp.OnRtnTradeCallback = traderOrders.OnRtnTrade
+		}
+		if simTd != nil {
+			err = tdctp.Start(simFrontAddr)
+		} else {
+			err = tdctp.Start(profile.TdFronts...)
+		}
+		if err != nil {
+			ctpLog.Warn("交易 API 不可用，仅使用合约字典", "err", err)
+			tdctp.Release()
+			traderOrders = nil
+		} else {
+			if *traderQuery {
+				precisionManager.SetQuerier(tdctp)
+			}
+			if traderOrders != nil && simTd != nil && *simOrders > 0 {
+				simTd.StartOrderFlow(*simOrders, 10**simOrders)
+				ctpLog.Info("定时发送模拟报单", "every", *simOrders)
+			}
+		}
+	}
 
+	if *recordPath != "" {
+		recorder, err := NewTickRecorder(*recordPath)
+		if err != nil {
+			fatal(ctpLog, "create tick recorder failed", "err", err)
 		}
+		mdctp.Recorder = recorder
+		go func() {
+			for range time.Tick(time.Second) {
+				if err := recorder.Flush(); err != nil {
+					ctpLog.Error("写入录制行情失败", "err", err)
+				}
+			}
+		}()
+		ctpLog.Info("录制行情", "path", *recordPath)
 	}
 
-	return nil
+	if *eventLogPath != "" {
+		eventLog, err := NewOrderEventRecorder(*eventLogPath)
+		if err != nil {
+			fatal(engineLog, "create order event log failed", "err", err)
+		}
+		orderEvents.SetRecorder(eventLog)
+		go func() {
+			for range time.Tick(time.Second) {
+				if err := eventLog.Flush(); err != nil {
+					engineLog.Error("flush order event log failed", "err", err)
+				}
+			}
+		}()
+		engineLog.Info("recording order events", "path", *eventLogPath)
+	}
 
-}
+	if *spoofLogPath != "" {
+		if err := surveillance.Open(*spoofLogPath); err != nil {
+			fatal(engineLog, "open surveillance log failed", "err", err)
+		}
+		go func() {
+			for range time.Tick(time.Second) {
+				if err := surveillance.Flush(); err != nil {
+					engineLog.Error("flush surveillance log failed", "err", err)
+				}
+			}
+		}()
+		engineLog.Info("recording surveillance episodes", "path", *spoofLogPath)
+	}
 
-func realMain() {
-	symbol := "ag2510" // Default symbol
-	if len(os.Args) > 1 {
-		symbol = os.Args[1]
+	if *alertWebhook != "" {
+		alerts.SetWebhook(NewWebhookSender(*alertWebhook))
+		engineLog.Info("posting alerts", "url", *alertWebhook)
 	}
 
+	book := NewBookActor(symbol)
 	appState = &AppState{
-		book:          NewL3OrderBook(symbol),
-		currentSymbol: symbol,
+		currentSymbol: book.Symbol(),
 		binanceCancel: make(chan bool, 1),
-		symbolC:       make(chan string, 1),
+	}
+	appState.book.Store(book)
+	appState.router.set(book.Symbol(), book)
+	if traderOrders != nil {
+		traderOrders.Attach()
+		ctpLog.Info("从交易 API 跟踪自有报单")
+	}
+
+	if *historyPath != "" {
+		history, err := OpenSnapshotHistory(*historyPath, *historyRetention)
+		if err != nil {
+			fatal(engineLog, "open snapshot history failed", "err", err)
+		}
+		appState.history = history
+		go history.Record(appState.book.Load, *historyKeyframe, nil)
+		engineLog.Info("recording snapshot history", "path", *historyPath)
 	}
 
-	// go runBinanceSync(symbol, appState.book, appState.binanceCancel)
+	// go runBinanceSync(symbol, appState.book.Load(), appState.binanceCancel)
 
-	go connectCtpAsync(symbol, appState)
+	go connectCtpAsync(mdctp, profile, appState)
 
 	http.Handle("/", http.FileServer(http.Dir("static")))
 	http.HandleFunc("/ws", wsHandler())
-
-	log.Printf("L3 Order Book Server running on http://localhost:8080")
-	log.Printf("Symbol: %s", symbol)
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.HandleFunc("/api/ctp/fronts", frontStatsHandler())
+	http.HandleFunc("GET /api/ctp/routing", routingStatsHandler())
+	http.HandleFunc("GET /api/history/{symbol}", historyHandler())
+	http.HandleFunc("GET /api/orders", ownOrdersHandler())
+	http.HandleFunc("POST /api/orders", registerOwnOrderHandler())
+	http.HandleFunc("DELETE /api/orders/{id}", cancelOwnOrderHandler())
+	http.HandleFunc("GET /api/fill/{symbol}", fillEstimateHandler())
+	http.HandleFunc("GET /api/microstructure/{symbol}", microstructureHandler())
+	http.HandleFunc("POST /api/resync/{symbol}", resyncHandler())
+	http.HandleFunc("GET /api/alerts", alertsHandler())
+	http.HandleFunc("GET /metrics", metricsHandler())
+	http.HandleFunc("GET /api/log/levels", logLevelsHandler())
+	http.HandleFunc("PUT /api/log/levels", setLogLevelsHandler())
+	http.HandleFunc("GET /api/rules", rulesHandler())
+	http.HandleFunc("POST /api/rules", addRuleHandler())
+	http.HandleFunc("DELETE /api/rules/{id}", deleteRuleHandler())
+	http.HandleFunc("GET /api/surveillance", surveillanceHandler())
+	http.HandleFunc("POST /api/webhook", webhookReceiveHandler())
+	http.HandleFunc("GET /api/webhook", webhookInboxHandler())
+	http.HandleFunc("GET /api/instruments/{id}", instrumentHandler())
+	http.HandleFunc("POST /api/instruments/refresh", instrumentRefreshHandler())
+
+	wsLog.Info("L3 order book server running", "url", "http://localhost:8080", "symbol", symbol)
+	fatal(wsLog, "server stopped", "err", http.ListenAndServe(":8080", nil))
 }
 
 func main() {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// Books of unknown symbols fall back to tick size 1 without the network
+	precisionManager = NewPrecisionManager(nil)
+	precisionManager.SetOffline(true)
+	setLogLevels(map[string]string{"*": "error"})
+	os.Exit(m.Run())
+}
+
+// newTestBook returns a book with tick size 1 and a fixed clock
+func newTestBook(t *testing.T) *L3OrderBook {
+	t.Helper()
+	ob := NewL3OrderBook("test")
+	ob.SetClock(func() int64 { return 1000 })
+	return ob
+}
+
+// newTestActor starts a book actor routed as the only book of the app
+func newTestActor(t *testing.T) *BookActor {
+	t.Helper()
+	a := NewBookActor("test")
+	a.Do(func(ob *L3OrderBook) { ob.SetClock(func() int64 { return 1000 }) })
+	appState = &AppState{}
+	appState.router.set(a.Symbol(), a)
+	t.Cleanup(func() {
+		a.Stop()
+		appState = nil
+	})
+	return a
+}
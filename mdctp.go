@@ -2,70 +2,272 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pseudocodes/go2ctp/ctp"
 	"github.com/pseudocodes/go2ctp/thost"
 )
 
+// defaultRspTimeout 是等待 CTP 异步应答的默认超时时间
+const defaultRspTimeout = 10 * time.Second
+
+// errMdUnavailable 在 MdApi 已释放或正在故障切换中重建时返回
+var errMdUnavailable = errors.New("MdApi 已释放或正在重建")
+
+// rspFuture 表示一个等待 CTP 异步应答的请求
+type rspFuture struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newRspFuture() *rspFuture {
+	return &rspFuture{done: make(chan struct{})}
+}
+
+// resolve 设置应答结果，只有第一次调用生效
+func (f *rspFuture) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+	})
+}
+
+// wait 等待应答结果或超时
+func (f *rspFuture) wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return f.err
+	case <-timer.C:
+		return fmt.Errorf("等待应答超时 (%s)", timeout)
+	}
+}
+
+// succeeded 判断请求是否已成功应答（超时或失败均返回 false）
+func (f *rspFuture) succeeded() bool {
+	select {
+	case <-f.done:
+		return f.err == nil
+	default:
+		return false
+	}
+}
+
+// rspInfoError 将 CTP 应答信息转换为 error，成功时返回 nil
+func rspInfoError(rspInfo *thost.CThostFtdcRspInfoField) error {
+	if rspInfo == nil || rspInfo.ErrorID == 0 {
+		return nil
+	}
+	return fmt.Errorf("ErrorID=%d, ErrorMsg=%s", rspInfo.ErrorID, rspInfo.ErrorMsg.GBString())
+}
+
 type MdCtp struct {
 	ctp.BaseMdSpi
-	UserID   string
-	BrokerID string
-	mdapi    thost.MdApi
-	resultC  chan int
+	UserID     string
+	BrokerID   string
+	Password   string
+	RspTimeout time.Duration // 等待异步应答的超时时间
+	Recorder   *TickRecorder // 非空时录制收到的深度行情
+	mdapi      thost.MdApi
+	newMdApi   func() thost.MdApi // 故障切换时用于重建 MdApi
+	started    bool               // 当前 mdapi 是否已调用 Init
+
+	requestID  atomic.Int32
+	mu         sync.Mutex
+	connectF   *rspFuture              // 等待 OnFrontConnected
+	pending    map[int]*rspFuture      // nRequestID -> 登录/登出等请求
+	subPending map[string][]*rspFuture // "sub:"/"unsub:" + InstrumentID -> 订阅请求
+
+	fronts      []*FrontStats       // 前置地址及统计信息，按配置顺序
+	ranked      []int               // 按探测延迟排序的前置索引
+	activeFront int                 // 当前连接的前置索引，-1 表示未连接
+	connected   bool                // 前置是否处于连接状态
+	loggedIn    bool                // 是否已登录，故障切换后自动重新登录
+	subscribed  map[string]struct{} // 已订阅合约，故障切换后自动重新订阅
+	failingOver atomic.Bool
+	closed      chan struct{} // Release 时关闭，停止故障切换
 }
 
 var _ thost.MdSpi = &MdCtp{}
 
 func CreateMdCtp(userID, brokerID string) *MdCtp {
-	mdapi := ctp.CreateMdApi(ctp.MdFlowPath("flows/"), ctp.MdUsingUDP(false), ctp.MdMultiCast(false))
+	return newMdCtp(func() thost.MdApi {
+		return ctp.CreateMdApi(ctp.MdFlowPath("flows/"), ctp.MdUsingUDP(false), ctp.MdMultiCast(false))
+	}, userID, brokerID)
+}
 
-	mdctp := &MdCtp{
-		UserID:   userID,
-		BrokerID: brokerID,
-		mdapi:    mdapi,
-		resultC:  make(chan int, 1),
-	}
+// CreateMdCtpFromProfile 根据配置档案创建 MdCtp
+func CreateMdCtpFromProfile(profile *CtpProfile) *MdCtp {
+	flowPath := profile.FlowPath
+	mdctp := newMdCtp(func() thost.MdApi {
+		return ctp.CreateMdApi(ctp.MdFlowPath(flowPath), ctp.MdUsingUDP(false), ctp.MdMultiCast(false))
+	}, profile.UserID, profile.BrokerID)
+	mdctp.Password = profile.Password
 	return mdctp
 }
 
-func (mdctp *MdCtp) Connect(frontAddr string) error {
-	mdctp.mdapi.RegisterSpi(mdctp)
-	mdctp.mdapi.RegisterFront(frontAddr)
-	mdctp.mdapi.Init()
-	ret := <-mdctp.resultC
-	if ret != 0 {
-		log.Printf("Connect failed: %d", ret)
-		return fmt.Errorf("Connect failed: %d", ret)
-	} else {
-		log.Printf("Connect success")
+func newMdCtp(newMdApi func() thost.MdApi, userID, brokerID string) *MdCtp {
+	return &MdCtp{
+		UserID:      userID,
+		BrokerID:    brokerID,
+		RspTimeout:  defaultRspTimeout,
+		mdapi:       newMdApi(),
+		newMdApi:    newMdApi,
+		pending:     make(map[int]*rspFuture),
+		subPending:  make(map[string][]*rspFuture),
+		activeFront: -1,
+		subscribed:  make(map[string]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// api 返回当前使用的 MdApi，故障切换时会被替换，释放后及重建期间为 nil
+func (mdctp *MdCtp) api() thost.MdApi {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+	return mdctp.mdapi
+}
+
+// isClosed 判断是否已调用 Release，调用方需持有 mu
+func (mdctp *MdCtp) isClosed() bool {
+	select {
+	case <-mdctp.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// nextRequestID 生成递增的请求编号
+func (mdctp *MdCtp) nextRequestID() int {
+	return int(mdctp.requestID.Add(1))
+}
+
+// trackRequest 登记一个按 nRequestID 关联的请求
+func (mdctp *MdCtp) trackRequest(requestID int) *rspFuture {
+	f := newRspFuture()
+	mdctp.mu.Lock()
+	mdctp.pending[requestID] = f
+	mdctp.mu.Unlock()
+	return f
+}
+
+// resolveRequest 完成 nRequestID 对应的请求
+func (mdctp *MdCtp) resolveRequest(requestID int, err error) bool {
+	mdctp.mu.Lock()
+	f, ok := mdctp.pending[requestID]
+	delete(mdctp.pending, requestID)
+	mdctp.mu.Unlock()
+	if ok {
+		f.resolve(err)
+	}
+	return ok
+}
+
+// trackInstruments 为每个合约登记一个订阅/退订请求
+func (mdctp *MdCtp) trackInstruments(kind string, instrumentIDs []string) []*rspFuture {
+	futures := make([]*rspFuture, len(instrumentIDs))
+	mdctp.mu.Lock()
+	for i, id := range instrumentIDs {
+		f := newRspFuture()
+		key := kind + ":" + id
+		mdctp.subPending[key] = append(mdctp.subPending[key], f)
+		futures[i] = f
+	}
+	mdctp.mu.Unlock()
+	return futures
+}
+
+// resolveInstrument 完成合约对应的所有订阅/退订请求
+func (mdctp *MdCtp) resolveInstrument(kind, instrumentID string, err error) bool {
+	key := kind + ":" + instrumentID
+	mdctp.mu.Lock()
+	futures := mdctp.subPending[key]
+	delete(mdctp.subPending, key)
+	mdctp.mu.Unlock()
+	for _, f := range futures {
+		f.resolve(err)
+	}
+	return len(futures) > 0
+}
+
+// untrackInstruments 请求发送失败时撤销登记
+func (mdctp *MdCtp) untrackInstruments(kind string, instrumentIDs []string, err error) {
+	for _, id := range instrumentIDs {
+		mdctp.resolveInstrument(kind, id, err)
+	}
+}
+
+// waitInstruments 等待所有合约的应答，汇总失败的合约
+func (mdctp *MdCtp) waitInstruments(instrumentIDs []string, futures []*rspFuture) error {
+	deadline := time.Now().Add(mdctp.RspTimeout)
+	var failed []string
+	for i, f := range futures {
+		if err := f.wait(time.Until(deadline)); err != nil {
+			failed = append(failed, fmt.Sprintf("%s(%v)", instrumentIDs[i], err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d/%d 个合约失败: %s", len(failed), len(instrumentIDs), strings.Join(failed, ", "))
 	}
-	return nil // 返回错误
+	return nil
+}
+
+// Connect 探测所有前置的连接延迟，按延迟从低到高依次尝试连接
+func (mdctp *MdCtp) Connect(frontAddrs ...string) error {
+	if len(frontAddrs) == 0 {
+		return fmt.Errorf("前置地址列表为空")
+	}
+
+	mdctp.setFronts(frontAddrs)
+	var lastErr error
+	for _, idx := range mdctp.ProbeFronts() {
+		if err := mdctp.connectFront(idx); err != nil {
+			lastErr = err
+			continue
+		}
+		ctpLog.Info("连接成功")
+		return nil
+	}
+	ctpLog.Error("连接失败", "err", lastErr)
+	return fmt.Errorf("Connect failed: %w", lastErr)
 }
 
 // Login 用户登录
 func (mdctp *MdCtp) Login() error {
 	loginReq := &thost.CThostFtdcReqUserLoginField{}
 	copy(loginReq.UserID[:], mdctp.UserID)
-	copy(loginReq.Password[:], "")
+	copy(loginReq.Password[:], mdctp.Password)
 	copy(loginReq.BrokerID[:], mdctp.BrokerID)
 
-	ret := mdctp.mdapi.ReqUserLogin(loginReq, 1)
+	requestID := mdctp.nextRequestID()
+	api := mdctp.api()
+	if api == nil {
+		return errMdUnavailable
+	}
+	f := mdctp.trackRequest(requestID)
+	ret := api.ReqUserLogin(loginReq, requestID)
 	if ret != 0 {
+		mdctp.resolveRequest(requestID, nil)
 		return fmt.Errorf("登录请求发送失败，返回码: %d", ret)
 	}
 
-	log.Printf("发送登录请求: UserID=%s, BrokerID=%s\n", mdctp.UserID, mdctp.BrokerID)
-	ret = <-mdctp.resultC
-	if ret != 0 {
-		return fmt.Errorf("登录失败，返回码: %d", ret)
+	ctpLog.Info("发送登录请求", "user_id", mdctp.UserID, "broker_id", mdctp.BrokerID, "request_id", requestID)
+	if err := f.wait(mdctp.RspTimeout); err != nil {
+		return fmt.Errorf("登录失败: %w", err)
 	}
+	mdctp.mu.Lock()
+	mdctp.loggedIn = true
+	mdctp.mu.Unlock()
 	return nil
 }
 
@@ -75,133 +277,250 @@ func (mdctp *MdCtp) Logout(userID, brokerID string) error {
 	copy(logoutReq.UserID[:], userID)
 	copy(logoutReq.BrokerID[:], brokerID)
 
-	ret := mdctp.mdapi.ReqUserLogout(logoutReq, 2)
+	requestID := mdctp.nextRequestID()
+	api := mdctp.api()
+	if api == nil {
+		return errMdUnavailable
+	}
+	f := mdctp.trackRequest(requestID)
+	ret := api.ReqUserLogout(logoutReq, requestID)
 	if ret != 0 {
+		mdctp.resolveRequest(requestID, nil)
 		return fmt.Errorf("登出请求发送失败，返回码: %d", ret)
 	}
 
-	log.Printf("发送登出请求: UserID=%s, BrokerID=%s\n", userID, brokerID)
-	ret = <-mdctp.resultC
-	if ret != 0 {
-		return fmt.Errorf("登出失败，返回码: %d", ret)
+	ctpLog.Info("发送登出请求", "user_id", userID, "broker_id", brokerID, "request_id", requestID)
+	if err := f.wait(mdctp.RspTimeout); err != nil {
+		return fmt.Errorf("登出失败: %w", err)
 	}
+	mdctp.mu.Lock()
+	mdctp.loggedIn = false
+	mdctp.mu.Unlock()
 	return nil
 }
 
-// SubscribeMarketData 订阅行情数据
+// LoggedIn 返回是否已登录
+func (mdctp *MdCtp) LoggedIn() bool {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+	return mdctp.loggedIn
+}
+
+// ConnectionState 返回前置是否已连接以及是否已登录
+func (mdctp *MdCtp) ConnectionState() (connected, loggedIn bool) {
+	mdctp.mu.Lock()
+	defer mdctp.mu.Unlock()
+	return mdctp.connected, mdctp.loggedIn
+}
+
+// SubscribeMarketData 订阅行情数据，等待每个合约的订阅应答
 func (mdctp *MdCtp) SubscribeMarketData(instrumentIDs ...string) error {
 	if len(instrumentIDs) == 0 {
 		return fmt.Errorf("合约列表为空")
 	}
 
-	ret := mdctp.mdapi.SubscribeMarketData(instrumentIDs...)
+	api := mdctp.api()
+	if api == nil {
+		return errMdUnavailable
+	}
+	futures := mdctp.trackInstruments("sub", instrumentIDs)
+	ret := api.SubscribeMarketData(instrumentIDs...)
 	if ret != 0 {
-		log.Printf("订阅行情失败: %+v, 返回码: %d\n", instrumentIDs, ret)
-	} else {
-		log.Printf("订阅行情成功: %+v\n", instrumentIDs)
+		ctpLog.Error("订阅行情失败", "instruments", instrumentIDs, "ret", ret)
+		err := fmt.Errorf("订阅行情请求发送失败，返回码: %d", ret)
+		mdctp.untrackInstruments("sub", instrumentIDs, err)
+		return err
 	}
 
-	log.Printf("批量订阅行情: %+v\n", instrumentIDs)
-	ret = <-mdctp.resultC
-	if ret != 0 {
-		return fmt.Errorf("订阅行情失败，返回码: %d", ret)
+	ctpLog.Info("批量订阅行情", "instruments", instrumentIDs)
+	err := mdctp.waitInstruments(instrumentIDs, futures)
+	mdctp.mu.Lock()
+	for i, id := range instrumentIDs {
+		if futures[i].succeeded() {
+			mdctp.subscribed[id] = struct{}{}
+		}
+	}
+	mdctp.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("订阅行情失败: %w", err)
 	}
 	return nil
 }
 
-// UnsubscribeMarketData 取消订阅行情数据
+// UnsubscribeMarketData 取消订阅行情数据，等待每个合约的退订应答
 func (mdctp *MdCtp) UnsubscribeMarketData(instrumentIDs ...string) error {
 	if len(instrumentIDs) == 0 {
 		return fmt.Errorf("合约列表为空")
 	}
 
-	ret := mdctp.mdapi.UnSubscribeMarketData(instrumentIDs...)
+	api := mdctp.api()
+	if api == nil {
+		return errMdUnavailable
+	}
+	futures := mdctp.trackInstruments("unsub", instrumentIDs)
+	ret := api.UnSubscribeMarketData(instrumentIDs...)
 	if ret != 0 {
-		log.Printf("取消订阅行情失败: %+v, 返回码: %d", instrumentIDs, ret)
-	} else {
-		log.Printf("取消订阅行情成功: %+v", instrumentIDs)
+		ctpLog.Error("取消订阅行情失败", "instruments", instrumentIDs, "ret", ret)
+		err := fmt.Errorf("取消订阅行情请求发送失败，返回码: %d", ret)
+		mdctp.untrackInstruments("unsub", instrumentIDs, err)
+		return err
 	}
 
-	log.Printf("批量取消订阅行情: %+v", instrumentIDs)
-	ret = <-mdctp.resultC
-	if ret != 0 {
-		return fmt.Errorf("取消订阅行情失败，返回码: %d", ret)
+	ctpLog.Info("批量取消订阅行情", "instruments", instrumentIDs)
+	err := mdctp.waitInstruments(instrumentIDs, futures)
+	// 未确认退订的合约仍可能在上游订阅中，保留以便故障切换后恢复
+	mdctp.mu.Lock()
+	for i, id := range instrumentIDs {
+		if futures[i].succeeded() {
+			delete(mdctp.subscribed, id)
+		}
+	}
+	mdctp.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("取消订阅行情失败: %w", err)
 	}
 	return nil
 }
 
-// Release 释放资源
+// Release 释放资源并停止故障切换，之后的断开不再触发重连
 func (mdctp *MdCtp) Release() {
-	if mdctp.mdapi != nil {
-		mdctp.mdapi.Release()
-		log.Println("MdCtp 资源已释放")
+	mdctp.mu.Lock()
+	if !mdctp.isClosed() {
+		close(mdctp.closed)
+	}
+	api := mdctp.mdapi
+	mdctp.mdapi = nil
+	mdctp.mu.Unlock()
+
+	if api != nil {
+		api.Release()
+		ctpLog.Info("MdCtp 资源已释放")
 	}
 }
 
 func (mdctp *MdCtp) OnFrontConnected() {
-	log.Println("OnFrontConnected")
-	mdctp.resultC <- 0
+	mdctp.mu.Lock()
+	f := mdctp.connectF
+	mdctp.connectF = nil
+	mdctp.connected = true
+	mdctp.mu.Unlock()
+
+	if f == nil {
+		// 断线后 API 自动重连，此时没有等待中的 Connect
+		ctpLog.Info("OnFrontConnected", "reconnected", true)
+	} else {
+		ctpLog.Info("OnFrontConnected")
+		f.resolve(nil)
+	}
+	if mdctp.OnFrontConnectedCallback != nil {
+		mdctp.OnFrontConnectedCallback()
+	}
 }
 
 func (mdctp *MdCtp) OnFrontDisconnected(reason int) {
-	log.Println("OnFrontDisconnected", reason)
+	ctpLog.Warn("OnFrontDisconnected", "reason", reason)
+	mdctp.mu.Lock()
+	mdctp.connected = false
+	mdctp.mu.Unlock()
+	mdctp.recordFrontEvent(func(fs *FrontStats) {
+		fs.Disconnects++
+		fs.LastDisconnectReason = reason
+	})
+	if mdctp.OnFrontDisconnectedCallback != nil {
+		mdctp.OnFrontDisconnectedCallback(reason)
+	}
+	mdctp.failover(fmt.Sprintf("前置断开 0x%x", reason))
 }
 
 // OnHeartBeatWarning 当客户端与交易后台通信连接断开时，该方法被调用。
 func (mdctp *MdCtp) OnHeartBeatWarning(timelapse int) {
-	log.Printf("OnHeartBeatWarning: 心跳超时 %d 秒", timelapse)
+	ctpLog.Warn("OnHeartBeatWarning: 心跳超时", "seconds", timelapse)
+	mdctp.recordFrontEvent(func(fs *FrontStats) {
+		fs.HeartbeatWarnings++
+	})
+	if mdctp.OnHeartBeatWarningCallback != nil {
+		mdctp.OnHeartBeatWarningCallback(timelapse)
+	}
+	mdctp.failover(fmt.Sprintf("心跳超时 %d 秒", timelapse))
 }
 
 func (mdctp *MdCtp) OnRspUserLogin(userLogin *thost.CThostFtdcRspUserLoginField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
-	if rspInfo != nil && rspInfo.ErrorID != 0 {
-		log.Printf("OnRspUserLogin 失败: ErrorID=%d, ErrorMsg=%s", rspInfo.ErrorID, rspInfo.ErrorMsg)
-		mdctp.resultC <- int(rspInfo.ErrorID)
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("OnRspUserLogin 失败", "err", err, "request_id", nRequestID)
 	} else {
-		log.Printf("OnRspUserLogin 成功: UserID=%s, BrokerID=%s", userLogin.UserID.String(), userLogin.BrokerID.String())
-		mdctp.resultC <- 0
+		ctpLog.Info("OnRspUserLogin 成功", "user_id", userLogin.UserID.String(), "broker_id", userLogin.BrokerID.String(), "request_id", nRequestID)
+	}
+	if !mdctp.resolveRequest(nRequestID, err) {
+		ctpLog.Warn("OnRspUserLogin: 未找到等待中的请求", "request_id", nRequestID)
 	}
 }
 
 // OnRspUserLogout 登出请求响应
 func (mdctp *MdCtp) OnRspUserLogout(userLogout *thost.CThostFtdcUserLogoutField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
-	if rspInfo != nil && rspInfo.ErrorID != 0 {
-		log.Printf("OnRspUserLogout 失败: ErrorID=%d, ErrorMsg=%s", rspInfo.ErrorID, rspInfo.ErrorMsg)
-		mdctp.resultC <- int(rspInfo.ErrorID)
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("OnRspUserLogout 失败", "err", err, "request_id", nRequestID)
 	} else {
-		log.Printf("OnRspUserLogout 成功: UserID=%s", userLogout.UserID)
-		mdctp.resultC <- 0
+		ctpLog.Info("OnRspUserLogout 成功", "user_id", userLogout.UserID.String(), "request_id", nRequestID)
+	}
+	if !mdctp.resolveRequest(nRequestID, err) {
+		ctpLog.Warn("OnRspUserLogout: 未找到等待中的请求", "request_id", nRequestID)
 	}
 }
 
 // OnRspError 错误应答
 func (mdctp *MdCtp) OnRspError(rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
 	if rspInfo != nil {
-		log.Printf("OnRspError: ErrorID=%d, ErrorMsg=%s, RequestID=%d, IsLast=%v",
-			rspInfo.ErrorID, rspInfo.ErrorMsg, nRequestID, bIsLast)
+		ctpLog.Error("OnRspError", "error_id", rspInfo.ErrorID, "error_msg", rspInfo.ErrorMsg.String(),
+			"request_id", nRequestID, "is_last", bIsLast)
 	}
+	err := rspInfoError(rspInfo)
+	if err == nil {
+		err = fmt.Errorf("OnRspError")
+	}
+	mdctp.resolveRequest(nRequestID, err)
 }
 
 // OnRspSubMarketData 订阅行情应答
 func (mdctp *MdCtp) OnRspSubMarketData(specificInstrument *thost.CThostFtdcSpecificInstrumentField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
-	if rspInfo != nil && rspInfo.ErrorID != 0 {
-		log.Printf("订阅行情失败: InstrumentID=%s, ErrorID=%d, ErrorMsg=%s",
-			specificInstrument.InstrumentID, rspInfo.ErrorID, rspInfo.ErrorMsg)
-		mdctp.resultC <- int(rspInfo.ErrorID)
+	if specificInstrument == nil {
+		ctpLog.Warn("订阅行情应答缺少合约信息", "err", rspInfoError(rspInfo))
+		return
+	}
+	instrumentID := specificInstrument.InstrumentID.String()
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("订阅行情失败", "instrument", instrumentID, "err", err)
 	} else {
-		log.Printf("订阅行情成功: InstrumentID=%s", specificInstrument.InstrumentID)
-		mdctp.resultC <- 0
+		ctpLog.Info("订阅行情成功", "instrument", instrumentID)
 	}
+	mdctp.resolveInstrument("sub", instrumentID, err)
 }
 
 // OnRspUnSubMarketData 取消订阅行情应答
 func (mdctp *MdCtp) OnRspUnSubMarketData(specificInstrument *thost.CThostFtdcSpecificInstrumentField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
-	if rspInfo != nil && rspInfo.ErrorID != 0 {
-		log.Printf("取消订阅行情失败: InstrumentID=%s, ErrorID=%d, ErrorMsg=%s",
-			specificInstrument.InstrumentID, rspInfo.ErrorID, rspInfo.ErrorMsg)
-		mdctp.resultC <- int(rspInfo.ErrorID)
+	if specificInstrument == nil {
+		ctpLog.Warn("取消订阅行情应答缺少合约信息", "err", rspInfoError(rspInfo))
+		return
+	}
+	instrumentID := specificInstrument.InstrumentID.String()
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("取消订阅行情失败", "instrument", instrumentID, "err", err)
 	} else {
-		log.Printf("取消订阅行情成功: InstrumentID=%s", specificInstrument.InstrumentID)
-		mdctp.resultC <- 0
+		ctpLog.Info("取消订阅行情成功", "instrument", instrumentID)
+	}
+	mdctp.resolveInstrument("unsub", instrumentID, err)
+}
+
+// OnRtnDepthMarketData 深度行情通知
+func (mdctp *MdCtp) OnRtnDepthMarketData(depthMarketData *thost.CThostFtdcDepthMarketDataField) {
+	if mdctp.Recorder != nil {
+		mdctp.Recorder.Record(depthMarketData)
+	}
+	if mdctp.OnRtnDepthMarketDataCallback != nil {
+		mdctp.OnRtnDepthMarketDataCallback(depthMarketData)
 	}
 }
 
@@ -319,7 +638,7 @@ func ExampleMdCtpUsage() {
 
 	err := mdctp.Login()
 	if err != nil {
-		log.Printf("登录失败: %v", err)
+		ctpLog.Error("登录失败", "err", err)
 		return
 	}
 
@@ -327,11 +646,11 @@ func ExampleMdCtpUsage() {
 	instruments := []string{"rb2508", "TA509", "CU2412"}
 	err = mdctp.SubscribeMarketData(instruments...)
 	if err != nil {
-		log.Printf("订阅行情失败: %v\n", err)
+		ctpLog.Error("订阅行情失败", "err", err)
 	}
 
 	// 示例：打印订阅的合约
-	log.Printf("已订阅的合约: %v\n", instruments)
+	ctpLog.Info("已订阅的合约", "instruments", instruments)
 
 	// 程序结束时清理资源
 	defer mdctp.Release()
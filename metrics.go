@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram buckets in seconds
+var (
+	latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+	applyBuckets   = []float64{0.000001, 0.0000025, 0.000005, 0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.01}
+)
+
+// Reconstruction anomalies counted per book
+const (
+	anomalyCrossedBook       = iota // Best bid at or above best ask after an update
+	anomalyOffGridPrice             // Feed price not a multiple of the tick size
+	anomalyInvalidPrice             // Price that failed to parse
+	anomalyNegativeQty              // Level reported with negative volume
+	anomalyTickSizeReset            // Book cleared because the tick size changed
+	anomalySumMismatch              // Orders of a level not adding up to its L2 quantity
+	anomalyBadOrder                 // Order of zero or negative lots
+	anomalyQueueDisagreement        // Enhanced queue holding a different quantity than the plain one
+	anomalyOrderSequence            // Queue out of arrival order, or an order ID repeated
+	numAnomalies
+)
+
+var anomalyNames = [numAnomalies]string{
+	anomalyCrossedBook:       "crossed_book",
+	anomalyOffGridPrice:      "off_grid_price",
+	anomalyInvalidPrice:      "invalid_price",
+	anomalyNegativeQty:       "negative_qty",
+	anomalyTickSizeReset:     "tick_size_reset",
+	anomalySumMismatch:       "sum_mismatch",
+	anomalyBadOrder:          "bad_order",
+	anomalyQueueDisagreement: "queue_disagreement",
+	anomalyOrderSequence:     "order_sequence",
+}
+
+// anomalyCounts counts anomalies by kind. Written by the book's actor and
+// read by /metrics.
+type anomalyCounts [numAnomalies]atomic.Uint64
+
+func (c *anomalyCounts) add(kind int) {
+	c[kind].Add(1)
+}
+
+// histogram is a Prometheus histogram with fixed buckets that can be observed
+// and read concurrently
+type histogram struct {
+	bounds []float64       // Upper bounds in seconds
+	counts []atomic.Uint64 // Per bucket, the last one above all bounds
+	sum    atomic.Uint64   // float64 bits of the sum in seconds
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// write writes the samples of the histogram. labels is empty or a list of
+// name="value" pairs without braces.
+func (h *histogram) write(b *bytes.Buffer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, bound, cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, cumulative)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %g\n", name, labels, math.Float64frombits(h.sum.Load()))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, cumulative)
+}
+
+// bookStats are the health measures of one book, written by its actor and
+// read by /metrics
+type bookStats struct {
+	ticks      atomic.Uint64
+	bidLevels  atomic.Int64 // As of the last published snapshot
+	askLevels  atomic.Int64
+	bidOrders  atomic.Int64
+	askOrders  atomic.Int64
+	latency    *histogram // From a tick reaching the actor to the snapshot that includes it
+	applyDelta *histogram // Applying one L2 update
+}
+
+func newBookStats() *bookStats {
+	return &bookStats{latency: newHistogram(latencyBuckets), applyDelta: newHistogram(applyBuckets)}
+}
+
+// countOrders returns the number of orders queued on a side
+func countOrders(side *bookSide) int64 {
+	var n int
+	for i := range side.levels {
+		n += len(side.levels[i].queue.orders)
+	}
+	return int64(n)
+}
+
+// wsClientSet tracks the reply queues of the connected WebSocket clients
+type wsClientSet struct {
+	mu     sync.Mutex
+	queues map[chan map[string]any]struct{}
+}
+
+// wsClients are the connected WebSocket clients
+var wsClients = &wsClientSet{queues: make(map[chan map[string]any]struct{})}
+
+func (s *wsClientSet) add(queue chan map[string]any) {
+	s.mu.Lock()
+	s.queues[queue] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *wsClientSet) remove(queue chan map[string]any) {
+	s.mu.Lock()
+	delete(s.queues, queue)
+	s.mu.Unlock()
+}
+
+// depth returns the number of clients and the total and largest number of
+// messages waiting in their queues
+func (s *wsClientSet) depth() (clients, queued, largest int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for queue := range s.queues {
+		n := len(queue)
+		queued += n
+		largest = max(largest, n)
+	}
+	return len(s.queues), queued, largest
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricFamily writes the HELP and TYPE lines of a metric
+func metricFamily(b *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolGauge(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// metricsHandler serves engine health in the Prometheus text format
+func metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		books := appState.router.books()
+		slices.SortFunc(books, func(x, y *BookActor) int { return strings.Compare(x.QualifiedSymbol(), y.QualifiedSymbol()) })
+		labels := make([]string, len(books))
+		for i, book := range books {
+			labels[i] = fmt.Sprintf(`symbol="%s"`, labelEscaper.Replace(book.QualifiedSymbol()))
+		}
+
+		metricFamily(&b, "l3_ticks_total", "counter", "L2 updates applied per instrument.")
+		for i, book := range books {
+			fmt.Fprintf(&b, "l3_ticks_total{%s} %d\n", labels[i], book.stats.ticks.Load())
+		}
+		metricFamily(&b, "l3_tick_to_snapshot_seconds", "histogram", "Time from a tick reaching its book to the publication of the snapshot that includes it.")
+		for i, book := range books {
+			book.stats.latency.write(&b, "l3_tick_to_snapshot_seconds", labels[i])
+		}
+		metricFamily(&b, "l3_apply_delta_seconds", "histogram", "Time to apply one L2 update to the reconstructed book.")
+		for i, book := range books {
+			book.stats.applyDelta.write(&b, "l3_apply_delta_seconds", labels[i])
+		}
+		metricFamily(&b, "l3_book_levels", "gauge", "Price levels per book side.")
+		for i, book := range books {
+			fmt.Fprintf(&b, "l3_book_levels{%s,side=\"bid\"} %d\n", labels[i], book.stats.bidLevels.Load())
+			fmt.Fprintf(&b, "l3_book_levels{%s,side=\"ask\"} %d\n", labels[i], book.stats.askLevels.Load())
+		}
+		metricFamily(&b, "l3_book_orders", "gauge", "Reconstructed orders per book side.")
+		for i, book := range books {
+			fmt.Fprintf(&b, "l3_book_orders{%s,side=\"bid\"} %d\n", labels[i], book.stats.bidOrders.Load())
+			fmt.Fprintf(&b, "l3_book_orders{%s,side=\"ask\"} %d\n", labels[i], book.stats.askOrders.Load())
+		}
+		metricFamily(&b, "l3_anomalies_total", "counter", "Reconstruction anomalies by kind.")
+		for i, book := range books {
+			for kind, name := range anomalyNames {
+				fmt.Fprintf(&b, "l3_anomalies_total{%s,kind=\"%s\"} %d\n", labels[i], name, book.book.anomalies[kind].Load())
+			}
+		}
+
+		metricFamily(&b, "l3_book_resyncs_total", "counter", "Rebuilds from L2 after failed book checks or on request, by scope.")
+		for i, book := range books {
+			fmt.Fprintf(&b, "l3_book_resyncs_total{%s,scope=\"level\"} %d\n", labels[i], book.book.levelResyncs.Load())
+			fmt.Fprintf(&b, "l3_book_resyncs_total{%s,scope=\"book\"} %d\n", labels[i], book.book.bookResyncs.Load())
+		}
+
+		stats := appState.router.Stats()
+		metricFamily(&b, "l3_router_ticks_total", "counter", "Feed ticks by routing result.")
+		fmt.Fprintf(&b, "l3_router_ticks_total{result=\"routed\"} %d\n", stats.Routed)
+		fmt.Fprintf(&b, "l3_router_ticks_total{result=\"unknown\"} %d\n", stats.Unknown)
+		fmt.Fprintf(&b, "l3_router_ticks_total{result=\"misrouted\"} %d\n", stats.Misrouted)
+
+		clients, queued, largest := wsClients.depth()
+		metricFamily(&b, "l3_ws_clients", "gauge", "Connected WebSocket clients.")
+		fmt.Fprintf(&b, "l3_ws_clients %d\n", clients)
+		metricFamily(&b, "l3_ws_send_queue_depth", "gauge", "Messages waiting to be sent, summed over WebSocket clients.")
+		fmt.Fprintf(&b, "l3_ws_send_queue_depth %d\n", queued)
+		metricFamily(&b, "l3_ws_send_queue_max", "gauge", "Messages waiting to be sent to the most backed up WebSocket client.")
+		fmt.Fprintf(&b, "l3_ws_send_queue_max %d\n", largest)
+
+		appState.mu.RLock()
+		md := appState.md
+		appState.mu.RUnlock()
+		if md != nil {
+			connected, loggedIn := md.ConnectionState()
+			metricFamily(&b, "l3_ctp_connected", "gauge", "Whether the CTP market data front is connected.")
+			fmt.Fprintf(&b, "l3_ctp_connected %d\n", boolGauge(connected))
+			metricFamily(&b, "l3_ctp_logged_in", "gauge", "Whether the CTP market data session is logged in.")
+			fmt.Fprintf(&b, "l3_ctp_logged_in %d\n", boolGauge(loggedIn))
+
+			fronts := md.FrontStats()
+			metricFamily(&b, "l3_ctp_front_active", "gauge", "Whether a CTP front is the one in use.")
+			for _, fs := range fronts {
+				fmt.Fprintf(&b, "l3_ctp_front_active{front=\"%s\"} %d\n", labelEscaper.Replace(fs.Addr), boolGauge(fs.Active))
+			}
+			metricFamily(&b, "l3_ctp_front_disconnects_total", "counter", "Disconnects per CTP front.")
+			for _, fs := range fronts {
+				fmt.Fprintf(&b, "l3_ctp_front_disconnects_total{front=\"%s\"} %d\n", labelEscaper.Replace(fs.Addr), fs.Disconnects)
+			}
+			metricFamily(&b, "l3_ctp_front_failovers_total", "counter", "Failovers away from each CTP front.")
+			for _, fs := range fronts {
+				fmt.Fprintf(&b, "l3_ctp_front_failovers_total{front=\"%s\"} %d\n", labelEscaper.Replace(fs.Addr), fs.Failovers)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(b.Bytes())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import "fmt"
+
+const (
+	imbalanceDepth    = 5    // Levels covered by the depth imbalances
+	metricsSeriesSize = 4096 // Samples kept per book, one per update
+)
+
+// BookMetrics are microstructure measures of the book at one point in time
+type BookMetrics struct {
+	Timestamp   int64                   `json:"timestamp"`    // Unix milliseconds
+	Mid         float64                 `json:"mid"`          // 0 while a side is empty
+	Microprice  float64                 `json:"microprice"`   // Best prices weighted by the opposite side's size
+	WeightedMid float64                 `json:"weighted_mid"` // Mid of the size-weighted bid and ask prices of the best 5 levels
+	SpreadTicks int64                   `json:"spread_ticks"`
+	Imbalance   [imbalanceDepth]float64 `json:"imbalance"` // (bid-ask)/(bid+ask) volume over the best 1..5 levels
+	OFI         int64                   `json:"ofi"`       // Order-flow imbalance of the last update, in lots
+	Bid         SideFlow                `json:"bid_flow"`
+	Ask         SideFlow                `json:"ask_flow"`
+}
+
+// SideFlow are the recent order flow rates of one side, inferred by the queues
+type SideFlow struct {
+	Depletion     float64 `json:"depletion"`     // Lots per second filled or cancelled
+	Replenishment float64 `json:"replenishment"` // Lots per second added
+	CancelToAdd   float64 `json:"cancel_to_add"` // Lots cancelled per lot added
+}
+
+// sideFlowSums are decaying sums of the volume added and removed on a side
+type sideFlowSums struct {
+	added     float64
+	filled    float64
+	cancelled float64
+	last      int64 // Unix milliseconds
+}
+
+func (s *sideFlowSums) decay(now int64) {
+	f := decayFactor(s.last, now)
+	s.added *= f
+	s.filled *= f
+	s.cancelled *= f
+	s.last = now
+}
+
+// orderFlow collects the volume the queues of a book infer as added, filled
+// and cancelled. Volume leaving from the front of a queue counts as filled,
+// anything else as cancelled, as for fill estimates.
+type orderFlow struct {
+	bid, ask sideFlowSums
+	since    int64 // Unix milliseconds of the first update
+}
+
+func (f *orderFlow) side(bid bool) *sideFlowSums {
+	if bid {
+		return &f.bid
+	}
+	return &f.ask
+}
+
+// added records qty lots joining a queue
+func (f *orderFlow) added(bid bool, qty, now int64) {
+	if f == nil {
+		return
+	}
+	if f.since == 0 {
+		f.since = now
+	}
+	s := f.side(bid)
+	s.decay(now)
+	s.added += float64(qty)
+}
+
+// removed records qty lots leaving a queue under rule
+func (f *orderFlow) removed(bid bool, qty int64, rule string, now int64) {
+	if f == nil {
+		return
+	}
+	if f.since == 0 {
+		f.since = now
+	}
+	s := f.side(bid)
+	s.decay(now)
+	if frontRule(rule) {
+		s.filled += float64(qty)
+	} else {
+		s.cancelled += float64(qty)
+	}
+}
+
+// rates returns the flow rates of a side at now
+func (f *orderFlow) rates(bid bool, now int64) SideFlow {
+	s := f.side(bid)
+	if f.since == 0 {
+		return SideFlow{}
+	}
+	k := decayFactor(s.last, now) / rateSeconds(f.since, now)
+	flow := SideFlow{
+		Depletion:     (s.filled + s.cancelled) * k,
+		Replenishment: s.added * k,
+	}
+	if s.added > 0 {
+		flow.CancelToAdd = s.cancelled / s.added
+	}
+	return flow
+}
+
+// topOfBook is the best level of each side, ok false while a side is empty
+type topOfBook struct {
+	bidTick, bidQty int64
+	askTick, askQty int64
+	bidOK, askOK    bool
+}
+
+func (ob *L3OrderBook) topOfBook() topOfBook {
+	var t topOfBook
+	if len(ob.bids.levels) > 0 {
+		best := &ob.bids.levels[0]
+		t.bidTick, t.bidQty, t.bidOK = best.tick, best.queue.sum(), true
+	}
+	if len(ob.asks.levels) > 0 {
+		best := &ob.asks.levels[0]
+		t.askTick, t.askQty, t.askOK = best.tick, best.queue.sum(), true
+	}
+	return t
+}
+
+// orderFlowImbalance is the OFI of Cont, Kukanov and Stoikov between two
+// states of the best levels: size arriving at or improving the best bid and
+// leaving or backing off the best ask counts positive.
+func orderFlowImbalance(prev, cur topOfBook) int64 {
+	var ofi int64
+	if prev.bidOK && cur.bidOK {
+		if cur.bidTick >= prev.bidTick {
+			ofi += cur.bidQty
+		}
+		if cur.bidTick <= prev.bidTick {
+			ofi -= prev.bidQty
+		}
+	}
+	if prev.askOK && cur.askOK {
+		if cur.askTick <= prev.askTick {
+			ofi -= cur.askQty
+		}
+		if cur.askTick >= prev.askTick {
+			ofi += prev.askQty
+		}
+	}
+	return ofi
+}
+
+// metricsSeries keeps the recent metrics of a book, one sample per update
+type metricsSeries struct {
+	samples []BookMetrics // Ring buffer, allocated on first use
+	next    int           // Slot of the next sample
+	full    bool          // Whether the ring has wrapped
+	prev    topOfBook     // Best levels after the previous update
+	ofi     int64         // OFI of the last update
+	flow    orderFlow
+}
+
+func (s *metricsSeries) add(m BookMetrics) {
+	if s.samples == nil {
+		s.samples = make([]BookMetrics, metricsSeriesSize)
+	}
+	s.samples[s.next] = m
+	s.next++
+	if s.next == len(s.samples) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// since returns up to limit of the latest samples taken at or after from,
+// oldest first. limit <= 0 returns all of them.
+func (s *metricsSeries) since(from int64, limit int) []BookMetrics {
+	ordered := s.samples[:s.next]
+	if s.full {
+		ordered = append(append(make([]BookMetrics, 0, len(s.samples)), s.samples[s.next:]...), s.samples[:s.next]...)
+	}
+	start := len(ordered)
+	for start > 0 && ordered[start-1].Timestamp >= from {
+		start--
+	}
+	if limit > 0 && len(ordered)-start > limit {
+		start = len(ordered) - limit
+	}
+	return append([]BookMetrics(nil), ordered[start:]...)
+}
+
+// recordMetrics samples the metrics after an update
+func (ob *L3OrderBook) recordMetrics() {
+	top := ob.topOfBook()
+	ob.metrics.ofi = orderFlowImbalance(ob.metrics.prev, top)
+	ob.metrics.prev = top
+	ob.metrics.add(ob.measure(top))
+}
+
+// Metrics returns the current metrics of the book
+func (ob *L3OrderBook) Metrics() BookMetrics {
+	return ob.measure(ob.topOfBook())
+}
+
+// MetricsSeries returns recorded metrics, see metricsSeries.since
+func (ob *L3OrderBook) MetricsSeries(from int64, limit int) []BookMetrics {
+	return ob.metrics.since(from, limit)
+}
+
+// measure computes the metrics of the book with best levels top
+func (ob *L3OrderBook) measure(top topOfBook) BookMetrics {
+	now := ob.queues.clock()
+	m := BookMetrics{
+		Timestamp: now,
+		OFI:       ob.metrics.ofi,
+		Bid:       ob.metrics.flow.rates(true, now),
+		Ask:       ob.metrics.flow.rates(false, now),
+	}
+
+	var bidVol, askVol, bidNotional, askNotional float64
+	bids, asks := ob.bids.top(imbalanceDepth), ob.asks.top(imbalanceDepth)
+	for i := range m.Imbalance {
+		if i < len(bids) {
+			qty := float64(bids[i].queue.sum())
+			bidVol += qty
+			bidNotional += qty * float64(bids[i].tick)
+		}
+		if i < len(asks) {
+			qty := float64(asks[i].queue.sum())
+			askVol += qty
+			askNotional += qty * float64(asks[i].tick)
+		}
+		if bidVol+askVol > 0 {
+			m.Imbalance[i] = (bidVol - askVol) / (bidVol + askVol)
+		}
+	}
+
+	if !top.bidOK || !top.askOK {
+		return m
+	}
+	tick := ob.scale.sizeF
+	m.SpreadTicks = top.askTick - top.bidTick
+	m.Mid = float64(top.bidTick+top.askTick) / 2 * tick
+	if top.bidQty+top.askQty > 0 {
+		m.Microprice = (float64(top.bidTick)*float64(top.askQty) + float64(top.askTick)*float64(top.bidQty)) /
+			float64(top.bidQty+top.askQty) * tick
+	}
+	if bidVol > 0 && askVol > 0 {
+		m.WeightedMid = (bidNotional/bidVol + askNotional/askVol) / 2 * tick
+	}
+	return m
+}
+
+// bookMetrics returns the current metrics of the book of symbol and, when
+// series is set, its recorded samples since from
+func bookMetrics(symbol string, series bool, from int64, limit int) (BookMetrics, []BookMetrics, error) {
+	_, instrumentID := parseSymbol(symbol)
+	book := appState.router.book(instrumentID)
+	if book == nil {
+		return BookMetrics{}, nil, fmt.Errorf("no book for %s", symbol)
+	}
+	var current BookMetrics
+	var samples []BookMetrics
+	ok := book.Do(func(ob *L3OrderBook) {
+		current = ob.Metrics()
+		if series {
+			samples = ob.MetricsSeries(from, limit)
+		}
+	})
+	if !ok {
+		return BookMetrics{}, nil, fmt.Errorf("book %s stopped", book.Symbol())
+	}
+	return current, samples, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shopspring/decimal"
+)
+
+// Order lifecycle event types inferred from L2 changes
+const (
+	EventAdd          = "ADD"
+	EventPartialFill  = "PARTIAL_FILL"
+	EventFill         = "FILL"
+	EventCancel       = "CANCEL"
+	EventLevelCleared = "LEVEL_CLEARED"
+)
+
+// Inference rules behind an event
+const (
+	RuleVolumeIncrease = "volume_increase" // Level grew, a new order joined the back of the queue
+	RuleExactMatch     = "exact_match"     // Decrease equal to one order's size, taken as its cancellation
+	RuleLargestFirst   = "largest_first"   // Large decrease, taken from the largest orders first
+	RuleFIFO           = "fifo"            // Small decrease, filled from the front of the queue
+	RuleZeroQty        = "zero_qty"        // Level reported with zero volume
+	RulePriceCrossed   = "price_crossed"   // Level ranked ahead of the new best price
+	RuleBookReset      = "book_reset"      // Book cleared by a snapshot or tick size change
+	RuleTradeAnchor    = "trade_anchor"    // Our own trade, confirming everything ahead of it is gone
+	RuleResync         = "resync"          // Level rebuilt from L2 after failing the book checks
+)
+
+// OrderEvent is an inferred change to one synthetic order
+type OrderEvent struct {
+	Seq       uint64          `json:"seq"`      // Book-wide event sequence
+	Type      string          `json:"type"`     // ADD, PARTIAL_FILL, FILL, CANCEL or LEVEL_CLEARED
+	ID        uint64          `json:"id"`       // Synthetic order ID, matches the level's order_ids and order_details
+	OrderID   string          `json:"order_id"` // symbol:side:price:id
+	Symbol    string          `json:"symbol"`
+	Side      string          `json:"side"` // bid or ask
+	Price     decimal.Decimal `json:"price"`
+	Qty       int64           `json:"qty"`       // Quantity added or removed by the event
+	Remaining int64           `json:"remaining"` // Order quantity after the event
+	Timestamp int64           `json:"timestamp"` // Unix milliseconds
+	Rule      string          `json:"rule"`      // Inference rule that produced the event
+}
+
+// rawOrderEvent is the compact form queues record on the feed path; IDs and
+// prices are only formatted when someone consumes the events
+type rawOrderEvent struct {
+	kind      string
+	rule      string
+	bid       bool
+	tick      int64
+	id        uint64
+	qty       int64
+	remaining int64
+	ts        int64
+}
+
+// orderEventLog buffers the events of a book between flushes. It is owned by
+// the book actor and records nothing while disabled.
+type orderEventLog struct {
+	enabled bool
+	events  []rawOrderEvent
+	seq     uint64
+}
+
+func (l *orderEventLog) add(ev rawOrderEvent) {
+	if l != nil && l.enabled {
+		l.events = append(l.events, ev)
+	}
+}
+
+// drain formats the buffered events of symbol and resets the buffer
+func (l *orderEventLog) drain(symbol string, scale tickScale) []OrderEvent {
+	if len(l.events) == 0 {
+		return nil
+	}
+	out := make([]OrderEvent, len(l.events))
+	for i, ev := range l.events {
+		l.seq++
+		side := "ask"
+		if ev.bid {
+			side = "bid"
+		}
+		price := scale.price(ev.tick)
+		out[i] = OrderEvent{
+			Seq:       l.seq,
+			Type:      ev.kind,
+			ID:        ev.id,
+			OrderID:   symbol + ":" + side + ":" + price.String() + ":" + strconv.FormatUint(ev.id, 10),
+			Symbol:    symbol,
+			Side:      side,
+			Price:     price,
+			Qty:       ev.qty,
+			Remaining: ev.remaining,
+			Timestamp: ev.ts,
+			Rule:      ev.rule,
+		}
+	}
+	l.events = l.events[:0]
+	return out
+}
+
+// OrderEventHub fans order events out to WebSocket subscribers and the
+// optional event log. Books only record events while the hub is active.
+type OrderEventHub struct {
+	mu       sync.Mutex
+	subs     map[chan []OrderEvent]struct{}
+	recorder *OrderEventRecorder
+	active   atomic.Bool
+	dropped  atomic.Uint64 // Batches dropped for slow subscribers
+}
+
+// orderEvents is the process-wide event hub
+var orderEvents = NewOrderEventHub()
+
+// NewOrderEventHub creates an empty hub
+func NewOrderEventHub() *OrderEventHub {
+	return &OrderEventHub{subs: make(map[chan []OrderEvent]struct{})}
+}
+
+// Active reports whether anyone consumes events
+func (h *OrderEventHub) Active() bool {
+	return h.active.Load()
+}
+
+func (h *OrderEventHub) updateActive() {
+	h.active.Store(len(h.subs) > 0 || h.recorder != nil)
+}
+
+// Subscribe returns a channel of event batches and a function that ends the
+// subscription and closes the channel. Batches are dropped, not queued, when
+// the subscriber falls more than buffer batches behind.
+func (h *OrderEventHub) Subscribe(buffer int) (<-chan []OrderEvent, func()) {
+	ch := make(chan []OrderEvent, buffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.updateActive()
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.updateActive()
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// SetRecorder writes all events to r, nil stops recording
+func (h *OrderEventHub) SetRecorder(r *OrderEventRecorder) {
+	h.mu.Lock()
+	h.recorder = r
+	h.updateActive()
+	h.mu.Unlock()
+}
+
+// Publish delivers a batch to the recorder and all subscribers without blocking
+func (h *OrderEventHub) Publish(events []OrderEvent) {
+	if len(events) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.recorder != nil {
+		h.recorder.Record(events)
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- events:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// OrderEventRecorder appends order events to a file as JSON lines
+type OrderEventRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+// NewOrderEventRecorder creates a recorder appending to path
+func NewOrderEventRecorder(path string) (*OrderEventRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log %s: %w", path, err)
+	}
+	w := bufio.NewWriter(file)
+	return &OrderEventRecorder{file: file, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Record writes a batch of events
+func (r *OrderEventRecorder) Record(events []OrderEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range events {
+		if err := r.enc.Encode(&events[i]); err != nil {
+			engineLog.Error("record order event failed", "err", err)
+			return
+		}
+	}
+}
+
+// Flush writes buffered events to the file
+func (r *OrderEventRecorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// Close flushes and closes the file
+func (r *OrderEventRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Own order states
+const (
+	OwnPending   = "pending"   // Registered, its volume has not shown up at the level yet
+	OwnQueued    = "queued"    // Placed in the reconstructed queue
+	OwnFilled    = "filled"    // Estimated fully filled
+	OwnCancelled = "cancelled" // Cancelled by the client
+)
+
+// Sources of own orders
+const (
+	OwnSourceAPI    = "api"    // Registered by a client, fills are estimated
+	OwnSourceTrader = "trader" // Reported by the CTP trader API, fills come from our trades
+)
+
+// defaultFillHorizon is the window fill_prob refers to when the client sets none
+const defaultFillHorizon = 60 * time.Second
+
+// ErrUnknownOwnOrder is returned for IDs no book is tracking
+var ErrUnknownOwnOrder = errors.New("unknown own order")
+
+// OwnOrderRequest registers one of our resting orders
+type OwnOrderRequest struct {
+	Symbol     string  `json:"symbol"` // Defaults to the active symbol
+	Side       string  `json:"side"`   // bid/buy or ask/sell
+	Price      string  `json:"price"`
+	Qty        int64   `json:"qty"`                   // Lots
+	Filled     int64   `json:"filled,omitempty"`      // Lots already traded
+	SubmitTime string  `json:"submit_time,omitempty"` // Any format of parseHistoryTime, defaults to now
+	Ref        string  `json:"ref,omitempty"`         // Client reference, e.g. the CTP OrderRef
+	Horizon    float64 `json:"horizon,omitempty"`     // Seconds for fill_prob, defaults to 60
+
+	source string // OwnSourceTrader for orders from the trader API
+	id     uint64 // Preassigned ID, taken from orderIDs when 0
+}
+
+// OwnOrderStatus is the estimated queue position of one of our orders
+type OwnOrderStatus struct {
+	ID          uint64          `json:"id"`
+	Ref         string          `json:"ref,omitempty"`
+	Symbol      string          `json:"symbol"`
+	Side        string          `json:"side"` // bid or ask
+	Price       decimal.Decimal `json:"price"`
+	Qty         int64           `json:"qty"`
+	Filled      int64           `json:"filled"`
+	State       string          `json:"state"`
+	Source      string          `json:"source"`         // api or trader
+	Rule        string          `json:"rule,omitempty"` // Inference rule behind the last fill
+	Position    int             `json:"position"`       // Orders ahead, 0 at the front
+	VolumeAhead int64           `json:"volume_ahead"`
+	LevelQty    int64           `json:"level_qty"`
+	DrainRate   float64         `json:"drain_rate"`   // Lots per second removed ahead of us since queued
+	TimeToFill  float64         `json:"time_to_fill"` // Estimated seconds to a full fill, -1 when unknown
+	FillProb    float64         `json:"fill_prob"`    // Probability of a full fill within the horizon
+	Horizon     float64         `json:"horizon"`      // Seconds
+	SubmitTime  int64           `json:"submit_time"`  // Unix milliseconds
+	UpdatedAt   int64           `json:"updated_at"`
+}
+
+// ownOrder is the tracking state of one of our orders
+type ownOrder struct {
+	status    OwnOrderStatus
+	bid       bool
+	anchored  bool  // Fills are confirmed by the exchange rather than inferred
+	queuedAt  int64 // When the order was placed in the queue
+	lastAhead int64
+	drained   int64 // Volume removed ahead of us since queued
+	dirty     bool  // Status changed since the last refresh
+}
+
+// OwnOrderTracker follows our orders through the queues of one book. It is
+// owned by the book's actor goroutine.
+type OwnOrderTracker struct {
+	orders map[uint64]*ownOrder
+}
+
+// filled records qty of order id as traded under rule
+func (t *OwnOrderTracker) filled(id uint64, qty int64, rule string) {
+	o := t.orders[id]
+	if o == nil {
+		return
+	}
+	o.status.Filled = min64(o.status.Filled+qty, o.status.Qty)
+	o.status.Rule = rule
+	if o.status.Filled == o.status.Qty {
+		o.status.State = OwnFilled
+	}
+	o.dirty = true
+}
+
+// cleared records that the level of order id went away under rule
+func (t *OwnOrderTracker) cleared(id uint64, rule string) {
+	o := t.orders[id]
+	if o == nil {
+		return
+	}
+	o.status.Rule = rule
+	if rule == RuleBookReset || rule == RuleResync || o.anchored {
+		// The queue is rebuilt from scratch, or the exchange has not reported
+		// a trade yet; claim the volume again
+		o.status.State = OwnPending
+	} else {
+		// The level emptied or the price traded through it
+		o.status.Filled = o.status.Qty
+		o.status.State = OwnFilled
+	}
+	o.dirty = true
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// parseOwnSide normalizes the side of an order request
+func parseOwnSide(side string) (bid bool, err error) {
+	switch strings.ToLower(side) {
+	case "bid", "buy", "b":
+		return true, nil
+	case "ask", "sell", "s":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid side %q: use bid/buy or ask/sell", side)
+}
+
+// RegisterOwnOrder starts tracking one of our orders and places it in the
+// queue when its volume is already visible
+func (ob *L3OrderBook) RegisterOwnOrder(req OwnOrderRequest) (OwnOrderStatus, error) {
+	if !ob.useEnhancedMode {
+		return OwnOrderStatus{}, errors.New("own orders require enhanced queue mode")
+	}
+	if req.Qty <= 0 || req.Filled < 0 || req.Filled >= req.Qty {
+		return OwnOrderStatus{}, fmt.Errorf("invalid qty %d with %d filled", req.Qty, req.Filled)
+	}
+	bid, err := parseOwnSide(req.Side)
+	if err != nil {
+		return OwnOrderStatus{}, err
+	}
+	tick, err := ob.scale.fromString(req.Price)
+	if err != nil {
+		return OwnOrderStatus{}, fmt.Errorf("invalid price %q: %w", req.Price, err)
+	}
+	submitted := ob.queues.clock()
+	if req.SubmitTime != "" {
+		t, err := parseHistoryTime(req.SubmitTime)
+		if err != nil {
+			return OwnOrderStatus{}, err
+		}
+		submitted = t.UnixMilli()
+	}
+	horizon := req.Horizon
+	if horizon <= 0 {
+		horizon = defaultFillHorizon.Seconds()
+	}
+
+	side := "ask"
+	if bid {
+		side = "bid"
+	}
+	source := req.source
+	if source == "" {
+		source = OwnSourceAPI
+	}
+	id := req.id
+	if id == 0 {
+		id = ob.queues.ids.Next()
+	}
+	o := &ownOrder{
+		status: OwnOrderStatus{
+			ID:         id,
+			Ref:        req.Ref,
+			Symbol:     ob.symbol,
+			Side:       side,
+			Price:      ob.scale.price(tick),
+			Qty:        req.Qty,
+			Filled:     req.Filled,
+			State:      OwnPending,
+			Source:     source,
+			TimeToFill: -1,
+			Horizon:    horizon,
+			SubmitTime: submitted,
+		},
+		bid:      bid,
+		anchored: source == OwnSourceTrader,
+	}
+	if ob.own.orders == nil {
+		ob.own.orders = make(map[uint64]*ownOrder)
+	}
+	ob.own.orders[o.status.ID] = o
+
+	now := ob.queues.clock()
+	ob.placeOwnOrder(o, now)
+	ob.measureOwnOrder(o, now)
+	o.status.UpdatedAt = now
+	return o.status, nil
+}
+
+// CancelOwnOrder stops tracking order id. Its volume stays in the queue as an
+// ordinary order until the cancellation shows up in the feed.
+func (ob *L3OrderBook) CancelOwnOrder(id uint64) (OwnOrderStatus, bool) {
+	o := ob.own.orders[id]
+	if o == nil {
+		return OwnOrderStatus{}, false
+	}
+	if o.status.State == OwnQueued {
+		if level, ok := ob.ownSide(o).get(ob.ownTick(o)); ok && level.enhanced != nil {
+			level.enhanced.releaseOwn(id)
+		}
+	}
+	o.status.State = OwnCancelled
+	o.status.UpdatedAt = ob.queues.clock()
+	o.dirty = true
+	return o.status, true
+}
+
+// AnchorOwnFill applies the cumulative traded volume the exchange reported
+// for order id. A queued order takes the difference as a confirmed fill that
+// also clears everything ahead of it.
+func (ob *L3OrderBook) AnchorOwnFill(id uint64, traded int64) bool {
+	o := ob.own.orders[id]
+	if o == nil {
+		return false
+	}
+	delta := traded - o.status.Filled
+	if delta <= 0 {
+		return true
+	}
+
+	queued := false
+	if o.status.State == OwnQueued {
+		if level, ok := ob.ownSide(o).get(ob.ownTick(o)); ok && level.enhanced != nil {
+			queued = level.enhanced.anchorOwn(id, delta)
+		}
+	}
+	if !queued {
+		// Not in the queue, so there is nothing ahead to correct
+		ob.own.filled(id, delta, RuleTradeAnchor)
+	}
+	return true
+}
+
+// OwnOrders returns the status of all tracked orders ordered by ID
+func (ob *L3OrderBook) OwnOrders() []OwnOrderStatus {
+	out := make([]OwnOrderStatus, 0, len(ob.own.orders))
+	for _, o := range ob.own.orders {
+		out = append(out, o.status)
+	}
+	slices.SortFunc(out, func(a, b OwnOrderStatus) int { return cmp.Compare(a.ID, b.ID) })
+	return out
+}
+
+// refreshOwnOrders places pending orders, re-estimates queued ones and
+// returns the statuses that changed. Filled and cancelled orders are reported
+// once and then dropped.
+func (ob *L3OrderBook) refreshOwnOrders() []OwnOrderStatus {
+	if len(ob.own.orders) == 0 {
+		return nil
+	}
+	now := ob.queues.clock()
+	var changed []OwnOrderStatus
+	for id, o := range ob.own.orders {
+		if o.status.State == OwnPending {
+			ob.placeOwnOrder(o, now)
+		}
+		if o.status.State == OwnQueued {
+			ob.measureOwnOrder(o, now)
+		}
+		if !o.dirty {
+			continue
+		}
+		o.dirty = false
+		o.status.UpdatedAt = now
+		changed = append(changed, o.status)
+		if o.status.State == OwnFilled || o.status.State == OwnCancelled {
+			delete(ob.own.orders, id)
+		}
+	}
+	slices.SortFunc(changed, func(a, b OwnOrderStatus) int { return cmp.Compare(a.ID, b.ID) })
+	return changed
+}
+
+func (ob *L3OrderBook) ownSide(o *ownOrder) *bookSide {
+	if o.bid {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// ownTick returns the tick index of an order's price. It is derived from the
+// price each time since a tick size change rescales the book.
+func (ob *L3OrderBook) ownTick(o *ownOrder) int64 {
+	tick, _ := ob.scale.fromString(o.status.Price.String())
+	return tick
+}
+
+// placeOwnOrder claims the volume of a pending order at its level
+func (ob *L3OrderBook) placeOwnOrder(o *ownOrder, now int64) {
+	level, ok := ob.ownSide(o).get(ob.ownTick(o))
+	if !ok || level.enhanced == nil {
+		return
+	}
+	remaining := o.status.Qty - o.status.Filled
+	if !level.enhanced.claimOwn(o.status.ID, remaining, o.status.SubmitTime, o.anchored) {
+		return
+	}
+	o.status.State = OwnQueued
+	o.queuedAt = now
+	o.drained = 0
+	o.lastAhead = -1
+	o.dirty = true
+}
+
+// measureOwnOrder updates the position of a queued order and its fill estimate
+func (ob *L3OrderBook) measureOwnOrder(o *ownOrder, now int64) {
+	level, ok := ob.ownSide(o).get(ob.ownTick(o))
+	if !ok || level.enhanced == nil {
+		return
+	}
+	position, ahead, qty, ok := level.enhanced.ownPosition(o.status.ID)
+	if !ok {
+		return
+	}
+
+	if o.lastAhead >= 0 && ahead < o.lastAhead {
+		o.drained += o.lastAhead - ahead
+	}
+	levelQty := level.enhanced.GetTotalQty()
+	if position != o.status.Position || ahead != o.status.VolumeAhead || levelQty != o.status.LevelQty || o.lastAhead < 0 {
+		o.dirty = true
+	}
+	o.lastAhead = ahead
+	o.status.Position = position
+	o.status.VolumeAhead = ahead
+	o.status.LevelQty = levelQty
+
+	elapsed := float64(now-o.queuedAt) / 1000
+	o.status.DrainRate = 0
+	if elapsed > 0 {
+		o.status.DrainRate = float64(o.drained) / elapsed
+	}
+	// Same model as the level's fill_estimate, with our place in the queue
+	fill, cancel := level.enhanced.depletion.rates(now)
+	o.status.TimeToFill, o.status.FillProb = estimateFill(ahead, qty, levelQty, fill, cancel, o.status.Horizon)
+}
+
+// fillProbability is the chance that at least need lots are removed ahead of
+// and from an order, when removals follow a Poisson process with the given
+// mean over the horizon
+func fillProbability(need int64, mean float64) float64 {
+	if need <= 0 {
+		return 1
+	}
+	if mean <= 0 {
+		return 0
+	}
+	if mean > 200 {
+		// Normal approximation with continuity correction
+		z := (float64(need) - 0.5 - mean) / math.Sqrt(mean)
+		return 0.5 * math.Erfc(z/math.Sqrt2)
+	}
+	// 1 - P(N < need), summing terms until they no longer matter
+	p := math.Exp(-mean)
+	cdf := p
+	for k := int64(1); k < need; k++ {
+		p *= mean / float64(k)
+		cdf += p
+		if float64(k) > mean && p < 1e-12 {
+			break
+		}
+	}
+	return math.Max(0, 1-cdf)
+}
+
+// OwnOrderHub fans own order status updates out to subscribers
+type OwnOrderHub struct {
+	mu      sync.Mutex
+	subs    map[chan []OwnOrderStatus]struct{}
+	dropped atomic.Uint64 // Batches dropped for slow subscribers
+}
+
+// ownOrderUpdates is the process-wide own order hub
+var ownOrderUpdates = &OwnOrderHub{subs: make(map[chan []OwnOrderStatus]struct{})}
+
+// Subscribe returns a channel of status batches and a function that ends the
+// subscription and closes the channel
+func (h *OwnOrderHub) Subscribe(buffer int) (<-chan []OwnOrderStatus, func()) {
+	ch := make(chan []OwnOrderStatus, buffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish delivers a batch to all subscribers without blocking
+func (h *OwnOrderHub) Publish(statuses []OwnOrderStatus) {
+	if len(statuses) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- statuses:
+		default:
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// registerOwnOrder registers req with the book of its symbol
+func registerOwnOrder(req OwnOrderRequest) (OwnOrderStatus, error) {
+	book := appState.book.Load()
+	if req.Symbol != "" {
+		_, instrumentID := parseSymbol(req.Symbol)
+		if book = appState.router.book(instrumentID); book == nil {
+			return OwnOrderStatus{}, fmt.Errorf("no book for %s", req.Symbol)
+		}
+	}
+
+	var status OwnOrderStatus
+	var err error
+	if !book.Do(func(ob *L3OrderBook) { status, err = ob.RegisterOwnOrder(req) }) {
+		return OwnOrderStatus{}, fmt.Errorf("book %s stopped", book.Symbol())
+	}
+	return status, err
+}
+
+// cancelOwnOrder stops tracking order id in whichever book holds it
+func cancelOwnOrder(id uint64) (OwnOrderStatus, error) {
+	for _, book := range appState.router.books() {
+		var status OwnOrderStatus
+		var found bool
+		book.Do(func(ob *L3OrderBook) { status, found = ob.CancelOwnOrder(id) })
+		if found {
+			return status, nil
+		}
+	}
+	return OwnOrderStatus{}, fmt.Errorf("%w %d", ErrUnknownOwnOrder, id)
+}
+
+// listOwnOrders returns the tracked orders of all books
+func listOwnOrders() []OwnOrderStatus {
+	out := []OwnOrderStatus{}
+	for _, book := range appState.router.books() {
+		book.Do(func(ob *L3OrderBook) { out = append(out, ob.OwnOrders()...) })
+	}
+	return out
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+// TestOwnOrderFillEstimate checks that our order gets the estimate the level
+// publishes for the same place in the queue
+func TestOwnOrderFillEstimate(t *testing.T) {
+	ob := newTestBook(t)
+	now := int64(1000)
+	ob.SetClock(func() int64 { return now })
+	ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: 20}})
+	status, err := ob.RegisterOwnOrder(OwnOrderRequest{Symbol: "test", Side: "bid", Price: "100", Qty: 5, SubmitTime: "0"})
+	if err != nil || status.State != OwnQueued {
+		t.Fatalf("register: %v, state %s", err, status.State)
+	}
+	for _, qty := range []int64{18, 17, 15} { // Small decreases fill from the front
+		now += 1000
+		ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: qty}})
+	}
+	ob.refreshOwnOrders()
+	own := ob.OwnOrders()[0]
+
+	level, _ := ob.bids.get(100)
+	est := level.enhanced.EstimateFill(own.Horizon)
+	for i, order := range level.enhanced.orders {
+		if order.ID != own.ID {
+			continue
+		}
+		if own.TimeToFill <= 0 || own.TimeToFill != est.TimeToFill[i] || own.FillProb != est.FillProb[i] {
+			t.Errorf("own estimate %.3fs %.3f, level has %.3fs %.3f", own.TimeToFill, own.FillProb, est.TimeToFill[i], est.FillProb[i])
+		}
+		return
+	}
+	t.Fatal("own order not in the queue")
+}
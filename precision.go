@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"net/http"
 	"strconv"
@@ -31,31 +30,73 @@ type Filter struct {
 
 // PrecisionInfo holds precision data for a symbol
 type PrecisionInfo struct {
-	Symbol         string `json:"symbol"`
-	PricePrecision int    `json:"price_precision"`
-	QtyPrecision   int    `json:"qty_precision"`
-	TickSize       string `json:"tick_size"`
-	StepSize       string `json:"step_size"`
-	LastUpdated    int64  `json:"last_updated"`
+	Symbol         string   `json:"symbol"`
+	PricePrecision int      `json:"price_precision"`
+	QtyPrecision   int      `json:"qty_precision"`
+	TickSize       string   `json:"tick_size"`
+	StepSize       string   `json:"step_size"`
+	LastUpdated    int64    `json:"last_updated"`
+	Multiplier     int      `json:"multiplier,omitempty"`    // Contract volume multiple
+	ExchangeID     string   `json:"exchange_id,omitempty"`   // Exchange code, e.g. SHFE
+	ProductID      string   `json:"product_id,omitempty"`    // Product code, e.g. ag
+	ProductClass   string   `json:"product_class,omitempty"` // Futures / Options ...
+	ExpireDate     string   `json:"expire_date,omitempty"`   // Last trading day, YYYYMMDD
+	OptionsType    string   `json:"options_type,omitempty"`  // Call / Put for options
+	StrikePrice    *float64 `json:"strike_price,omitempty"`  // Strike for options
+	Underlying     string   `json:"underlying,omitempty"`    // Underlying instrument for options
+	Source         string   `json:"source"`                  // Where the info came from: trader, store, api or default
+	Fallback       bool     `json:"fallback"`                // True when defaults were used because lookup failed
 }
 
+// fallbackTTL is how long a failed lookup is remembered before retrying
+const fallbackTTL = 5 * time.Minute
+
 // PrecisionManager manages precision information for symbols
 type PrecisionManager struct {
 	precisions map[string]*PrecisionInfo
+	fallbacks  map[string]*PrecisionInfo // Defaults handed out after a failed lookup
+	store      *InstrumentStore  // Local instrument dictionary
+	querier    InstrumentQuerier // Optional trader API lookup for exact instruments
+	offline    bool              // Never query the dictionary API when set
 	mu         sync.RWMutex
 	client     *http.Client
 }
 
-// NewPrecisionManager creates a new precision manager
-func NewPrecisionManager() *PrecisionManager {
+// NewPrecisionManager creates a new precision manager backed by store
+func NewPrecisionManager(store *InstrumentStore) *PrecisionManager {
+	if store == nil {
+		store = NewInstrumentStore("")
+	}
 	return &PrecisionManager{
 		precisions: make(map[string]*PrecisionInfo),
+		fallbacks:  make(map[string]*PrecisionInfo),
+		store:      store,
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 }
 
+// SetOffline disables dictionary API lookups
+func (pm *PrecisionManager) SetOffline(offline bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.offline = offline
+}
+
+// SetQuerier sets an exact-instrument lookup (e.g. the CTP trader API) that
+// takes precedence over the dictionary
+func (pm *PrecisionManager) SetQuerier(q InstrumentQuerier) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.querier = q
+}
+
+// Store returns the instrument store backing the manager
+func (pm *PrecisionManager) Store() *InstrumentStore {
+	return pm.store
+}
+
 // calculatePrecision calculates decimal places from a step size string
 func calculatePrecision(stepSize string) int {
 	if stepSize == "" {
@@ -96,7 +137,42 @@ func calculatePrecision2(stepFloat float64) int {
 	return precision
 }
 
-// FetchPrecisionInfo fetches precision information for a symbol from Binance
+// precisionFromInstrument builds precision info from a dictionary entry
+func precisionFromInstrument(symbol string, inst *Instrument, source string) *PrecisionInfo {
+	priceTick := inst.PriceTick
+	pricePrecision := calculatePrecision2(priceTick)
+
+	var formatStr string
+	if pricePrecision >= 1 {
+		formatStr = fmt.Sprintf("%%.%df", pricePrecision)
+	} else {
+		formatStr = "%.0f"
+	}
+	tickSize := fmt.Sprintf(formatStr, priceTick)
+	precisionLog.Info("precision", "symbol", symbol, "price_precision", pricePrecision, "price_tick", priceTick, "tick_size", tickSize)
+
+	return &PrecisionInfo{
+		Symbol:         symbol,
+		PricePrecision: pricePrecision,
+		QtyPrecision:   1,        // Default
+		TickSize:       tickSize, // From the dictionary
+		StepSize:       "1",      // Default
+		LastUpdated:    time.Now().Unix(),
+		Multiplier:     inst.VolumeMultiple,
+		ExchangeID:     inst.ExchangeID,
+		ProductID:      inst.ProductID,
+		ProductClass:   inst.ProductClass,
+		ExpireDate:     inst.ExpireDate,
+		OptionsType:    inst.OptionsType,
+		StrikePrice:    inst.StrikePrice,
+		Underlying:     inst.UnderlyingInstrID,
+		Source:         source,
+	}
+}
+
+// FetchPrecisionInfo resolves precision information for a symbol from the
+// cache, the trader API querier, the local instrument store, and finally the
+// dictionary API
 func (pm *PrecisionManager) FetchPrecisionInfo(symbol string) (*PrecisionInfo, error) {
 	pm.mu.RLock()
 	if info, exists := pm.precisions[symbol]; exists {
@@ -106,64 +182,98 @@ func (pm *PrecisionManager) FetchPrecisionInfo(symbol string) (*PrecisionInfo, e
 			return info, nil
 		}
 	}
+	offline := pm.offline
+	querier := pm.querier
 	pm.mu.RUnlock()
 
-	ct := ExtractContractPrefix(symbol)
-	resp, err := GetInstruments(
-		[]string{"futures"},
-		[]string{},   // 所有国家/地区
-		[]string{},   // 所有交易所
-		[]string{ct}, // 所有品种
-	)
-	// Fetch from API
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch instrument info: %w", err)
+	if querier != nil {
+		inst, err := querier.QueryInstrument(symbol)
+		if err == nil && !validPriceTick(inst.PriceTick) {
+			err = fmt.Errorf("invalid price tick %v", inst.PriceTick)
+		}
+		if err == nil {
+			// Keep the exact instrument in the store for offline use
+			pm.store.Put([]Instrument{*inst})
+			if err := pm.store.Save(); err != nil {
+				precisionLog.Error("save instrument store failed", "err", err)
+			}
+			return pm.cachePrecision(precisionFromInstrument(symbol, inst, "trader")), nil
+		}
+		precisionLog.Warn("trader API instrument query failed, falling back to dictionary", "symbol", symbol, "err", err)
 	}
 
-	if len(resp.Data) == 0 {
-		return nil, fmt.Errorf("symbol %s not found in exchange info", symbol)
+	source := "store"
+	inst, ok := pm.store.Get(symbol)
+	if !ok {
+		if offline {
+			return nil, fmt.Errorf("symbol %s not found in local instrument store (offline)", symbol)
+		}
+		if _, err := pm.store.Refresh([]string{ExtractContractPrefix(symbol)}); err != nil {
+			return nil, err
+		}
+		if inst, ok = pm.store.Get(symbol); !ok {
+			return nil, fmt.Errorf("symbol %s not found in instrument dictionary", symbol)
+		}
+		source = "api"
 	}
 
-	priceTick := resp.Data[0].PriceTick
-	log.Printf("priceTick: %f", priceTick)
-
-	pricePrecision := calculatePrecision2(priceTick)
+	return pm.cachePrecision(precisionFromInstrument(symbol, inst, source)), nil
+}
 
-	var formatStr string
-	if pricePrecision >= 1 {
-		formatStr = fmt.Sprintf("%%.%df", pricePrecision)
-	} else {
-		formatStr = "%.0f"
-	}
-	// log.Printf("formatStr: %s", formatStr)
-	tickSize := fmt.Sprintf(formatStr, priceTick)
-	log.Printf("pricePrecision: %d, priceTick: %f, tickSize: %s", pricePrecision, priceTick, tickSize)
-	// Find the symbol in the response
+// cachePrecision stores info in the cache and returns it
+func (pm *PrecisionManager) cachePrecision(info *PrecisionInfo) *PrecisionInfo {
+	pm.mu.Lock()
+	pm.precisions[info.Symbol] = info
+	delete(pm.fallbacks, info.Symbol)
+	pm.mu.Unlock()
+	return info
+}
 
-	precisionInfo := &PrecisionInfo{
-		Symbol:         symbol,
-		PricePrecision: pricePrecision,
-		QtyPrecision:   1,        // Default
-		TickSize:       tickSize, // Default
-		StepSize:       "1",      // Default
-		LastUpdated:    time.Now().Unix(),
+// RefreshPrecisionInfo drops cached info for symbol and re-queries the
+// dictionary API (unless offline) before resolving it again
+func (pm *PrecisionManager) RefreshPrecisionInfo(symbol string) *PrecisionInfo {
+	pm.mu.Lock()
+	delete(pm.precisions, symbol)
+	delete(pm.fallbacks, symbol)
+	offline := pm.offline
+	pm.mu.Unlock()
+
+	if !offline {
+		if _, err := pm.store.Refresh([]string{ExtractContractPrefix(symbol)}); err != nil {
+			precisionLog.Warn("refresh instruments failed, using local store", "symbol", symbol, "err", err)
+		}
 	}
-	return precisionInfo, nil
+	return pm.GetPrecisionInfo(symbol)
 }
 
-// GetPrecisionInfo gets cached precision info or fetches it if not available
+// GetPrecisionInfo gets cached precision info or fetches it if not available.
+// When the lookup fails, tick size 1 is used and the lookup is not retried
+// for fallbackTTL.
 func (pm *PrecisionManager) GetPrecisionInfo(symbol string) *PrecisionInfo {
+	pm.mu.RLock()
+	fallback, exists := pm.fallbacks[symbol]
+	pm.mu.RUnlock()
+	if exists && time.Now().Unix()-fallback.LastUpdated < int64(fallbackTTL/time.Second) {
+		return fallback
+	}
+
 	info, err := pm.FetchPrecisionInfo(symbol)
 	if err != nil {
-		log.Printf("Failed to fetch precision for %s: %v, using defaults", symbol, err)
-		return &PrecisionInfo{
+		precisionLog.Warn("no instrument info, falling back to tick size 1", "symbol", symbol, "retry_in", fallbackTTL, "err", err)
+		fallback = &PrecisionInfo{
 			Symbol:         symbol,
-			PricePrecision: 1,
+			PricePrecision: 0,
 			QtyPrecision:   1,
 			TickSize:       "1",
 			StepSize:       "1",
 			LastUpdated:    time.Now().Unix(),
+			Source:         "default",
+			Fallback:       true,
 		}
+		pm.mu.Lock()
+		pm.fallbacks[symbol] = fallback
+		pm.mu.Unlock()
+		return fallback
 	}
 	return info
 }
@@ -199,14 +309,20 @@ func (pm *PrecisionManager) ClearCache() {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 	pm.precisions = make(map[string]*PrecisionInfo)
+	pm.fallbacks = make(map[string]*PrecisionInfo)
 }
 
 // Global precision manager instance
 var precisionManager *PrecisionManager
 
-// InitializePrecisionManager initializes the global precision manager
+// InitializePrecisionManager initializes the global precision manager with
+// the default instrument store
 func InitializePrecisionManager() {
-	precisionManager = NewPrecisionManager()
+	store := NewInstrumentStore(defaultInstrumentStorePath)
+	if err := store.Load(); err != nil {
+		precisionLog.Error("load instrument store failed", "err", err)
+	}
+	precisionManager = NewPrecisionManager(store)
 }
 
 // ExtractContractPrefix 提取合约字符串中前面的非数字字符
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrecisionFallbackCached(t *testing.T) {
+	pm := NewPrecisionManager(nil)
+	pm.SetOffline(true)
+
+	first := pm.GetPrecisionInfo("xx2510")
+	if !first.Fallback || first.TickSize != "1" || first.PricePrecision != 0 {
+		t.Fatalf("got %+v, want the tick size 1 fallback", first)
+	}
+	if price := pm.FormatPrice("xx2510", 601); price != "601" {
+		t.Errorf("fallback formats 601 as %s", price)
+	}
+	if again := pm.GetPrecisionInfo("xx2510"); again != first {
+		t.Error("failed lookup retried within the fallback TTL")
+	}
+
+	first.LastUpdated -= int64(fallbackTTL.Seconds())
+	if again := pm.GetPrecisionInfo("xx2510"); again == first {
+		t.Error("expired fallback not retried")
+	}
+
+	pm.Store().Put([]Instrument{{InstrumentID: "xx2510", PriceTick: 0.5, VolumeMultiple: 10}})
+	if info := pm.RefreshPrecisionInfo("xx2510"); info.Fallback || info.TickSize != "0.5" {
+		t.Errorf("after refresh got %+v", info)
+	}
+}
+
+func TestImportSkipsInvalidPriceTick(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instruments.csv")
+	csv := "ExchangeID,InstrumentID,PriceTick,VolumeMultiple\nSHFE,ag2510,1,15\nSHFE,zz2510,0,10\nSHFE,yy2510,-0.5,10\n"
+	if err := os.WriteFile(path, []byte(csv), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store := NewInstrumentStore("")
+	if n, err := store.ImportFile(path); err != nil || n != 1 {
+		t.Fatalf("imported %d (%v), want 1", n, err)
+	}
+
+	pm := NewPrecisionManager(store)
+	pm.SetOffline(true)
+	if info := pm.GetPrecisionInfo("ag2510"); info.Fallback || info.Multiplier != 15 {
+		t.Errorf("ag2510: %+v", info)
+	}
+	if info := pm.GetPrecisionInfo("zz2510"); !info.Fallback || info.TickSize != "1" {
+		t.Errorf("zero tick not replaced by the fallback: %+v", info)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/shopspring/decimal"
+)
+
+// maxTickPrice bounds valid feed prices; CTP reports empty levels as 0 or DBL_MAX
+const maxTickPrice = 1e12
+
+// tickScale converts between prices and integer tick indexes
+type tickScale struct {
+	size  decimal.Decimal // Tick size
+	sizeF float64
+}
+
+// newTickScale builds a scale from a tick size string, defaulting to 1
+func newTickScale(tickSize string) tickScale {
+	size, err := decimal.NewFromString(tickSize)
+	if err != nil || !size.IsPositive() {
+		size = decimal.NewFromInt(1)
+	}
+	return tickScale{size: size, sizeF: size.InexactFloat64()}
+}
+
+// fromFloat returns the tick index of a feed price, false for empty or invalid prices
+func (s tickScale) fromFloat(price float64) (int64, bool) {
+	if price == 0 || math.IsNaN(price) || math.Abs(price) >= maxTickPrice {
+		return 0, false
+	}
+	return int64(math.Round(price / s.sizeF)), true
+}
+
+// onGrid reports whether a feed price lies on tick, allowing for float error
+func (s tickScale) onGrid(price float64, tick int64) bool {
+	return math.Abs(price-float64(tick)*s.sizeF) <= s.sizeF*1e-6
+}
+
+// fromString parses a decimal price string into a tick index
+func (s tickScale) fromString(price string) (int64, error) {
+	p, err := decimal.NewFromString(price)
+	if err != nil {
+		return 0, err
+	}
+	if p.Abs().GreaterThanOrEqual(decimal.NewFromFloat(maxTickPrice)) {
+		return 0, fmt.Errorf("price %s out of range", price)
+	}
+	return p.Div(s.size).Round(0).IntPart(), nil
+}
+
+// price returns the price of a tick index
+func (s tickScale) price(tick int64) decimal.Decimal {
+	return s.size.Mul(decimal.NewFromInt(tick))
+}
+
+// depthLevel is one L2 level of an update with its price as a tick index
+type depthLevel struct {
+	tick int64
+	qty  int64 // Lots
+}
+
+// bookLevel holds the queues of one price level
+type bookLevel struct {
+	tick     int64
+	queue    *OrderQueue
+	enhanced *EnhancedOrderQueue // nil when enhanced mode is disabled
+}
+
+// release returns the level's pooled orders, recording why the level went away
+func (l *bookLevel) release(rule string) {
+	if l.enhanced != nil {
+		l.enhanced.ClearLevel(rule)
+	}
+}
+
+// orderSizes appends the sizes of the level's orders in queue order to dst.
+// Snapshots show the enhanced queue when there is one, as order events, own
+// orders and order details all follow it; the plain queue removes volume by
+// its own rules and only shares IDs with it for added orders.
+func (l *bookLevel) orderSizes(dst []int64) []int64 {
+	if l.enhanced == nil {
+		return append(dst, l.queue.orders...)
+	}
+	for _, order := range l.enhanced.orders {
+		dst = append(dst, order.Qty)
+	}
+	return dst
+}
+
+// orderIDs appends the IDs of the orders of orderSizes to dst
+func (l *bookLevel) orderIDs(dst []uint64) []uint64 {
+	if l.enhanced == nil {
+		return append(dst, l.queue.ids...)
+	}
+	for _, order := range l.enhanced.orders {
+		dst = append(dst, order.ID)
+	}
+	return dst
+}
+
+// bookSide keeps the levels of one side sorted best-first: descending ticks
+// for bids, ascending for asks. Futures books carry few levels, so a sorted
+// slice with binary search is cheaper than a tree and top-N is a prefix.
+type bookSide struct {
+	desc   bool
+	levels []bookLevel
+}
+
+func newBookSide(isBid bool) *bookSide {
+	return &bookSide{desc: isBid}
+}
+
+// better reports whether tick a ranks ahead of tick b on this side
+func (bs *bookSide) better(a, b int64) bool {
+	if bs.desc {
+		return a > b
+	}
+	return a < b
+}
+
+// search returns the position of tick, or where it would be inserted
+func (bs *bookSide) search(tick int64) (int, bool) {
+	i := sort.Search(len(bs.levels), func(i int) bool {
+		return !bs.better(bs.levels[i].tick, tick)
+	})
+	return i, i < len(bs.levels) && bs.levels[i].tick == tick
+}
+
+// get returns the level at tick. The pointer is valid until the side is modified.
+func (bs *bookSide) get(tick int64) (*bookLevel, bool) {
+	i, ok := bs.search(tick)
+	if !ok {
+		return nil, false
+	}
+	return &bs.levels[i], true
+}
+
+// insert adds a level, replacing any existing level at the same tick
+func (bs *bookSide) insert(level bookLevel) {
+	i, ok := bs.search(level.tick)
+	if ok {
+		bs.levels[i] = level
+		return
+	}
+	bs.levels = append(bs.levels, bookLevel{})
+	copy(bs.levels[i+1:], bs.levels[i:])
+	bs.levels[i] = level
+}
+
+// remove deletes the level at tick, recording why it went away
+func (bs *bookSide) remove(tick int64, rule string) bool {
+	i, ok := bs.search(tick)
+	if !ok {
+		return false
+	}
+	bs.levels[i].release(rule)
+	copy(bs.levels[i:], bs.levels[i+1:])
+	bs.levels[len(bs.levels)-1] = bookLevel{}
+	bs.levels = bs.levels[:len(bs.levels)-1]
+	return true
+}
+
+// removeBetterThan drops all levels ranked ahead of tick and returns how many were removed
+func (bs *bookSide) removeBetterThan(tick int64) int {
+	i, _ := bs.search(tick)
+	if i == 0 {
+		return 0
+	}
+	for j := range bs.levels[:i] {
+		bs.levels[j].release(RulePriceCrossed)
+	}
+	n := copy(bs.levels, bs.levels[i:])
+	clear(bs.levels[n:])
+	bs.levels = bs.levels[:n]
+	return i
+}
+
+// top returns the best n levels. The slice aliases the side.
+func (bs *bookSide) top(n int) []bookLevel {
+	return bs.levels[:min(n, len(bs.levels))]
+}
+
+func (bs *bookSide) len() int {
+	return len(bs.levels)
+}
+
+// clear deletes all levels, recording why they went away
+func (bs *bookSide) clear(rule string) {
+	for i := range bs.levels {
+		bs.levels[i].release(rule)
+	}
+	clear(bs.levels)
+	bs.levels = bs.levels[:0]
+}
@@ -1,231 +1,315 @@
 package main
 
 import (
+	"slices"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/shopspring/decimal"
 )
 
 // OrderInfo represents detailed order information for better tracking
 type OrderInfo struct {
-	ID        uint64          `json:"id"`         // Synthetic order ID
-	Qty       decimal.Decimal `json:"qty"`        // Order quantity
-	Timestamp int64           `json:"timestamp"`  // Creation timestamp
-	Age       int64           `json:"age"`        // Age in milliseconds
-	IsPartial bool            `json:"is_partial"` // Whether this order was partially filled
+	ID        uint64 `json:"id"`                 // Synthetic order ID
+	Qty       int64  `json:"qty"`                // Order quantity in lots
+	Timestamp int64  `json:"timestamp"`          // Creation timestamp
+	Age       int64  `json:"age"`                // Age in milliseconds
+	IsPartial bool   `json:"is_partial"`         // Whether this order was partially filled
+	Own       bool   `json:"own,omitempty"`      // One of our orders, never taken as a cancellation
+	Anchored  bool   `json:"anchored,omitempty"` // Own order confirmed by the exchange, only our trades fill it
+}
+
+// orderInfoPool recycles orders removed from queues so the feed path does not allocate
+var orderInfoPool = sync.Pool{
+	New: func() any { return new(OrderInfo) },
+}
+
+// releaseOrderInfo returns an order to the pool. The caller must not keep references to it.
+func releaseOrderInfo(order *OrderInfo) {
+	*order = OrderInfo{}
+	orderInfoPool.Put(order)
+}
+
+// OrderIDGenerator hands out synthetic order IDs that stay unique across
+// price levels, book resets and symbol switches. It is safe for concurrent use.
+type OrderIDGenerator struct {
+	last atomic.Uint64
+}
+
+// NewOrderIDGenerator creates a generator whose first ID is start+1
+func NewOrderIDGenerator(start uint64) *OrderIDGenerator {
+	g := &OrderIDGenerator{}
+	g.last.Store(start)
+	return g
+}
+
+// Next returns a new ID
+func (g *OrderIDGenerator) Next() uint64 {
+	return g.last.Add(1)
+}
+
+// orderIDs is shared by all books. It starts from the process start time in
+// microseconds so IDs in recorded logs do not repeat across restarts, and
+// stays below 2^53 so browsers read the IDs exactly.
+var orderIDs = NewOrderIDGenerator(uint64(time.Now().UnixMilli()) * 1000)
+
+// queueContext is shared by the queues of one book
+type queueContext struct {
+	clock  func() int64      // Current time in Unix milliseconds
+	events *orderEventLog    // Receives inferred order events, may be nil
+	ids    *OrderIDGenerator // Source of synthetic order IDs
+	own    *OwnOrderTracker  // Notified when inference fills our orders, may be nil
+	flow   *orderFlow        // Accumulates added and removed volume, may be nil
 }
 
-// EnhancedOrderQueue provides advanced order queue management
+// defaultQueueContext uses the wall clock and the shared ID generator and records no events
+var defaultQueueContext = &queueContext{clock: wallClock, ids: orderIDs}
+
+// EnhancedOrderQueue provides advanced order queue management. It is owned
+// by the book's actor goroutine and is not safe for concurrent use.
 type EnhancedOrderQueue struct {
-	orders      []*OrderInfo    // FIFO ordered list of orders
-	totalQty    decimal.Decimal // Cache for total quantity
-	nextOrderID uint64          // Counter for synthetic order IDs
-	mu          sync.RWMutex
-	priceLevel  string          // Price level this queue represents
-	lastUpdate  int64           // Last update timestamp
+	orders     []*OrderInfo  // FIFO ordered list of orders
+	totalQty   int64         // Cache for total quantity
+	priceTick  int64         // Tick index of the price level this queue represents
+	isBid      bool          // Side of the price level
+	lastUpdate int64         // Last update timestamp
+	depletion  depletionRate // Rate volume leaves the level, for fill estimates
+	ctx        *queueContext // Clock, event log and ID source of the book
+}
+
+// wallClock returns the current wall time in Unix milliseconds
+func wallClock() int64 {
+	return time.Now().UnixMilli()
 }
 
-// NewEnhancedOrderQueue creates a new enhanced order queue
-func NewEnhancedOrderQueue(priceLevel string) *EnhancedOrderQueue {
+// NewEnhancedOrderQueue creates a new enhanced order queue. ctx supplies the
+// clock, event log and order IDs of the book; nil uses the wall clock and the
+// shared ID generator without recording events.
+func NewEnhancedOrderQueue(priceTick int64, isBid bool, ctx *queueContext) *EnhancedOrderQueue {
+	if ctx == nil {
+		ctx = defaultQueueContext
+	}
+	now := ctx.clock()
 	return &EnhancedOrderQueue{
-		orders:      make([]*OrderInfo, 0),
-		totalQty:    decimal.Zero,
-		nextOrderID: 1,
-		priceLevel:  priceLevel,
-		lastUpdate:  time.Now().UnixMilli(),
+		orders:     make([]*OrderInfo, 0, 4),
+		priceTick:  priceTick,
+		isBid:      isBid,
+		lastUpdate: now,
+		depletion:  depletionRate{since: now},
+		ctx:        ctx,
 	}
 }
 
-// AddOrder adds a new order to the queue
-func (eq *EnhancedOrderQueue) AddOrder(qty decimal.Decimal) {
-	eq.mu.Lock()
-	defer eq.mu.Unlock()
+// emit records an event changing order by qty, leaving remaining
+func (eq *EnhancedOrderQueue) emit(kind, rule string, order *OrderInfo, qty, remaining, now int64) {
+	eq.ctx.events.add(rawOrderEvent{
+		kind:      kind,
+		rule:      rule,
+		bid:       eq.isBid,
+		tick:      eq.priceTick,
+		id:        order.ID,
+		qty:       qty,
+		remaining: remaining,
+		ts:        now,
+	})
+}
 
-	now := time.Now().UnixMilli()
-	order := &OrderInfo{
-		ID:        eq.nextOrderID,
-		Qty:       qty,
-		Timestamp: now,
-		Age:       0,
-		IsPartial: false,
+// reduce takes qty from the order at index i, removing it when nothing is
+// left, and records a fill under rule
+func (eq *EnhancedOrderQueue) reduce(i int, qty int64, rule string, now int64) {
+	order := eq.orders[i]
+	if order.Own {
+		eq.ctx.own.filled(order.ID, qty, rule)
+	}
+	taken := min64(qty, order.Qty)
+	eq.depletion.record(taken, rule, now)
+	eq.ctx.flow.removed(eq.isBid, taken, rule, now)
+	if qty >= order.Qty {
+		eq.emit(EventFill, rule, order, order.Qty, 0, now)
+		eq.removeAt(i)
+		return
 	}
-	
-	eq.nextOrderID++
+	order.Qty -= qty
+	order.IsPartial = true
+	eq.totalQty -= qty
+	eq.emit(EventPartialFill, rule, order, qty, order.Qty, now)
+}
+
+// AddOrder adds a new order with a fresh ID to the queue
+func (eq *EnhancedOrderQueue) AddOrder(qty int64) {
+	eq.addOrder(eq.ctx.ids.Next(), qty, RuleVolumeIncrease)
+}
+
+// addOrder adds a new order under an ID allocated by the caller, recording
+// its arrival under rule
+func (eq *EnhancedOrderQueue) addOrder(id uint64, qty int64, rule string) {
+	now := eq.ctx.clock()
+	order := orderInfoPool.Get().(*OrderInfo)
+	order.ID = id
+	order.Qty = qty
+	order.Timestamp = now
+
 	eq.orders = append(eq.orders, order)
-	eq.totalQty = eq.totalQty.Add(qty)
+	eq.totalQty += qty
 	eq.lastUpdate = now
+	eq.ctx.flow.added(eq.isBid, qty, now)
+	eq.emit(EventAdd, rule, order, qty, qty, now)
 }
 
-// RemoveQty removes quantity from the queue using FIFO and intelligent matching
-func (eq *EnhancedOrderQueue) RemoveQty(qtyToRemove decimal.Decimal) {
-	eq.mu.Lock()
-	defer eq.mu.Unlock()
+// removeAt removes the order at index i and returns it to the pool
+func (eq *EnhancedOrderQueue) removeAt(i int) {
+	order := eq.orders[i]
+	eq.totalQty -= order.Qty
+	copy(eq.orders[i:], eq.orders[i+1:])
+	eq.orders[len(eq.orders)-1] = nil
+	eq.orders = eq.orders[:len(eq.orders)-1]
+	releaseOrderInfo(order)
+}
 
-	if qtyToRemove.LessThanOrEqual(decimal.Zero) {
+// RemoveQty removes quantity from the queue using FIFO and intelligent matching
+func (eq *EnhancedOrderQueue) RemoveQty(qtyToRemove int64) {
+	if qtyToRemove <= 0 {
 		return
 	}
 
 	remaining := qtyToRemove
-	now := time.Now().UnixMilli()
+	now := eq.ctx.clock()
 
-	// Strategy 1: Try to find exact match first (simulates order cancellation)
+	// Strategy 1: Try to find exact match first (simulates order cancellation).
+	// Our own orders are only cancelled by us.
 	for i := len(eq.orders) - 1; i >= 0; i-- {
-		if eq.orders[i].Qty.Equal(remaining) {
+		if order := eq.orders[i]; !order.Own && order.Qty == remaining {
 			// Exact match - remove entire order
-			eq.totalQty = eq.totalQty.Sub(eq.orders[i].Qty)
-			eq.orders = append(eq.orders[:i], eq.orders[i+1:]...)
+			eq.emit(EventCancel, RuleExactMatch, order, remaining, 0, now)
+			eq.depletion.record(remaining, RuleExactMatch, now)
+			eq.ctx.flow.removed(eq.isBid, remaining, RuleExactMatch, now)
+			eq.removeAt(i)
 			eq.lastUpdate = now
 			return
 		}
 	}
 
 	// Strategy 2: Remove from largest orders first (simulates large order fills)
-	if remaining.GreaterThan(eq.getLargestOrderQty().Div(decimal.NewFromFloat(2))) {
-		eq.removeFromLargestOrders(&remaining)
+	if 2*remaining > eq.getLargestOrderQty() {
+		eq.removeFromLargestOrders(&remaining, now)
 	} else {
 		// Strategy 3: FIFO removal for small changes (simulates normal fills)
-		eq.removeFIFO(&remaining)
+		eq.removeFIFO(&remaining, now)
 	}
 
 	eq.lastUpdate = now
 }
 
-// removeFIFO removes quantity using FIFO order (front of queue first)
-func (eq *EnhancedOrderQueue) removeFIFO(remaining *decimal.Decimal) {
-	i := 0
-	for i < len(eq.orders) && remaining.GreaterThan(decimal.Zero) {
+// removeFIFO removes quantity using FIFO order (front of queue first).
+// Anchored orders only trade when the exchange reports it, so volume beyond
+// what is ahead of them was cancelled behind them; they are only reduced when
+// nothing else is left.
+func (eq *EnhancedOrderQueue) removeFIFO(remaining *int64, now int64) {
+	for i := 0; i < len(eq.orders) && *remaining > 0; {
 		order := eq.orders[i]
-		
-		if order.Qty.LessThanOrEqual(*remaining) {
-			// Remove entire order
-			*remaining = remaining.Sub(order.Qty)
-			eq.totalQty = eq.totalQty.Sub(order.Qty)
-			eq.orders = append(eq.orders[:i], eq.orders[i+1:]...)
-			// Don't increment i since we removed an element
-		} else {
-			// Partial fill
-			fillAmount := *remaining
-			order.Qty = order.Qty.Sub(fillAmount)
-			order.IsPartial = true
-			eq.totalQty = eq.totalQty.Sub(fillAmount)
-			*remaining = decimal.Zero
+		if order.Anchored {
 			i++
+			continue
 		}
+		qty := order.Qty
+		if qty > *remaining {
+			qty = *remaining // Partial fill
+		}
+		*remaining -= qty
+		eq.reduce(i, qty, RuleFIFO, now)
+	}
+	for len(eq.orders) > 0 && *remaining > 0 {
+		qty := eq.orders[0].Qty
+		if qty > *remaining {
+			qty = *remaining // Partial fill
+		}
+		*remaining -= qty
+		eq.reduce(0, qty, RuleFIFO, now)
 	}
 }
 
 // removeFromLargestOrders removes quantity from the largest orders first
-func (eq *EnhancedOrderQueue) removeFromLargestOrders(remaining *decimal.Decimal) {
-	for remaining.GreaterThan(decimal.Zero) && len(eq.orders) > 0 {
-		// Find largest order
+func (eq *EnhancedOrderQueue) removeFromLargestOrders(remaining *int64, now int64) {
+	for *remaining > 0 && len(eq.orders) > 0 {
 		largestIdx := eq.getLargestOrderIndex()
 		if largestIdx == -1 {
+			// Only our own orders are left, so the rest was traded
+			eq.removeFIFO(remaining, now)
 			break
 		}
-
-		largestOrder := eq.orders[largestIdx]
-		
-		if largestOrder.Qty.LessThanOrEqual(*remaining) {
-			// Remove entire largest order
-			*remaining = remaining.Sub(largestOrder.Qty)
-			eq.totalQty = eq.totalQty.Sub(largestOrder.Qty)
-			eq.orders = append(eq.orders[:largestIdx], eq.orders[largestIdx+1:]...)
-		} else {
-			// Partial fill of largest order
-			fillAmount := *remaining
-			largestOrder.Qty = largestOrder.Qty.Sub(fillAmount)
-			largestOrder.IsPartial = true
-			eq.totalQty = eq.totalQty.Sub(fillAmount)
-			*remaining = decimal.Zero
+		qty := eq.orders[largestIdx].Qty
+		if qty > *remaining {
+			qty = *remaining // Partial fill of largest order
 		}
+		*remaining -= qty
+		eq.reduce(largestIdx, qty, RuleLargestFirst, now)
 	}
 }
 
-// getLargestOrderIndex finds the index of the largest order
+// getLargestOrderIndex finds the index of the largest order that is not ours,
+// or -1 when there is none
 func (eq *EnhancedOrderQueue) getLargestOrderIndex() int {
-	if len(eq.orders) == 0 {
-		return -1
-	}
+	maxIdx := -1
+	maxQty := int64(0)
 
-	maxIdx := 0
-	maxQty := eq.orders[0].Qty
-	
-	for i := 1; i < len(eq.orders); i++ {
-		if eq.orders[i].Qty.GreaterThan(maxQty) {
+	for i := 0; i < len(eq.orders); i++ {
+		if !eq.orders[i].Own && eq.orders[i].Qty > maxQty {
 			maxQty = eq.orders[i].Qty
 			maxIdx = i
 		}
 	}
-	
+
 	return maxIdx
 }
 
 // getLargestOrderQty returns the quantity of the largest order
-func (eq *EnhancedOrderQueue) getLargestOrderQty() decimal.Decimal {
+func (eq *EnhancedOrderQueue) getLargestOrderQty() int64 {
 	idx := eq.getLargestOrderIndex()
 	if idx == -1 {
-		return decimal.Zero
+		return 0
 	}
 	return eq.orders[idx].Qty
 }
 
 // UpdateAge updates the age of all orders in the queue
 func (eq *EnhancedOrderQueue) UpdateAge() {
-	eq.mu.Lock()
-	defer eq.mu.Unlock()
-
-	now := time.Now().UnixMilli()
+	now := eq.ctx.clock()
 	for _, order := range eq.orders {
 		order.Age = now - order.Timestamp
 	}
 }
 
-// GetOrders returns a copy of all orders (thread-safe)
+// GetOrders returns a copy of all orders. The copies share one
+// backing array so a snapshot costs a single allocation per level.
 func (eq *EnhancedOrderQueue) GetOrders() []*OrderInfo {
-	eq.mu.RLock()
-	defer eq.mu.RUnlock()
-
+	copies := make([]OrderInfo, len(eq.orders))
 	orders := make([]*OrderInfo, len(eq.orders))
 	for i, order := range eq.orders {
-		orders[i] = &OrderInfo{
-			ID:        order.ID,
-			Qty:       order.Qty,
-			Timestamp: order.Timestamp,
-			Age:       order.Age,
-			IsPartial: order.IsPartial,
-		}
+		copies[i] = *order
+		orders[i] = &copies[i]
 	}
 	return orders
 }
 
 // GetTotalQty returns the total quantity in the queue
-func (eq *EnhancedOrderQueue) GetTotalQty() decimal.Decimal {
-	eq.mu.RLock()
-	defer eq.mu.RUnlock()
+func (eq *EnhancedOrderQueue) GetTotalQty() int64 {
 	return eq.totalQty
 }
 
 // GetOrderCount returns the number of orders in the queue
 func (eq *EnhancedOrderQueue) GetOrderCount() int {
-	eq.mu.RLock()
-	defer eq.mu.RUnlock()
 	return len(eq.orders)
 }
 
 // GetAverageOrderAge returns the average age of orders in milliseconds
 func (eq *EnhancedOrderQueue) GetAverageOrderAge() float64 {
-	eq.mu.RLock()
-	defer eq.mu.RUnlock()
-
 	if len(eq.orders) == 0 {
 		return 0
 	}
 
 	totalAge := int64(0)
-	now := time.Now().UnixMilli()
-	
+	now := eq.ctx.clock()
+
 	for _, order := range eq.orders {
 		age := now - order.Timestamp
 		totalAge += age
@@ -236,22 +320,19 @@ func (eq *EnhancedOrderQueue) GetAverageOrderAge() float64 {
 
 // GetQueueDepthMetrics returns detailed metrics about the queue
 type QueueMetrics struct {
-	TotalOrders    int             `json:"total_orders"`
-	TotalQty       decimal.Decimal `json:"total_qty"`
-	AvgOrderSize   decimal.Decimal `json:"avg_order_size"`
-	MaxOrderSize   decimal.Decimal `json:"max_order_size"`
-	MinOrderSize   decimal.Decimal `json:"min_order_size"`
-	AvgAge         float64         `json:"avg_age_ms"`
-	OldestAge      int64           `json:"oldest_age_ms"`
-	PartialOrders  int             `json:"partial_orders"`
-	LastUpdate     int64           `json:"last_update"`
+	TotalOrders   int     `json:"total_orders"`
+	TotalQty      int64   `json:"total_qty"`
+	AvgOrderSize  float64 `json:"avg_order_size"`
+	MaxOrderSize  int64   `json:"max_order_size"`
+	MinOrderSize  int64   `json:"min_order_size"`
+	AvgAge        float64 `json:"avg_age_ms"`
+	OldestAge     int64   `json:"oldest_age_ms"`
+	PartialOrders int     `json:"partial_orders"`
+	LastUpdate    int64   `json:"last_update"`
 }
 
 // GetMetrics returns comprehensive queue metrics
 func (eq *EnhancedOrderQueue) GetMetrics() QueueMetrics {
-	eq.mu.RLock()
-	defer eq.mu.RUnlock()
-
 	metrics := QueueMetrics{
 		TotalOrders: len(eq.orders),
 		TotalQty:    eq.totalQty,
@@ -264,9 +345,9 @@ func (eq *EnhancedOrderQueue) GetMetrics() QueueMetrics {
 
 	// Calculate min/max/average order sizes
 	totalAge := int64(0)
-	now := time.Now().UnixMilli()
+	now := eq.ctx.clock()
 	partialCount := 0
-	
+
 	minQty := eq.orders[0].Qty
 	maxQty := eq.orders[0].Qty
 	oldestAge := now - eq.orders[0].Timestamp
@@ -274,24 +355,24 @@ func (eq *EnhancedOrderQueue) GetMetrics() QueueMetrics {
 	for _, order := range eq.orders {
 		age := now - order.Timestamp
 		totalAge += age
-		
+
 		if age > oldestAge {
 			oldestAge = age
 		}
-		
-		if order.Qty.LessThan(minQty) {
+
+		if order.Qty < minQty {
 			minQty = order.Qty
 		}
-		if order.Qty.GreaterThan(maxQty) {
+		if order.Qty > maxQty {
 			maxQty = order.Qty
 		}
-		
+
 		if order.IsPartial {
 			partialCount++
 		}
 	}
 
-	metrics.AvgOrderSize = eq.totalQty.Div(decimal.NewFromInt(int64(len(eq.orders))))
+	metrics.AvgOrderSize = float64(eq.totalQty) / float64(len(eq.orders))
 	metrics.MaxOrderSize = maxQty
 	metrics.MinOrderSize = minQty
 	metrics.AvgAge = float64(totalAge) / float64(len(eq.orders))
@@ -303,56 +384,152 @@ func (eq *EnhancedOrderQueue) GetMetrics() QueueMetrics {
 
 // OptimizeQueue performs maintenance on the queue (merge small orders, clean up, etc.)
 func (eq *EnhancedOrderQueue) OptimizeQueue() {
-	eq.mu.Lock()
-	defer eq.mu.Unlock()
-
-	// Remove orders with zero quantity
-	filteredOrders := make([]*OrderInfo, 0, len(eq.orders))
+	// Remove orders with zero quantity, compacting in place
+	kept := eq.orders[:0]
 	for _, order := range eq.orders {
-		if order.Qty.GreaterThan(decimal.Zero) {
-			filteredOrders = append(filteredOrders, order)
+		if order.Qty > 0 {
+			kept = append(kept, order)
+		} else {
+			releaseOrderInfo(order)
 		}
 	}
-	eq.orders = filteredOrders
+	clear(eq.orders[len(kept):])
+	eq.orders = kept
 
 	// Recalculate total quantity
-	eq.totalQty = decimal.Zero
+	eq.totalQty = 0
 	for _, order := range eq.orders {
-		eq.totalQty = eq.totalQty.Add(order.Qty)
+		eq.totalQty += order.Qty
 	}
 
 	// Sort orders by timestamp to maintain FIFO order
-	sort.Slice(eq.orders, func(i, j int) bool {
+	sort.SliceStable(eq.orders, func(i, j int) bool {
 		return eq.orders[i].Timestamp < eq.orders[j].Timestamp
 	})
 
-	eq.lastUpdate = time.Now().UnixMilli()
+	eq.lastUpdate = eq.ctx.clock()
+}
+
+// ClearLevel removes all orders when the price level goes away, recording
+// a LEVEL_CLEARED event for each under rule
+func (eq *EnhancedOrderQueue) ClearLevel(rule string) {
+	now := eq.ctx.clock()
+	for _, order := range eq.orders {
+		eq.emit(EventLevelCleared, rule, order, order.Qty, 0, now)
+		if order.Own {
+			eq.ctx.own.cleared(order.ID, rule)
+		}
+	}
+	eq.Clear()
+}
+
+// claimOwn takes qty of the level's volume as our order id, submitted at the
+// given time. The first inferred order that arrived no earlier with exactly
+// qty becomes ours; otherwise qty is split off the back of the first larger
+// one, conservatively placing us behind volume that arrived with ours. It
+// returns false when the volume has not shown up yet.
+func (eq *EnhancedOrderQueue) claimOwn(id uint64, qty, submitted int64, anchored bool) bool {
+	split := -1
+	for i, order := range eq.orders {
+		if order.Own || order.Timestamp < submitted {
+			continue
+		}
+		if order.Qty == qty {
+			order.ID = id
+			order.Own = true
+			order.Anchored = anchored
+			return true
+		}
+		if split < 0 && order.Qty > qty {
+			split = i
+		}
+	}
+	if split < 0 {
+		return false
+	}
+
+	base := eq.orders[split]
+	base.Qty -= qty
+	own := orderInfoPool.Get().(*OrderInfo)
+	*own = OrderInfo{ID: id, Qty: qty, Timestamp: base.Timestamp, Own: true, Anchored: anchored}
+	eq.orders = slices.Insert(eq.orders, split+1, own)
+	return true
+}
+
+// ownPosition returns the number of orders and the volume ahead of our order
+// id and its remaining quantity
+func (eq *EnhancedOrderQueue) ownPosition(id uint64) (position int, ahead, qty int64, ok bool) {
+	for i, order := range eq.orders {
+		if order.Own && order.ID == id {
+			return i, ahead, order.Qty, true
+		}
+		ahead += order.Qty
+	}
+	return 0, 0, 0, false
+}
+
+// releaseOwn hands our order id back to inference, so the volume drop of its
+// cancellation is matched against it like any other order
+func (eq *EnhancedOrderQueue) releaseOwn(id uint64) {
+	for _, order := range eq.orders {
+		if order.Own && order.ID == id {
+			order.Own = false
+			order.Anchored = false
+			return
+		}
+	}
+}
+
+// anchorOwn applies a trade of qty on our order id reported by the exchange.
+// Everything ahead of the order must have left the level before it traded, so
+// those orders are removed as fills. The level total drops below the feed's
+// until the next tick, which adds back any volume the feed still shows.
+func (eq *EnhancedOrderQueue) anchorOwn(id uint64, qty int64) bool {
+	idx := -1
+	for i, order := range eq.orders {
+		if order.Own && order.ID == id {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return false
+	}
+
+	now := eq.ctx.clock()
+	for ; idx > 0; idx-- {
+		eq.reduce(0, eq.orders[0].Qty, RuleTradeAnchor, now)
+	}
+	eq.reduce(0, qty, RuleTradeAnchor, now)
+	eq.lastUpdate = now
+	return true
 }
 
 // Clear removes all orders from the queue
 func (eq *EnhancedOrderQueue) Clear() {
-	eq.mu.Lock()
-	defer eq.mu.Unlock()
-
+	for i, order := range eq.orders {
+		releaseOrderInfo(order)
+		eq.orders[i] = nil
+	}
 	eq.orders = eq.orders[:0]
-	eq.totalQty = decimal.Zero
-	eq.lastUpdate = time.Now().UnixMilli()
+	eq.totalQty = 0
+	eq.lastUpdate = eq.ctx.clock()
 }
 
 // GetOrdersByAge returns orders sorted by age (oldest first)
 func (eq *EnhancedOrderQueue) GetOrdersByAge() []*OrderInfo {
 	orders := eq.GetOrders()
-	
+
 	// Update ages
-	now := time.Now().UnixMilli()
+	now := eq.ctx.clock()
 	for _, order := range orders {
 		order.Age = now - order.Timestamp
 	}
-	
+
 	// Sort by age (oldest first)
 	sort.Slice(orders, func(i, j int) bool {
 		return orders[i].Age > orders[j].Age
 	})
-	
+
 	return orders
-}
\ No newline at end of file
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// TestQueueModelsAgree drives random L2 quantities through one level and
+// checks that both queue models hold the level's quantity in positive orders
+func TestQueueModelsAgree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ob := newTestBook(t)
+	for i := 0; i < 5000; i++ {
+		qty := int64(rng.Intn(60))
+		if rng.Intn(10) == 0 {
+			qty = 0
+		}
+		ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: qty}})
+		level, ok := ob.bids.get(100)
+		if qty == 0 {
+			if ok {
+				t.Fatalf("step %d: level kept at zero quantity", i)
+			}
+			continue
+		}
+		if kinds := levelViolations(level, qty); kinds != 0 {
+			t.Fatalf("step %d: qty %d, plain %v (total %d), enhanced %d: violations %b",
+				i, qty, level.queue.orders, level.queue.total, level.enhanced.totalQty, kinds)
+		}
+	}
+}
+
+func TestUpdateQueueTakesWholeDecrease(t *testing.T) {
+	ob := newTestBook(t)
+	queue := &OrderQueue{}
+	for _, qty := range []int64{1, 1, 1} {
+		queue.push(qty, ob.queues.ids.Next())
+	}
+	ob.updateQueue(queue, 1, 0)
+	if queue.sum() != 1 || !slices.Equal(queue.orders, []int64{1}) {
+		t.Errorf("orders %v with total %d, want [1]", queue.orders, queue.sum())
+	}
+}
+
+// TestSnapshotOrderIDsFollowEvents checks that the order IDs of a snapshot
+// are those the order events talk about
+func TestSnapshotOrderIDsFollowEvents(t *testing.T) {
+	ob := newTestBook(t)
+	ob.SetEventsEnabled(true)
+	live := map[uint64]bool{}
+	for _, qty := range []int64{5, 15, 13, 10} { // [5,10], then -2 and -3
+		ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: qty}})
+		for _, ev := range ob.DrainEvents() {
+			switch ev.Type {
+			case EventAdd:
+				live[ev.ID] = true
+			case EventFill, EventCancel, EventLevelCleared:
+				delete(live, ev.ID)
+			}
+		}
+		snapshot := ob.getL3Snapshot(5)
+		level := snapshot.Bids[0]
+		if len(level.OrderIDs) != len(live) || len(level.Orders) != len(level.OrderIDs) {
+			t.Fatalf("qty %d: order_ids %v, orders %v, live %v", qty, level.OrderIDs, level.Orders, live)
+		}
+		for i, id := range level.OrderIDs {
+			if !live[id] {
+				t.Errorf("qty %d: order_ids shows %d, which the events removed", qty, id)
+			}
+			if level.OrderDetails[i].ID != id {
+				t.Errorf("qty %d: order_ids[%d] = %d, order_details has %d", qty, i, id, level.OrderDetails[i].ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// parseSymbol splits an exchange-qualified symbol such as "SHFE.ag2510" into
+// its exchange and instrument ID. Plain instrument IDs return an empty exchange.
+func parseSymbol(symbol string) (exchangeID, instrumentID string) {
+	prefix, rest, ok := strings.Cut(symbol, ".")
+	if !ok || prefix == "" || rest == "" {
+		return "", symbol
+	}
+	for _, c := range prefix {
+		if c < 'A' || c > 'Z' {
+			return "", symbol
+		}
+	}
+	return prefix, rest
+}
+
+// bookRoutes maps instrument IDs to the books that accept their ticks
+type bookRoutes map[string]*BookActor
+
+// RouteStats counts how incoming ticks were routed
+type RouteStats struct {
+	Routed       uint64            `json:"routed"`
+	Unknown      uint64            `json:"unknown"`                 // No book for the instrument
+	Misrouted    uint64            `json:"misrouted"`               // Rejected by the book, e.g. exchange mismatch
+	UnknownIDs   map[string]uint64 `json:"unknown_ids,omitempty"`   // Instrument ID -> unknown ticks
+	MisroutedIDs map[string]uint64 `json:"misrouted_ids,omitempty"` // "EXCHANGE.instrument" -> misrouted ticks
+	Routes       []string          `json:"routes"`                  // Instruments with a book
+}
+
+// tickRouter dispatches feed ticks to the book of their instrument. The route
+// map is copied on write so the feed reads it without locking; the per-ID
+// counters are only touched on the rejection paths.
+type tickRouter struct {
+	routes    atomic.Pointer[bookRoutes]
+	routed    atomic.Uint64
+	unknown   atomic.Uint64
+	misrouted atomic.Uint64
+
+	mu           sync.Mutex // Guards route writes and the per-ID counters
+	unknownIDs   map[string]uint64
+	misroutedIDs map[string]uint64
+}
+
+// set adds the route of an instrument, or removes it when actor is nil
+func (r *tickRouter) set(instrumentID string, actor *BookActor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := make(bookRoutes)
+	if cur := r.routes.Load(); cur != nil {
+		maps.Copy(next, *cur)
+	}
+	if actor == nil {
+		delete(next, instrumentID)
+	} else {
+		next[instrumentID] = actor
+	}
+	r.routes.Store(&next)
+}
+
+// book returns the book routed for an instrument, or nil
+func (r *tickRouter) book(instrumentID string) *BookActor {
+	if routes := r.routes.Load(); routes != nil {
+		return (*routes)[instrumentID]
+	}
+	return nil
+}
+
+// books returns all routed books
+func (r *tickRouter) books() []*BookActor {
+	var books []*BookActor
+	if routes := r.routes.Load(); routes != nil {
+		for _, book := range *routes {
+			books = append(books, book)
+		}
+	}
+	return books
+}
+
+// dispatch applies a tick to the book of its instrument. Ticks without a book
+// or rejected by it are counted and dropped; the first one of each ID is logged.
+func (r *tickRouter) dispatch(f *thost.CThostFtdcDepthMarketDataField) bool {
+	var book *BookActor
+	if routes := r.routes.Load(); routes != nil {
+		book = (*routes)[string(instrumentKey(f))]
+	}
+	if book == nil {
+		r.unknown.Add(1)
+		if r.count(&r.unknownIDs, f.InstrumentID.String()) == 1 {
+			engineLog.Warn("dropping ticks for unsubscribed instrument", "instrument", f.InstrumentID.String())
+		}
+		return false
+	}
+	if !book.Accepts(f) {
+		r.misrouted.Add(1)
+		key := f.ExchangeID.String() + "." + f.InstrumentID.String()
+		if r.count(&r.misroutedIDs, key) == 1 {
+			engineLog.Warn("dropping misrouted ticks", "tick", key, "book", book.QualifiedSymbol())
+		}
+		return false
+	}
+	if !book.ApplyDepthMarketData(f) {
+		return false // Book stopped during a switch
+	}
+	r.routed.Add(1)
+	return true
+}
+
+// count increments the counter of id and returns the new value
+func (r *tickRouter) count(counters *map[string]uint64, id string) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if *counters == nil {
+		*counters = make(map[string]uint64)
+	}
+	(*counters)[id]++
+	return (*counters)[id]
+}
+
+// Stats returns a copy of the routing counters
+func (r *tickRouter) Stats() RouteStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := RouteStats{
+		Routed:       r.routed.Load(),
+		Unknown:      r.unknown.Load(),
+		Misrouted:    r.misrouted.Load(),
+		UnknownIDs:   maps.Clone(r.unknownIDs),
+		MisroutedIDs: maps.Clone(r.misroutedIDs),
+		Routes:       []string{},
+	}
+	if routes := r.routes.Load(); routes != nil {
+		for _, book := range *routes {
+			stats.Routes = append(stats.Routes, book.QualifiedSymbol())
+		}
+	}
+	slices.Sort(stats.Routes)
+	return stats
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// routeTick returns an empty tick of an instrument
+func routeTick(exchange, instrument string) *thost.CThostFtdcDepthMarketDataField {
+	f := &thost.CThostFtdcDepthMarketDataField{}
+	copy(f.ExchangeID[:], exchange)
+	copy(f.InstrumentID[:], instrument)
+	return f
+}
+
+func TestParseSymbol(t *testing.T) {
+	tests := []struct {
+		symbol, exchange, instrument string
+	}{
+		{"ag2510", "", "ag2510"},
+		{"SHFE.ag2510", "SHFE", "ag2510"},
+		{"CZCE.SR601", "CZCE", "SR601"},
+		{"shfe.ag2510", "", "shfe.ag2510"}, // Exchange IDs are upper case
+		{"SH1.ag2510", "", "SH1.ag2510"},
+		{".ag2510", "", ".ag2510"},
+		{"SHFE.", "", "SHFE."},
+		{"IO2510-C-4000", "", "IO2510-C-4000"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		exchange, instrument := parseSymbol(tt.symbol)
+		if exchange != tt.exchange || instrument != tt.instrument {
+			t.Errorf("parseSymbol(%q) = %q, %q, want %q, %q", tt.symbol, exchange, instrument, tt.exchange, tt.instrument)
+		}
+	}
+}
+
+func TestTickRouterCopyOnWrite(t *testing.T) {
+	var r tickRouter
+	ag, au := NewBookActor("ag2510"), NewBookActor("au2510")
+	t.Cleanup(func() {
+		ag.Stop()
+		au.Stop()
+	})
+
+	r.set("ag2510", ag)
+	held := r.routes.Load()
+	r.set("au2510", au)
+	r.set("ag2510", nil)
+	if len(*held) != 1 || (*held)["ag2510"] != ag {
+		t.Errorf("routes read before the writes changed to %v", *held)
+	}
+	if r.book("ag2510") != nil || r.book("au2510") != au {
+		t.Errorf("routes %v, want only au2510", r.Stats().Routes)
+	}
+	r.set("missing", nil)
+	if books := r.books(); len(books) != 1 || books[0] != au {
+		t.Errorf("removing a missing route changed the routes to %v", r.Stats().Routes)
+	}
+}
+
+func TestTickRouterDispatch(t *testing.T) {
+	var r tickRouter
+	book := NewBookActor("SHFE.ag2510")
+	t.Cleanup(book.Stop)
+	r.set(book.Symbol(), book)
+
+	ticks := []struct {
+		exchange, instrument string
+		routed               bool
+	}{
+		{"SHFE", "ag2510", true},
+		{"", "ag2510", true}, // Fronts that leave ExchangeID empty
+		{"INE", "ag2510", false},
+		{"INE", "ag2510", false},
+		{"SHFE", "au2510", false},
+		{"", "sc2510", false},
+	}
+	for _, tick := range ticks {
+		if got := r.dispatch(routeTick(tick.exchange, tick.instrument)); got != tick.routed {
+			t.Errorf("tick %s.%s routed %v, want %v", tick.exchange, tick.instrument, got, tick.routed)
+		}
+	}
+
+	stats := r.Stats()
+	if stats.Routed != 2 || stats.Misrouted != 2 || stats.Unknown != 2 {
+		t.Errorf("routed %d, misrouted %d, unknown %d, want 2 each", stats.Routed, stats.Misrouted, stats.Unknown)
+	}
+	if want := map[string]uint64{"INE.ag2510": 2}; !maps.Equal(stats.MisroutedIDs, want) {
+		t.Errorf("misrouted IDs %v, want %v", stats.MisroutedIDs, want)
+	}
+	if want := map[string]uint64{"au2510": 1, "sc2510": 1}; !maps.Equal(stats.UnknownIDs, want) {
+		t.Errorf("unknown IDs %v, want %v", stats.UnknownIDs, want)
+	}
+	if !slices.Equal(stats.Routes, []string{"SHFE.ag2510"}) {
+		t.Errorf("routes %v", stats.Routes)
+	}
+
+	// Stats returns copies
+	stats.MisroutedIDs["INE.ag2510"] = 0
+	if r.Stats().MisroutedIDs["INE.ag2510"] != 2 {
+		t.Error("stats share the router counters")
+	}
+
+	// Ticks of a stopped book are dropped without counting as routed
+	book.Stop()
+	if r.dispatch(routeTick("SHFE", "ag2510")) || r.Stats().Routed != 2 {
+		t.Error("tick routed to a stopped book")
+	}
+}
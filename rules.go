@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AlertUserRule is the alert type of user-defined rules
+const AlertUserRule = "rule"
+
+// Rule kinds
+const (
+	RuleLevelTotal = "level_total" // Lots at any level within Ticks of the touch
+	RuleOrderSize  = "order_size"  // Lots of an added order
+	RuleSpread     = "spread"      // Spread in ticks
+	RuleBestQueue  = "best_queue"  // Lots queued at the best level
+)
+
+const defaultRuleCooldown = time.Minute
+
+// ErrUnknownRule is returned for rule IDs that are not defined
+var ErrUnknownRule = errors.New("unknown alert rule")
+
+// AlertRule is a user-defined condition over book state. It fires when the
+// measure of Kind compares to Threshold under Op for at least For seconds,
+// at most once per Cooldown seconds and book.
+type AlertRule struct {
+	ID        uint64  `json:"id"`               // Assigned when the rule is added
+	Name      string  `json:"name,omitempty"`   // Shown in alert messages
+	Symbol    string  `json:"symbol,omitempty"` // Instrument, all books when empty
+	Kind      string  `json:"kind"`
+	Side      string  `json:"side,omitempty"` // bid or ask, both when empty; not for spread
+	Op        string  `json:"op,omitempty"`   // >, >=, < or <=, default > (>= for order_size)
+	Threshold float64 `json:"threshold"`
+	Ticks     int64   `json:"ticks,omitempty"`    // level_total: levels this many ticks from the touch, 0 is the best level only
+	For       float64 `json:"for,omitempty"`      // Seconds the condition must hold, not for order_size
+	Cooldown  float64 `json:"cooldown,omitempty"` // Seconds between alerts, default 60
+}
+
+// validate checks a rule and fills in defaults
+func (r *AlertRule) validate() error {
+	switch r.Kind {
+	case RuleLevelTotal, RuleOrderSize, RuleSpread, RuleBestQueue:
+	default:
+		return fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+	switch r.Side {
+	case "", "bid", "ask":
+	default:
+		return fmt.Errorf("invalid side %q", r.Side)
+	}
+	if r.Kind == RuleSpread && r.Side != "" {
+		return errors.New("spread rules take no side")
+	}
+	if r.Op == "" {
+		r.Op = ">"
+		if r.Kind == RuleOrderSize {
+			r.Op = ">="
+		}
+	}
+	switch r.Op {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("invalid op %q", r.Op)
+	}
+	if r.Threshold < 0 || r.Ticks < 0 || r.For < 0 || r.Cooldown < 0 {
+		return errors.New("threshold, ticks, for and cooldown must not be negative")
+	}
+	if r.Kind == RuleOrderSize && r.For > 0 {
+		return errors.New("order_size rules fire on single orders and take no for")
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = defaultRuleCooldown.Seconds()
+	}
+	if r.Symbol != "" {
+		_, r.Symbol = parseSymbol(r.Symbol)
+	}
+	return nil
+}
+
+// holds compares v to the threshold
+func (r *AlertRule) holds(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	default:
+		return v <= r.Threshold
+	}
+}
+
+// onSide reports whether the rule covers the bid or ask side
+func (r *AlertRule) onSide(bid bool) bool {
+	return r.Side == "" || (r.Side == "bid") == bid
+}
+
+func (r *AlertRule) String() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	var b strings.Builder
+	if r.Side != "" {
+		b.WriteString(r.Side + " ")
+	}
+	b.WriteString(r.Kind)
+	if r.Kind == RuleLevelTotal {
+		fmt.Fprintf(&b, " within %d ticks", r.Ticks)
+	}
+	fmt.Fprintf(&b, " %s %g", r.Op, r.Threshold)
+	if r.For > 0 {
+		fmt.Fprintf(&b, " for %gs", r.For)
+	}
+	return b.String()
+}
+
+// RuleSet holds the user-defined rules. Rules are immutable once added, so
+// books read the current list without locking.
+type RuleSet struct {
+	mu    sync.Mutex
+	next  uint64
+	rules atomic.Pointer[[]*AlertRule]
+}
+
+// alertRules is the process-wide rule set
+var alertRules = &RuleSet{}
+
+// Add validates a rule and starts evaluating it
+func (s *RuleSet) Add(r AlertRule) (AlertRule, error) {
+	if err := r.validate(); err != nil {
+		return AlertRule{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	r.ID = s.next
+	rules := append(s.current(), &r)
+	s.rules.Store(&rules)
+	return r, nil
+}
+
+// Remove stops evaluating rule id
+func (s *RuleSet) Remove(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.current()
+	for i, r := range current {
+		if r.ID == id {
+			rules := append(append([]*AlertRule{}, current[:i]...), current[i+1:]...)
+			s.rules.Store(&rules)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %d", ErrUnknownRule, id)
+}
+
+// List returns the rules in the order they were added
+func (s *RuleSet) List() []AlertRule {
+	current := s.current()
+	out := make([]AlertRule, len(current))
+	for i, r := range current {
+		out[i] = *r
+	}
+	return out
+}
+
+// current returns the rule list, which callers must not modify
+func (s *RuleSet) current() []*AlertRule {
+	if rules := s.rules.Load(); rules != nil {
+		return *rules
+	}
+	return nil
+}
+
+// ruleState follows one rule on one book
+type ruleState struct {
+	since int64 // When the condition started holding, 0 while it does not
+	fired int64 // Time of the last alert
+}
+
+// ruleDetector evaluates the user-defined rules against a book after each
+// update. A condition that must hold for a while is checked on updates, so
+// it fires on the first update after the time has passed.
+type ruleDetector struct {
+	states map[uint64]*ruleState
+}
+
+func newRuleDetector() *ruleDetector {
+	return &ruleDetector{states: make(map[uint64]*ruleState)}
+}
+
+func (d *ruleDetector) detect(ob *L3OrderBook, events []rawOrderEvent, _ []sizeScore) []Alert {
+	rules := alertRules.current()
+	if len(d.states) > len(rules) {
+		d.forgetRemoved(rules)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var out []Alert
+	now := ob.queues.clock()
+	for _, r := range rules {
+		if r.Symbol != "" && r.Symbol != ob.symbol {
+			continue
+		}
+		st := d.states[r.ID]
+		if st == nil {
+			st = &ruleState{}
+			d.states[r.ID] = st
+		}
+		var a Alert
+		var hit bool
+		if r.Kind == RuleOrderSize {
+			a, hit = ob.matchOrderSize(r, events)
+		} else if a, hit = ob.matchState(r); !hit {
+			st.since = 0
+		} else {
+			if st.since == 0 {
+				st.since = now
+			}
+			hit = now-st.since >= int64(r.For*1000)
+		}
+		if !hit || st.fired != 0 && now-st.fired < int64(r.Cooldown*1000) {
+			continue
+		}
+
+		st.fired = now
+		a.Type = AlertUserRule
+		a.Symbol = ob.symbol
+		a.Confidence = 1
+		a.RuleID = r.ID
+		if a.Timestamp == 0 {
+			a.Timestamp = now
+		}
+		a.Message = r.String() + ": " + a.Message
+		out = append(out, a)
+	}
+	return out
+}
+
+// forgetRemoved drops the state of rules no longer defined
+func (d *ruleDetector) forgetRemoved(rules []*AlertRule) {
+	defined := make(map[uint64]bool, len(rules))
+	for _, r := range rules {
+		defined[r.ID] = true
+	}
+	for id := range d.states {
+		if !defined[id] {
+			delete(d.states, id)
+		}
+	}
+}
+
+// matchOrderSize finds an added order of the update matching r
+func (ob *L3OrderBook) matchOrderSize(r *AlertRule, events []rawOrderEvent) (Alert, bool) {
+	for _, ev := range events {
+		if ev.kind == EventAdd && ev.rule != RuleResync && r.onSide(ev.bid) && r.holds(float64(ev.qty)) {
+			a := ob.alert("", ev, ev.qty, 1, fmt.Sprintf("order of %d lots added", ev.qty))
+			return a, true
+		}
+	}
+	return Alert{}, false
+}
+
+// matchState checks r against the current book
+func (ob *L3OrderBook) matchState(r *AlertRule) (Alert, bool) {
+	if r.Kind == RuleSpread {
+		if len(ob.bids.levels) == 0 || len(ob.asks.levels) == 0 {
+			return Alert{}, false
+		}
+		spread := ob.asks.levels[0].tick - ob.bids.levels[0].tick
+		if !r.holds(float64(spread)) {
+			return Alert{}, false
+		}
+		// Reported at the best bid
+		return Alert{
+			Price:   ob.scale.price(ob.bids.levels[0].tick),
+			Message: fmt.Sprintf("spread is %d ticks", spread),
+		}, true
+	}
+
+	for _, bid := range []bool{true, false} {
+		if !r.onSide(bid) {
+			continue
+		}
+		side, name := ob.asks, "ask"
+		if bid {
+			side, name = ob.bids, "bid"
+		}
+		ticks := r.Ticks
+		if r.Kind == RuleBestQueue {
+			ticks = 0
+		}
+		for _, level := range side.levels {
+			away := level.tick - side.levels[0].tick
+			if bid {
+				away = -away
+			}
+			if away > ticks {
+				break
+			}
+			qty := level.queue.sum()
+			if r.holds(float64(qty)) {
+				return Alert{
+					Side:    name,
+					Price:   ob.scale.price(level.tick),
+					Size:    qty,
+					Message: fmt.Sprintf("%d lots at %s", qty, ob.scale.price(level.tick)),
+				}, true
+			}
+		}
+	}
+	return Alert{}, false
+}
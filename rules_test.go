@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestRulesGateEvents(t *testing.T) {
+	noDetectors(t)
+
+	a := newTestActor(t)
+	// Recording is switched after each update, so it applies from the next one
+	recording := func() (enabled bool) {
+		a.Do(func(*L3OrderBook) {})
+		a.Do(func(ob *L3OrderBook) { enabled = ob.events.enabled })
+		return enabled
+	}
+	if recording() {
+		t.Fatal("events recorded without detectors or rules")
+	}
+
+	rule, err := alertRules.Add(AlertRule{Kind: RuleOrderSize, Threshold: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { alertRules.Remove(rule.ID) })
+	if !recording() {
+		t.Fatal("events not recorded with a rule defined")
+	}
+	var alerts []Alert
+	a.Do(func(ob *L3OrderBook) {
+		applyTestDepth(ob, testBids, testAsks)
+		alerts = ob.DetectAlerts()
+	})
+	if len(alerts) != 1 || alerts[0].RuleID != rule.ID {
+		t.Errorf("got %d alerts, want one for the orders of size >= 5", len(alerts))
+	}
+
+	if err := alertRules.Remove(rule.ID); err != nil {
+		t.Fatal(err)
+	}
+	if recording() {
+		t.Error("events still recorded after the last rule was removed")
+	}
+}
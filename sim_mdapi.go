@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// simFrontAddr 是模拟前置的地址，探测时不做网络连接
+const simFrontAddr = "sim://local"
+
+// SimTick 是一条可录制/回放的深度行情（五档）
+type SimTick struct {
+	InstrumentID   string     `json:"instrument_id"`
+	ExchangeID     string     `json:"exchange_id,omitempty"`
+	TradingDay     string     `json:"trading_day,omitempty"`
+	UpdateTime     string     `json:"update_time"`
+	UpdateMillisec int        `json:"update_millisec"`
+	LocalTime      int64      `json:"local_time"` // 录制时的本地时间（毫秒），回放时用于还原节奏
+	LastPrice      float64    `json:"last_price"`
+	Volume         int        `json:"volume"`
+	Turnover       float64    `json:"turnover,omitempty"`
+	OpenInterest   float64    `json:"open_interest,omitempty"`
+	BidPrices      [5]float64 `json:"bid_prices"`
+	BidVolumes     [5]int     `json:"bid_volumes"`
+	AskPrices      [5]float64 `json:"ask_prices"`
+	AskVolumes     [5]int     `json:"ask_volumes"`
+}
+
+// depthLevels 取出深度行情中的五档买卖价量
+func depthLevels(f *thost.CThostFtdcDepthMarketDataField) (bidPrices [5]float64, bidVolumes [5]int, askPrices [5]float64, askVolumes [5]int) {
+	bidPrices = [5]float64{float64(f.BidPrice1), float64(f.BidPrice2), float64(f.BidPrice3), float64(f.BidPrice4), float64(f.BidPrice5)}
+	bidVolumes = [5]int{int(f.BidVolume1), int(f.BidVolume2), int(f.BidVolume3), int(f.BidVolume4), int(f.BidVolume5)}
+	askPrices = [5]float64{float64(f.AskPrice1), float64(f.AskPrice2), float64(f.AskPrice3), float64(f.AskPrice4), float64(f.AskPrice5)}
+	askVolumes = [5]int{int(f.AskVolume1), int(f.AskVolume2), int(f.AskVolume3), int(f.AskVolume4), int(f.AskVolume5)}
+	return
+}
+
+// NewSimTick 从深度行情生成可录制的 SimTick
+func NewSimTick(f *thost.CThostFtdcDepthMarketDataField) *SimTick {
+	t := &SimTick{
+		InstrumentID:   f.InstrumentID.String(),
+		ExchangeID:     f.ExchangeID.String(),
+		TradingDay:     f.TradingDay.String(),
+		UpdateTime:     f.UpdateTime.String(),
+		UpdateMillisec: int(f.UpdateMillisec),
+		LocalTime:      time.Now().UnixMilli(),
+		LastPrice:      float64(f.LastPrice),
+		Volume:         int(f.Volume),
+		Turnover:       float64(f.Turnover),
+		OpenInterest:   float64(f.OpenInterest),
+	}
+	t.BidPrices, t.BidVolumes, t.AskPrices, t.AskVolumes = depthLevels(f)
+	return t
+}
+
+// ToDepthMarketData 转换为 CTP 深度行情结构
+func (t *SimTick) ToDepthMarketData() *thost.CThostFtdcDepthMarketDataField {
+	f := &thost.CThostFtdcDepthMarketDataField{}
+	copy(f.InstrumentID[:], t.InstrumentID)
+	copy(f.ExchangeID[:], t.ExchangeID)
+	copy(f.TradingDay[:], t.TradingDay)
+	copy(f.ActionDay[:], t.TradingDay)
+	copy(f.UpdateTime[:], t.UpdateTime)
+	f.UpdateMillisec = thost.TThostFtdcMillisecType(t.UpdateMillisec)
+	f.LastPrice = thost.TThostFtdcPriceType(t.LastPrice)
+	f.Volume = thost.TThostFtdcVolumeType(t.Volume)
+	f.Turnover = thost.TThostFtdcMoneyType(t.Turnover)
+	f.OpenInterest = thost.TThostFtdcLargeVolumeType(t.OpenInterest)
+
+	bp, bv, ap, av := t.BidPrices, t.BidVolumes, t.AskPrices, t.AskVolumes
+	f.BidPrice1, f.BidVolume1 = thost.TThostFtdcPriceType(bp[0]), thost.TThostFtdcVolumeType(bv[0])
+	f.BidPrice2, f.BidVolume2 = thost.TThostFtdcPriceType(bp[1]), thost.TThostFtdcVolumeType(bv[1])
+	f.BidPrice3, f.BidVolume3 = thost.TThostFtdcPriceType(bp[2]), thost.TThostFtdcVolumeType(bv[2])
+	f.BidPrice4, f.BidVolume4 = thost.TThostFtdcPriceType(bp[3]), thost.TThostFtdcVolumeType(bv[3])
+	f.BidPrice5, f.BidVolume5 = thost.TThostFtdcPriceType(bp[4]), thost.TThostFtdcVolumeType(bv[4])
+	f.AskPrice1, f.AskVolume1 = thost.TThostFtdcPriceType(ap[0]), thost.TThostFtdcVolumeType(av[0])
+	f.AskPrice2, f.AskVolume2 = thost.TThostFtdcPriceType(ap[1]), thost.TThostFtdcVolumeType(av[1])
+	f.AskPrice3, f.AskVolume3 = thost.TThostFtdcPriceType(ap[2]), thost.TThostFtdcVolumeType(av[2])
+	f.AskPrice4, f.AskVolume4 = thost.TThostFtdcPriceType(ap[3]), thost.TThostFtdcVolumeType(av[3])
+	f.AskPrice5, f.AskVolume5 = thost.TThostFtdcPriceType(ap[4]), thost.TThostFtdcVolumeType(av[4])
+	return f
+}
+
+// LoadSimTicks 读取 JSON Lines 格式的录制行情
+func LoadSimTicks(path string) ([]*SimTick, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("打开行情文件失败: %w", err)
+	}
+	defer file.Close()
+
+	var ticks []*SimTick
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var t SimTick
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			return nil, fmt.Errorf("解析行情文件第 %d 行失败: %w", line, err)
+		}
+		ticks = append(ticks, &t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("读取行情文件失败: %w", err)
+	}
+	return ticks, nil
+}
+
+// TickRecorder 将收到的深度行情以 JSON Lines 格式写入文件，供模拟前置回放
+type TickRecorder struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	enc  *json.Encoder
+}
+
+// NewTickRecorder 创建行情录制器，追加写入 path
+func NewTickRecorder(path string) (*TickRecorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("创建行情录制文件失败: %w", err)
+	}
+	w := bufio.NewWriter(file)
+	return &TickRecorder{file: file, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Record 写入一条深度行情
+func (r *TickRecorder) Record(f *thost.CThostFtdcDepthMarketDataField) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(NewSimTick(f)); err != nil {
+		ctpLog.Error("录制行情失败", "err", err)
+	}
+}
+
+// Flush 将缓冲写入文件
+func (r *TickRecorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// Close 刷新并关闭文件
+func (r *TickRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// SimOptions 配置模拟行情前置
+type SimOptions struct {
+	Ticks     []*SimTick    // 录制的行情，为空时生成合成行情
+	Speed     float64       // 回放倍速，<= 0 表示按 Interval 匀速回放
+	Loop      bool          // 回放结束后是否从头开始
+	Interval  time.Duration // 合成行情的推送间隔
+	BasePrice float64       // 合成行情的初始价格
+	TickSize  float64       // 合成行情的最小变动价位
+	Seed      int64         // 合成行情的随机种子
+	Trader    *SimTraderApi // 非空时用推送的行情撮合其中的模拟挂单
+}
+
+// SimMdApi 是 thost.MdApi 的本地模拟实现，无需网络即可驱动 MdSpi 回调。
+// 所有回调都在同一个 goroutine 中按顺序执行，与 CTP 的回调线程模型一致。
+type SimMdApi struct {
+	opts   SimOptions
+	spi    thost.MdSpi
+	fronts []string
+
+	mu         sync.Mutex
+	subscribed map[string]bool
+	books      map[string]*SimTick // 合成行情的当前状态
+	rng        *rand.Rand
+
+	events   chan func()
+	done     chan struct{}
+	initOnce sync.Once
+	stopOnce sync.Once
+}
+
+var _ thost.MdApi = &SimMdApi{}
+
+// NewSimMdApi 创建模拟行情 API
+func NewSimMdApi(opts SimOptions) *SimMdApi {
+	if opts.Interval <= 0 {
+		opts.Interval = 500 * time.Millisecond
+	}
+	if opts.BasePrice <= 0 {
+		opts.BasePrice = 5000
+	}
+	if opts.TickSize <= 0 {
+		opts.TickSize = 1
+	}
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	return &SimMdApi{
+		opts:       opts,
+		subscribed: make(map[string]bool),
+		books:      make(map[string]*SimTick),
+		rng:        rand.New(rand.NewSource(opts.Seed)),
+		events:     make(chan func(), 1024),
+		done:       make(chan struct{}),
+	}
+}
+
+// CreateSimMdCtp 创建连接模拟前置的 MdCtp，每次故障切换都会生成新的 SimMdApi
+func CreateSimMdCtp(userID, brokerID string, opts SimOptions) *MdCtp {
+	return newMdCtp(func() thost.MdApi {
+		return NewSimMdApi(opts)
+	}, userID, brokerID)
+}
+
+// post 将回调放入事件队列，API 释放后丢弃
+func (api *SimMdApi) post(fn func()) {
+	select {
+	case <-api.done:
+	case api.events <- fn:
+	}
+}
+
+func (api *SimMdApi) GetApiVersion() string { return "sim-1.0" }
+
+func (api *SimMdApi) Release() {
+	api.stopOnce.Do(func() { close(api.done) })
+}
+
+func (api *SimMdApi) Init() {
+	api.initOnce.Do(func() {
+		go api.dispatch()
+		api.post(func() { api.spi.OnFrontConnected() })
+		if len(api.opts.Ticks) > 0 {
+			go api.replay()
+		} else {
+			go api.synthesize()
+		}
+	})
+}
+
+func (api *SimMdApi) Join() int {
+	<-api.done
+	return 0
+}
+
+func (api *SimMdApi) GetTradingDay() string { return time.Now().Format("20060102") }
+
+func (api *SimMdApi) RegisterFront(frontAddress string) {
+	api.fronts = append(api.fronts, frontAddress)
+}
+
+func (api *SimMdApi) RegisterNameServer(nsAddress string) {}
+
+func (api *SimMdApi) RegisterFensUserInfo(pFensUserInfo *thost.CThostFtdcFensUserInfoField) {}
+
+func (api *SimMdApi) RegisterSpi(pSpi thost.MdSpi) { api.spi = pSpi }
+
+func (api *SimMdApi) SubscribeMarketData(instrumentIDs ...string) int {
+	api.mu.Lock()
+	for _, id := range instrumentIDs {
+		api.subscribed[id] = true
+	}
+	api.mu.Unlock()
+
+	for i, id := range instrumentIDs {
+		rsp := &thost.CThostFtdcSpecificInstrumentField{}
+		copy(rsp.InstrumentID[:], id)
+		isLast := i == len(instrumentIDs)-1
+		api.post(func() { api.spi.OnRspSubMarketData(rsp, &thost.CThostFtdcRspInfoField{}, 0, isLast) })
+	}
+	return 0
+}
+
+func (api *SimMdApi) UnSubscribeMarketData(instrumentIDs ...string) int {
+	api.mu.Lock()
+	for _, id := range instrumentIDs {
+		delete(api.subscribed, id)
+	}
+	api.mu.Unlock()
+
+	for i, id := range instrumentIDs {
+		rsp := &thost.CThostFtdcSpecificInstrumentField{}
+		copy(rsp.InstrumentID[:], id)
+		isLast := i == len(instrumentIDs)-1
+		api.post(func() { api.spi.OnRspUnSubMarketData(rsp, &thost.CThostFtdcRspInfoField{}, 0, isLast) })
+	}
+	return 0
+}
+
+func (api *SimMdApi) SubscribeForQuoteRsp(instrumentIDs ...string) int { return 0 }
+
+func (api *SimMdApi) UnSubscribeForQuoteRsp(instrumentIDs ...string) int { return 0 }
+
+func (api *SimMdApi) ReqUserLogin(pReqUserLoginField *thost.CThostFtdcReqUserLoginField, nRequestID int) int {
+	rsp := &thost.CThostFtdcRspUserLoginField{}
+	copy(rsp.TradingDay[:], api.GetTradingDay())
+	copy(rsp.LoginTime[:], time.Now().Format("15:04:05"))
+	rsp.BrokerID = pReqUserLoginField.BrokerID
+	rsp.UserID = pReqUserLoginField.UserID
+	copy(rsp.SystemName[:], "SimMdApi")
+	api.post(func() { api.spi.OnRspUserLogin(rsp, &thost.CThostFtdcRspInfoField{}, nRequestID, true) })
+	return 0
+}
+
+func (api *SimMdApi) ReqUserLogout(pUserLogout *thost.CThostFtdcUserLogoutField, nRequestID int) int {
+	rsp := *pUserLogout
+	api.post(func() { api.spi.OnRspUserLogout(&rsp, &thost.CThostFtdcRspInfoField{}, nRequestID, true) })
+	return 0
+}
+
+func (api *SimMdApi) ReqQryMulticastInstrument(pQryMulticastInstrument *thost.CThostFtdcQryMulticastInstrumentField, nRequestID int) int {
+	return 0
+}
+
+// dispatch 顺序执行回调
+func (api *SimMdApi) dispatch() {
+	for {
+		select {
+		case <-api.done:
+			return
+		case fn := <-api.events:
+			fn()
+		}
+	}
+}
+
+// isSubscribed 判断合约是否已订阅
+func (api *SimMdApi) isSubscribed(instrumentID string) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.subscribed[instrumentID]
+}
+
+// pushTick 推送一条行情
+func (api *SimMdApi) pushTick(t *SimTick) {
+	f := t.ToDepthMarketData()
+	api.post(func() { api.spi.OnRtnDepthMarketData(f) })
+	if api.opts.Trader != nil {
+		api.opts.Trader.MatchDepthMarketData(f)
+	}
+}
+
+// replay 按录制时的节奏回放行情，只推送已订阅的合约
+func (api *SimMdApi) replay() {
+	ticks := api.opts.Ticks
+	for {
+		for i, t := range ticks {
+			delay := api.opts.Interval
+			if api.opts.Speed > 0 && i > 0 && t.LocalTime > ticks[i-1].LocalTime {
+				delay = time.Duration(float64(t.LocalTime-ticks[i-1].LocalTime)/api.opts.Speed) * time.Millisecond
+			}
+			select {
+			case <-api.done:
+				return
+			case <-time.After(delay):
+			}
+			if api.isSubscribed(t.InstrumentID) {
+				api.pushTick(t)
+			}
+		}
+		if !api.opts.Loop {
+			ctpLog.Info("模拟前置: 行情回放结束", "ticks", len(ticks))
+			return
+		}
+	}
+}
+
+// synthesize 为每个已订阅合约生成随机游走的五档行情
+func (api *SimMdApi) synthesize() {
+	ticker := time.NewTicker(api.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-api.done:
+			return
+		case <-ticker.C:
+		}
+
+		api.mu.Lock()
+		var ticks []*SimTick
+		for id := range api.subscribed {
+			ticks = append(ticks, api.nextSyntheticTick(id))
+		}
+		api.mu.Unlock()
+
+		for _, t := range ticks {
+			api.pushTick(t)
+		}
+	}
+}
+
+// nextSyntheticTick 推进合约的合成盘口，调用方需持有 api.mu
+func (api *SimMdApi) nextSyntheticTick(instrumentID string) *SimTick {
+	tick := api.opts.TickSize
+	book, ok := api.books[instrumentID]
+	if !ok {
+		book = &SimTick{InstrumentID: instrumentID, LastPrice: api.opts.BasePrice}
+		bid := math.Floor(api.opts.BasePrice/tick) * tick
+		for i := 0; i < 5; i++ {
+			book.BidPrices[i] = bid - float64(i)*tick
+			book.AskPrices[i] = bid + float64(i+1)*tick
+			book.BidVolumes[i] = 10 + api.rng.Intn(200)
+			book.AskVolumes[i] = 10 + api.rng.Intn(200)
+		}
+		api.books[instrumentID] = book
+	}
+
+	// 价格偶尔移动一个最小变动价位
+	switch r := api.rng.Float64(); {
+	case r < 0.1:
+		api.shiftBook(book, tick)
+	case r < 0.2:
+		api.shiftBook(book, -tick)
+	}
+
+	// 各档数量随机增减，模拟挂单、撤单与成交
+	for i := 0; i < 5; i++ {
+		book.BidVolumes[i] = max(1, book.BidVolumes[i]+api.rng.Intn(21)-10)
+		book.AskVolumes[i] = max(1, book.AskVolumes[i]+api.rng.Intn(21)-10)
+	}
+	traded := api.rng.Intn(5)
+	book.Volume += traded
+	if traded > 0 {
+		book.LastPrice = book.BidPrices[0]
+		if api.rng.Intn(2) == 0 {
+			book.LastPrice = book.AskPrices[0]
+		}
+	}
+
+	now := time.Now()
+	book.TradingDay = now.Format("20060102")
+	book.UpdateTime = now.Format("15:04:05")
+	book.UpdateMillisec = now.Nanosecond() / int(time.Millisecond)
+	book.LocalTime = now.UnixMilli()
+
+	out := *book
+	return &out
+}
+
+// shiftBook 将整个盘口平移 delta，新出现的档位使用随机数量
+func (api *SimMdApi) shiftBook(book *SimTick, delta float64) {
+	tick := api.opts.TickSize
+	bid := book.BidPrices[0] + delta
+	up := delta > 0
+	for i := 0; i < 5; i++ {
+		book.BidPrices[i] = bid - float64(i)*tick
+		book.AskPrices[i] = bid + float64(i+1)*tick
+	}
+	if up {
+		// 买一为新档位，卖盘整体前移
+		copy(book.BidVolumes[1:], book.BidVolumes[:4])
+		book.BidVolumes[0] = 1 + api.rng.Intn(50)
+		copy(book.AskVolumes[:4], book.AskVolumes[1:])
+		book.AskVolumes[4] = 10 + api.rng.Intn(200)
+	} else {
+		copy(book.AskVolumes[1:], book.AskVolumes[:4])
+		book.AskVolumes[0] = 1 + api.rng.Intn(50)
+		copy(book.BidVolumes[:4], book.BidVolumes[1:])
+		book.BidVolumes[4] = 10 + api.rng.Intn(200)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// SimTraderApi 是本地模拟交易 API，实现 TraderQueryApi，用于离线运行和测试合约查询。
+// 它也接受限价报单，按模拟行情撮合，通过 OnRtnOrder/OnRtnTrade 回报，
+// 用于离线验证自有订单跟踪。
+type SimTraderApi struct {
+	spi         thost.TraderSpi
+	fronts      []string
+	instruments map[string]*thost.CThostFtdcInstrumentField
+	tickSize    float64 // 未登记的合约按此最小变动价位合成，<= 0 时视为不存在
+
+	orders    map[string]*simOrder                             // OrderSysID -> 挂单
+	depth     map[string]*thost.CThostFtdcDepthMarketDataField // 合约 -> 最新行情
+	nextSysID int
+	nextTrade int
+
+	mu       sync.Mutex
+	events   chan func()
+	done     chan struct{}
+	initOnce sync.Once
+	stopOnce sync.Once
+}
+
+var _ TraderQueryApi = &SimTraderApi{}
+
+// NewSimTraderApi 创建模拟交易 API，instruments 为预置的合约
+func NewSimTraderApi(tickSize float64, instruments ...Instrument) *SimTraderApi {
+	api := &SimTraderApi{
+		instruments: make(map[string]*thost.CThostFtdcInstrumentField),
+		tickSize:    tickSize,
+		orders:      make(map[string]*simOrder),
+		depth:       make(map[string]*thost.CThostFtdcDepthMarketDataField),
+		events:      make(chan func(), 1024),
+		done:        make(chan struct{}),
+	}
+	for i := range instruments {
+		api.AddInstrument(&instruments[i])
+	}
+	return api
+}
+
+// CreateSimTdCtp 创建连接模拟交易 API 的 TdCtp
+func CreateSimTdCtp(profile *CtpProfile, tickSize float64) *TdCtp {
+	return NewTdCtp(NewSimTraderApi(tickSize), profile)
+}
+
+// AddInstrument 登记一个可查询的合约
+func (api *SimTraderApi) AddInstrument(inst *Instrument) {
+	f := &thost.CThostFtdcInstrumentField{}
+	copy(f.InstrumentID[:], inst.InstrumentID)
+	copy(f.ExchangeID[:], inst.ExchangeID)
+	copy(f.ProductID[:], inst.ProductID)
+	copy(f.ExpireDate[:], inst.ExpireDate)
+	copy(f.UnderlyingInstrID[:], inst.UnderlyingInstrID)
+	f.PriceTick = thost.TThostFtdcPriceType(inst.PriceTick)
+	f.VolumeMultiple = thost.TThostFtdcVolumeMultipleType(inst.VolumeMultiple)
+	if inst.ProductClass != "" {
+		f.ProductClass = thost.TThostFtdcProductClassType(inst.ProductClass[0])
+	}
+	if inst.OptionsType != "" {
+		f.OptionsType = thost.TThostFtdcOptionsTypeType(inst.OptionsType[0])
+	}
+	if inst.StrikePrice != nil {
+		f.StrikePrice = thost.TThostFtdcPriceType(*inst.StrikePrice)
+	}
+
+	api.mu.Lock()
+	api.instruments[inst.InstrumentID] = f
+	api.mu.Unlock()
+}
+
+// lookup 查找合约，未登记时按 tickSize 合成期货合约
+func (api *SimTraderApi) lookup(instrumentID string) *thost.CThostFtdcInstrumentField {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if f, ok := api.instruments[instrumentID]; ok {
+		copied := *f
+		return &copied
+	}
+	if api.tickSize <= 0 || instrumentID == "" {
+		return nil
+	}
+	f := &thost.CThostFtdcInstrumentField{}
+	copy(f.InstrumentID[:], instrumentID)
+	copy(f.ExchangeID[:], "SIM")
+	copy(f.ProductID[:], ExtractContractPrefix(instrumentID))
+	f.ProductClass = thost.THOST_FTDC_PC_Futures
+	f.PriceTick = thost.TThostFtdcPriceType(api.tickSize)
+	f.VolumeMultiple = 1
+	return f
+}
+
+func (api *SimTraderApi) post(fn func()) {
+	select {
+	case <-api.done:
+	case api.events <- fn:
+	}
+}
+
+// dispatch 顺序执行回调
+func (api *SimTraderApi) dispatch() {
+	for {
+		select {
+		case <-api.done:
+			return
+		case fn := <-api.events:
+			fn()
+		}
+	}
+}
+
+func (api *SimTraderApi) Init() {
+	api.initOnce.Do(func() {
+		go api.dispatch()
+		api.post(func() { api.spi.OnFrontConnected() })
+	})
+}
+
+func (api *SimTraderApi) Release() {
+	api.stopOnce.Do(func() { close(api.done) })
+}
+
+func (api *SimTraderApi) RegisterFront(frontAddress string) {
+	api.fronts = append(api.fronts, frontAddress)
+}
+
+func (api *SimTraderApi) RegisterSpi(pSpi thost.TraderSpi) { api.spi = pSpi }
+
+func (api *SimTraderApi) SubscribePrivateTopic(nResumeType thost.THOST_TE_RESUME_TYPE) {}
+
+func (api *SimTraderApi) SubscribePublicTopic(nResumeType thost.THOST_TE_RESUME_TYPE) {}
+
+func (api *SimTraderApi) ReqAuthenticate(pReqAuthenticateField *thost.CThostFtdcReqAuthenticateField, nRequestID int) int {
+	rsp := &thost.CThostFtdcRspAuthenticateField{}
+	rsp.BrokerID = pReqAuthenticateField.BrokerID
+	rsp.UserID = pReqAuthenticateField.UserID
+	rsp.AppID = pReqAuthenticateField.AppID
+	api.post(func() { api.spi.OnRspAuthenticate(rsp, &thost.CThostFtdcRspInfoField{}, nRequestID, true) })
+	return 0
+}
+
+func (api *SimTraderApi) ReqUserLogin(pReqUserLoginField *thost.CThostFtdcReqUserLoginField, nRequestID int) int {
+	rsp := &thost.CThostFtdcRspUserLoginField{}
+	copy(rsp.TradingDay[:], time.Now().Format("20060102"))
+	copy(rsp.LoginTime[:], time.Now().Format("15:04:05"))
+	rsp.BrokerID = pReqUserLoginField.BrokerID
+	rsp.UserID = pReqUserLoginField.UserID
+	copy(rsp.SystemName[:], "SimTraderApi")
+	api.post(func() { api.spi.OnRspUserLogin(rsp, &thost.CThostFtdcRspInfoField{}, nRequestID, true) })
+	return 0
+}
+
+// ReqQryInstrument 按合约代码查询，与 CTP 一致：找不到时返回空结果
+func (api *SimTraderApi) ReqQryInstrument(pQryInstrument *thost.CThostFtdcQryInstrumentField, nRequestID int) int {
+	f := api.lookup(pQryInstrument.InstrumentID.String())
+	api.post(func() { api.spi.OnRspQryInstrument(f, &thost.CThostFtdcRspInfoField{}, nRequestID, true) })
+	return 0
+}
+
+// simOrder 是模拟撮合中的一笔挂单
+type simOrder struct {
+	field  thost.CThostFtdcOrderField
+	placed time.Time
+}
+
+// simFrontID 和 simSessionID 是模拟会话的标识
+const (
+	simFrontID   = 1
+	simSessionID = 1
+)
+
+// ReqOrderInsert 接受限价报单，立即回报“未成交还在队列中”，之后按行情撮合
+func (api *SimTraderApi) ReqOrderInsert(pInputOrder *thost.CThostFtdcInputOrderField, nRequestID int) int {
+	inst := api.lookup(pInputOrder.InstrumentID.String())
+	if inst == nil {
+		return -1
+	}
+	now := time.Now().In(exchangeLocation)
+
+	api.mu.Lock()
+	api.nextSysID++
+	order := &simOrder{placed: time.Now()}
+	f := &order.field
+	f.BrokerID = pInputOrder.BrokerID
+	f.InvestorID = pInputOrder.InvestorID
+	f.InstrumentID = pInputOrder.InstrumentID
+	f.OrderRef = pInputOrder.OrderRef
+	f.UserID = pInputOrder.UserID
+	f.OrderPriceType = pInputOrder.OrderPriceType
+	f.Direction = pInputOrder.Direction
+	f.CombOffsetFlag = pInputOrder.CombOffsetFlag
+	f.CombHedgeFlag = pInputOrder.CombHedgeFlag
+	f.LimitPrice = pInputOrder.LimitPrice
+	f.VolumeTotalOriginal = pInputOrder.VolumeTotalOriginal
+	f.TimeCondition = pInputOrder.TimeCondition
+	f.VolumeCondition = pInputOrder.VolumeCondition
+	f.RequestID = thost.TThostFtdcRequestIDType(nRequestID)
+	f.ExchangeID = inst.ExchangeID
+	copy(f.OrderSysID[:], fmt.Sprintf("%12d", api.nextSysID))
+	copy(f.TradingDay[:], now.Format("20060102"))
+	copy(f.InsertDate[:], now.Format("20060102"))
+	copy(f.InsertTime[:], now.Format("15:04:05"))
+	f.OrderSubmitStatus = thost.THOST_FTDC_OSS_Accepted
+	f.OrderStatus = thost.THOST_FTDC_OST_NoTradeQueueing
+	f.VolumeTotal = f.VolumeTotalOriginal
+	f.FrontID = simFrontID
+	f.SessionID = simSessionID
+	api.orders[f.OrderSysID.String()] = order
+	rtn := *f
+	api.mu.Unlock()
+
+	api.post(func() { api.spi.OnRtnOrder(&rtn) })
+	return 0
+}
+
+// ReqOrderAction 撤单，按 OrderSysID 或 FrontID/SessionID/OrderRef 查找挂单
+func (api *SimTraderApi) ReqOrderAction(pInputOrderAction *thost.CThostFtdcInputOrderActionField, nRequestID int) int {
+	api.mu.Lock()
+	var found *simOrder
+	sysID := strings.TrimSpace(pInputOrderAction.OrderSysID.String())
+	for _, order := range api.orders {
+		f := &order.field
+		if (sysID != "" && strings.TrimSpace(f.OrderSysID.String()) == sysID) ||
+			(sysID == "" && f.FrontID == pInputOrderAction.FrontID && f.SessionID == pInputOrderAction.SessionID &&
+				f.OrderRef == pInputOrderAction.OrderRef) {
+			found = order
+			break
+		}
+	}
+	if found == nil {
+		api.mu.Unlock()
+		rspInfo := &thost.CThostFtdcRspInfoField{ErrorID: 25}
+		copy(rspInfo.ErrorMsg[:], "CTP:撤单找不到相应报单")
+		action := *pInputOrderAction
+		api.post(func() { api.spi.OnRspOrderAction(&action, rspInfo, nRequestID, true) })
+		return 0
+	}
+	delete(api.orders, found.field.OrderSysID.String())
+	found.field.OrderStatus = thost.THOST_FTDC_OST_Canceled
+	copy(found.field.CancelTime[:], time.Now().In(exchangeLocation).Format("15:04:05"))
+	rtn := found.field
+	api.mu.Unlock()
+
+	api.post(func() { api.spi.OnRtnOrder(&rtn) })
+	return 0
+}
+
+// MatchDepthMarketData 用一条行情撮合挂单：对手价达到限价，或本方最优价越过限价
+// （该价位已被成交穿透）时，挂单按限价成交。多于 1 手的挂单首次撮合只成交一半，
+// 剩余部分继续排队，下次撮合时全部成交
+func (api *SimTraderApi) MatchDepthMarketData(f *thost.CThostFtdcDepthMarketDataField) {
+	instrumentID := f.InstrumentID.String()
+	bid1, ask1 := float64(f.BidPrice1), float64(f.AskPrice1)
+	now := time.Now().In(exchangeLocation)
+
+	api.mu.Lock()
+	copied := *f
+	api.depth[instrumentID] = &copied
+
+	var callbacks []func()
+	for sysID, order := range api.orders {
+		o := &order.field
+		if o.InstrumentID.String() != instrumentID {
+			continue
+		}
+		limit := float64(o.LimitPrice)
+		var filled bool
+		if o.Direction == thost.THOST_FTDC_D_Buy {
+			filled = (ask1 > 0 && ask1 <= limit) || (bid1 > 0 && bid1 < limit)
+		} else {
+			filled = (bid1 > 0 && bid1 >= limit) || (ask1 > 0 && ask1 > limit)
+		}
+		if !filled {
+			continue
+		}
+
+		api.nextTrade++
+		trade := &thost.CThostFtdcTradeField{}
+		trade.BrokerID = o.BrokerID
+		trade.InvestorID = o.InvestorID
+		trade.InstrumentID = o.InstrumentID
+		trade.OrderRef = o.OrderRef
+		trade.UserID = o.UserID
+		trade.ExchangeID = o.ExchangeID
+		copy(trade.TradeID[:], fmt.Sprintf("%12d", api.nextTrade))
+		trade.Direction = o.Direction
+		trade.OrderSysID = o.OrderSysID
+		trade.Price = o.LimitPrice
+		trade.Volume = o.VolumeTotal
+		if o.VolumeTraded == 0 && o.VolumeTotal > 1 {
+			trade.Volume = o.VolumeTotal / 2
+		}
+		trade.TradingDay = o.TradingDay
+		copy(trade.TradeDate[:], now.Format("20060102"))
+		copy(trade.TradeTime[:], now.Format("15:04:05"))
+
+		o.VolumeTraded += trade.Volume
+		o.VolumeTotal -= trade.Volume
+		if o.VolumeTotal > 0 {
+			o.OrderStatus = thost.THOST_FTDC_OST_PartTradedQueueing
+		} else {
+			o.OrderStatus = thost.THOST_FTDC_OST_AllTraded
+			delete(api.orders, sysID)
+		}
+		rtn := *o
+		callbacks = append(callbacks, func() {
+			api.spi.OnRtnOrder(&rtn)
+			api.spi.OnRtnTrade(trade)
+		})
+	}
+	api.mu.Unlock()
+
+	for _, fn := range callbacks {
+		api.post(fn)
+	}
+}
+
+// StartOrderFlow 每隔 interval 在有行情的合约上轮流于买一、卖一挂 1~3 手限价单，
+// 挂单超过 maxAge 未成交则撤单，为离线运行提供自有报单
+func (api *SimTraderApi) StartOrderFlow(interval, maxAge time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for n := 0; ; n++ {
+			select {
+			case <-api.done:
+				return
+			case <-ticker.C:
+			}
+
+			api.mu.Lock()
+			var inputs []*thost.CThostFtdcInputOrderField
+			for instrumentID, f := range api.depth {
+				in := &thost.CThostFtdcInputOrderField{}
+				copy(in.InstrumentID[:], instrumentID)
+				copy(in.OrderRef[:], fmt.Sprintf("%12d", n+1))
+				in.OrderPriceType = thost.THOST_FTDC_OPT_LimitPrice
+				in.CombOffsetFlag[0] = byte(thost.THOST_FTDC_OF_Open)
+				in.CombHedgeFlag[0] = byte(thost.THOST_FTDC_HF_Speculation)
+				in.TimeCondition = thost.THOST_FTDC_TC_GFD
+				in.VolumeCondition = thost.THOST_FTDC_VC_AV
+				in.VolumeTotalOriginal = thost.TThostFtdcVolumeType(1 + n%3)
+				if n%2 == 0 {
+					in.Direction = thost.THOST_FTDC_D_Buy
+					in.LimitPrice = f.BidPrice1
+				} else {
+					in.Direction = thost.THOST_FTDC_D_Sell
+					in.LimitPrice = f.AskPrice1
+				}
+				inputs = append(inputs, in)
+			}
+			var stale []*thost.CThostFtdcInputOrderActionField
+			for _, order := range api.orders {
+				if time.Since(order.placed) > maxAge {
+					action := &thost.CThostFtdcInputOrderActionField{}
+					action.ExchangeID = order.field.ExchangeID
+					action.OrderSysID = order.field.OrderSysID
+					action.ActionFlag = thost.THOST_FTDC_AF_Delete
+					stale = append(stale, action)
+				}
+			}
+			api.mu.Unlock()
+
+			for _, in := range inputs {
+				api.ReqOrderInsert(in, 0)
+			}
+			for _, action := range stale {
+				api.ReqOrderAction(action, 0)
+			}
+		}
+	}()
+}
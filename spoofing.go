@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Surveillance episode types, also used as alert types
+const (
+	AlertSpoofing = "spoofing" // Large order pulled just before the price reached it
+	AlertLayering = "layering" // Orders on several levels added and pulled together
+)
+
+const (
+	spoofMinTicks      = 2               // Ticks from the touch an order must rest to count as away
+	spoofMaxLife       = time.Minute     // Orders resting longer are not followed
+	spoofReachWindow   = 5 * time.Second // Time after a cancel within which the price must reach the level
+	spoofPruneInterval = time.Second     // How often expired orders are dropped
+	layerWindow        = time.Second     // Adds, or cancels, this close together belong to one layer
+	layerMinLevels     = 3               // Distinct levels that make a layer
+	surveillanceRecent = 256             // Episodes kept for GET /api/surveillance
+)
+
+var (
+	detectSpoofing = true // Run the spoofing and layering detector on new books
+	spoofZ         = 2.0  // Size z-score of an order that may be a spoof
+	layerZ         = 1.0  // Size z-score of each order of a layer
+	spoofMinScore  = 0.5  // Episodes scoring lower are not reported
+)
+
+// SpoofEpisode is a suspected spoofing or layering episode
+type SpoofEpisode struct {
+	Type        string            `json:"type"` // spoofing or layering
+	Symbol      string            `json:"symbol"`
+	Side        string            `json:"side"`
+	Prices      []decimal.Decimal `json:"prices"`
+	OrderIDs    []uint64          `json:"order_ids"`
+	Size        int64             `json:"size"`                 // Total lots pulled
+	AddedAt     int64             `json:"added_at"`             // Unix milliseconds of the first add
+	CancelledAt int64             `json:"cancelled_at"`         // Unix milliseconds of the last cancel
+	ReachedAt   int64             `json:"reached_at,omitempty"` // When the price reached the level, spoofing only
+	Distance    int64             `json:"distance"`             // Ticks from the touch when added, nearest order for layering
+	Score       float64           `json:"score"`                // 0..1
+}
+
+// watchedOrder is a large order resting away from the touch
+type watchedOrder struct {
+	id       uint64
+	bid      bool
+	tick     int64
+	qty      int64
+	z        float64
+	addedAt  int64
+	distance int64       // Ticks from the touch when added
+	spoof    bool        // Large enough to be a spoof on its own
+	layer    *layerGroup // Layer the order was added with, nil when none
+}
+
+// pulledOrder is a spoof candidate cancelled after the price moved toward it,
+// waiting to see whether the price reaches its level
+type pulledOrder struct {
+	*watchedOrder
+	cancelledAt int64
+	distance    int64 // Ticks from the touch when cancelled
+}
+
+// layerGroup is a set of orders added on one side within layerWindow
+type layerGroup struct {
+	bid       bool
+	firstAdd  int64
+	orders    []*watchedOrder
+	ticks     map[int64]bool
+	cancelled []*watchedOrder // In cancel order
+	cancelAt  []int64
+	reported  bool
+}
+
+// spoofDetector follows large orders away from the touch through their
+// inferred lifecycle
+type spoofDetector struct {
+	watched   map[uint64]*watchedOrder
+	pulled    []pulledOrder
+	forming   [2]*layerGroup // Latest layer per side, ask at 0 and bid at 1
+	lastPrune int64
+}
+
+func newSpoofDetector() *spoofDetector {
+	return &spoofDetector{watched: make(map[uint64]*watchedOrder)}
+}
+
+// ticksFromTouch returns how many ticks tick rests behind the best price of
+// its side; 0 or less means the price reached it
+func (ob *L3OrderBook) ticksFromTouch(bid bool, tick int64) (int64, bool) {
+	if bid {
+		if len(ob.bids.levels) == 0 {
+			return 0, false
+		}
+		return ob.bids.levels[0].tick - tick, true
+	}
+	if len(ob.asks.levels) == 0 {
+		return 0, false
+	}
+	return tick - ob.asks.levels[0].tick, true
+}
+
+func (d *spoofDetector) detect(ob *L3OrderBook, events []rawOrderEvent, scores []sizeScore) []Alert {
+	var out []Alert
+	for i, ev := range events {
+		switch {
+		case ev.kind == EventAdd && ev.rule != RuleResync:
+			d.added(ob, ev, scores[i])
+
+		case ev.kind == EventCancel || ev.kind == EventFill && !frontRule(ev.rule):
+			// The whole order left from inside the queue
+			if o := d.watched[ev.id]; o != nil {
+				delete(d.watched, ev.id)
+				if a, ok := d.cancelled(ob, o, ev.ts); ok {
+					out = append(out, a)
+				}
+			}
+
+		case ev.kind == EventFill || ev.kind == EventPartialFill && frontRule(ev.rule) || ev.kind == EventLevelCleared:
+			// Traded or swept, so it was a real order
+			delete(d.watched, ev.id)
+		}
+	}
+
+	now := ob.queues.clock()
+	out = append(out, d.reached(ob, now)...)
+	if now-d.lastPrune >= spoofPruneInterval.Milliseconds() {
+		d.prune(now)
+		d.lastPrune = now
+	}
+	return out
+}
+
+// added starts following a large order added away from the touch
+func (d *spoofDetector) added(ob *L3OrderBook, ev rawOrderEvent, score sizeScore) {
+	if !score.ready || score.z < layerZ {
+		return
+	}
+	distance, ok := ob.ticksFromTouch(ev.bid, ev.tick)
+	if !ok || distance < spoofMinTicks {
+		return
+	}
+	o := &watchedOrder{
+		id:       ev.id,
+		bid:      ev.bid,
+		tick:     ev.tick,
+		qty:      ev.qty,
+		z:        score.z,
+		addedAt:  ev.ts,
+		distance: distance,
+		spoof:    score.z >= spoofZ,
+	}
+	d.watched[ev.id] = o
+
+	side := 0
+	if ev.bid {
+		side = 1
+	}
+	g := d.forming[side]
+	if g == nil || ev.ts-g.firstAdd > layerWindow.Milliseconds() {
+		g = &layerGroup{bid: ev.bid, firstAdd: ev.ts, ticks: make(map[int64]bool)}
+		d.forming[side] = g
+	}
+	g.orders = append(g.orders, o)
+	g.ticks[ev.tick] = true
+	o.layer = g
+}
+
+// cancelled handles a watched order pulled from the book. A spoof candidate
+// the price moved toward waits to see whether the price reaches its level; a
+// layer is reported once enough of its levels were pulled together.
+func (d *spoofDetector) cancelled(ob *L3OrderBook, o *watchedOrder, now int64) (Alert, bool) {
+	if o.spoof {
+		if distance, ok := ob.ticksFromTouch(o.bid, o.tick); ok && distance < o.distance {
+			d.pulled = append(d.pulled, pulledOrder{watchedOrder: o, cancelledAt: now, distance: distance})
+		}
+	}
+
+	g := o.layer
+	if g == nil || g.reported || len(g.ticks) < layerMinLevels {
+		return Alert{}, false
+	}
+	g.cancelled = append(g.cancelled, o)
+	g.cancelAt = append(g.cancelAt, now)
+
+	// Levels pulled within layerWindow of this cancel
+	levels := make(map[int64]bool)
+	var pulled []*watchedOrder
+	for i, c := range g.cancelled {
+		if now-g.cancelAt[i] <= layerWindow.Milliseconds() {
+			levels[c.tick] = true
+			pulled = append(pulled, c)
+		}
+	}
+	if len(levels) < layerMinLevels {
+		return Alert{}, false
+	}
+
+	// Share of the layer pulled at once, how large its orders were and how
+	// briefly they rested
+	var z float64
+	nearest := pulled[0]
+	for _, c := range pulled {
+		z += c.z
+		if c.distance < nearest.distance {
+			nearest = c
+		}
+	}
+	share := float64(len(pulled)) / float64(len(g.orders))
+	size := 1 - math.Exp(-z/float64(len(pulled))/2)
+	brief := 1 - math.Min(1, float64(now-g.firstAdd)/float64(spoofMaxLife.Milliseconds()))
+	episode := ob.episode(AlertLayering, pulled, now, 0, nearest.distance, (share+size+brief)/3)
+	if episode.Score < spoofMinScore {
+		return Alert{}, false
+	}
+	g.reported = true
+	return ob.reportEpisode(episode, nearest), true
+}
+
+// reached reports pulled spoof candidates whose level the price has reached
+// and forgets those that waited too long
+func (d *spoofDetector) reached(ob *L3OrderBook, now int64) []Alert {
+	var out []Alert
+	kept := d.pulled[:0]
+	for _, p := range d.pulled {
+		distance, ok := ob.ticksFromTouch(p.bid, p.tick)
+		switch {
+		case ok && distance <= 0:
+			// How large the order was, how close the price came before it was
+			// pulled and how soon the price arrived afterwards
+			size := 1 - math.Exp(-p.z/2)
+			approach := 1 - float64(p.distance)/float64(p.watchedOrder.distance)
+			timing := 1 - float64(now-p.cancelledAt)/float64(spoofReachWindow.Milliseconds())
+			episode := ob.episode(AlertSpoofing, []*watchedOrder{p.watchedOrder}, p.cancelledAt, now, p.watchedOrder.distance, (size+approach+timing)/3)
+			if episode.Score >= spoofMinScore {
+				out = append(out, ob.reportEpisode(episode, p.watchedOrder))
+			}
+		case now-p.cancelledAt <= spoofReachWindow.Milliseconds():
+			kept = append(kept, p)
+		}
+	}
+	clear(d.pulled[len(kept):])
+	d.pulled = kept
+	return out
+}
+
+// prune stops following orders that rested too long to be spoofs
+func (d *spoofDetector) prune(now int64) {
+	for id, o := range d.watched {
+		if now-o.addedAt > spoofMaxLife.Milliseconds() {
+			delete(d.watched, id)
+		}
+	}
+	for i, g := range d.forming {
+		if g != nil && now-g.firstAdd > spoofMaxLife.Milliseconds() {
+			d.forming[i] = nil
+		}
+	}
+}
+
+// episode describes the pulled orders
+func (ob *L3OrderBook) episode(kind string, orders []*watchedOrder, cancelledAt, reachedAt, distance int64, score float64) SpoofEpisode {
+	side := "ask"
+	if orders[0].bid {
+		side = "bid"
+	}
+	ep := SpoofEpisode{
+		Type:        kind,
+		Symbol:      ob.symbol,
+		Side:        side,
+		AddedAt:     orders[0].addedAt,
+		CancelledAt: cancelledAt,
+		ReachedAt:   reachedAt,
+		Distance:    distance,
+		Score:       score,
+	}
+	for _, o := range orders {
+		ep.Prices = append(ep.Prices, ob.scale.price(o.tick))
+		ep.OrderIDs = append(ep.OrderIDs, o.id)
+		ep.Size += o.qty
+		if o.addedAt < ep.AddedAt {
+			ep.AddedAt = o.addedAt
+		}
+	}
+	return ep
+}
+
+// reportEpisode logs an episode for review and returns its alert
+func (ob *L3OrderBook) reportEpisode(ep SpoofEpisode, nearest *watchedOrder) Alert {
+	surveillance.Record(ep)
+
+	var message string
+	if ep.Type == AlertSpoofing {
+		message = fmt.Sprintf("%d lots added %d ticks from the touch, pulled %dms before the price reached it",
+			ep.Size, ep.Distance, ep.ReachedAt-ep.CancelledAt)
+	} else {
+		message = fmt.Sprintf("%d orders, %d lots on %d levels added and pulled together after %dms",
+			len(ep.OrderIDs), ep.Size, len(ep.Prices), ep.CancelledAt-ep.AddedAt)
+	}
+	return Alert{
+		Type:       ep.Type,
+		Symbol:     ep.Symbol,
+		Side:       ep.Side,
+		Price:      ob.scale.price(nearest.tick),
+		Size:       ep.Size,
+		Confidence: ep.Score,
+		OrderID:    nearest.id,
+		Timestamp:  ep.CancelledAt,
+		Message:    message,
+	}
+}
+
+// SurveillanceLog keeps recent episodes and appends all of them to an
+// optional review file as JSON lines
+type SurveillanceLog struct {
+	mu     sync.Mutex
+	recent []SpoofEpisode
+	file   *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+}
+
+// surveillance is the process-wide episode log
+var surveillance = &SurveillanceLog{}
+
+// Open appends episodes to path from now on
+func (l *SurveillanceLog) Open(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open surveillance log %s: %w", path, err)
+	}
+	l.mu.Lock()
+	l.file = file
+	l.w = bufio.NewWriter(file)
+	l.enc = json.NewEncoder(l.w)
+	l.mu.Unlock()
+	return nil
+}
+
+// Record keeps an episode and writes it to the review file
+func (l *SurveillanceLog) Record(ep SpoofEpisode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent = append(l.recent, ep)
+	if n := len(l.recent) - surveillanceRecent; n > 0 {
+		l.recent = append(l.recent[:0], l.recent[n:]...)
+	}
+	if l.enc != nil {
+		if err := l.enc.Encode(&ep); err != nil {
+			engineLog.Error("record surveillance episode failed", "err", err)
+		}
+	}
+}
+
+// Recent returns the latest episodes, oldest first
+func (l *SurveillanceLog) Recent() []SpoofEpisode {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]SpoofEpisode{}, l.recent...)
+}
+
+// Flush writes buffered episodes to the review file
+func (l *SurveillanceLog) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Flush()
+}
@@ -391,6 +391,7 @@ class L3OrderBookVisualizer {
     const connectionStatus = document.getElementById('connection-status');
     connectionStatus.textContent = 'Switching...';
     connectionStatus.style.color = '#ffaa00';
+    this.switching = true;
 
     // Send switch symbol message to backend
     if (this.ws && this.ws.readyState === WebSocket.OPEN) {
@@ -445,10 +446,23 @@ class L3OrderBookVisualizer {
             this.symbolSynced = true;
           }
 
-          // Update connection status
-          connectionStatus.textContent = 'Connected';
-          connectionStatus.style.color = '#00ff88';
+          // Update connection status, keeping switch progress visible
+          if (!this.switching) {
+            connectionStatus.textContent = 'Connected';
+            connectionStatus.style.color = '#00ff88';
+          }
+        } else if (message.type === 'switch_progress') {
+          const stages = {
+            subscribing: 'Subscribing',
+            subscribed: 'Subscribed, waiting for first tick',
+            first_tick: 'First tick received',
+            no_tick: 'No tick yet',
+            ready: 'Ready',
+          };
+          connectionStatus.textContent = `${message.symbol}: ${stages[message.stage] || message.stage}`;
+          connectionStatus.style.color = '#ffaa00';
         } else if (message.type === 'symbol_switched') {
+          this.switching = false;
           // Update UI to reflect successful symbol switch
           const tickerSelect = document.getElementById('ticker-select');
           tickerSelect.value = message.symbol;
@@ -473,6 +487,7 @@ class L3OrderBookVisualizer {
           this.precision = message.precision;
           this.updatePrecisionDisplay();
         } else if (message.type === 'error') {
+          this.switching = false;
           connectionStatus.textContent = 'Error: ' + message.message;
           connectionStatus.style.color = '#ff4444';
         }
@@ -523,6 +538,33 @@ class L3OrderBookVisualizer {
     return parseFloat(qty).toFixed(decimals);
   }
 
+  // Orders of a level to draw. Fill estimates are aligned with order_details,
+  // so those are used when both are present.
+  queueOrders(level) {
+    if (level.fill_estimate && level.order_details) {
+      return level.order_details.map((o) => ({ size: o.qty, id: o.id }));
+    }
+    return (level.orders || []).map((size, i) => ({
+      size,
+      id: level.order_ids && level.order_ids[i],
+    }));
+  }
+
+  // Label of an order in a queue, using its book-wide ID when the server sends one
+  orderLabel(order, orderIndex) {
+    return order.id ? `#${order.id}` : `${orderIndex + 1}`;
+  }
+
+  // Predicted fill of an order from the level's depletion rate, empty when unknown
+  fillLabel(level, orderIndex) {
+    const est = level.fill_estimate;
+    if (!est || !est.time_to_fill || est.time_to_fill[orderIndex] === undefined) return '';
+    const ttf = est.time_to_fill[orderIndex];
+    if (ttf < 0) return '';
+    const prob = Math.round(est.fill_prob[orderIndex] * 100);
+    return ` (fill ~${ttf.toFixed(1)}s, ${prob}% within ${est.horizon}s)`;
+  }
+
   renderChart() {
     if (!this.svg || !this.l3Data) return;
 
@@ -716,20 +758,19 @@ class L3OrderBookVisualizer {
         } orders (${this.formatQuantity(bid.total_size)} total)
                         </div>
                         <div class="queue-orders" style="margin-top: 4px;">
-                            ${bid.orders
+                            ${this.queueOrders(bid)
                               .map((order, orderIndex) => {
+                                const size = Number.parseFloat(order.size);
                                 const width = Math.max(
                                   4,
-                                  (Number.parseFloat(order) /
-                                    Number.parseFloat(bid.max_order)) *
-                                    120
+                                  (size / Number.parseFloat(bid.max_order)) * 120
                                 );
-                                const size = Number.parseFloat(order);
-                                return `<span class="order-bar" title="Order ${
-                                  orderIndex + 1
-                                }: ${size.toFixed(
+                                return `<span class="order-bar" title="Order ${this.orderLabel(
+                                  order,
+                                  orderIndex
+                                )}: ${size.toFixed(
                                   2
-                                )}" style="width: ${width}px; background: #00ff88; display: inline-block; height: 8px; margin: 1px; border-radius: 2px;"></span>`;
+                                )}${this.fillLabel(bid, orderIndex)}" style="width: ${width}px; background: #00ff88; display: inline-block; height: 8px; margin: 1px; border-radius: 2px;"></span>`;
                               })
                               .join('')}
                         </div>
@@ -749,20 +790,19 @@ class L3OrderBookVisualizer {
         } orders (${this.formatQuantity(ask.total_size)} total)
                         </div>
                         <div class="queue-orders" style="margin-top: 4px;">
-                            ${ask.orders
+                            ${this.queueOrders(ask)
                               .map((order, orderIndex) => {
+                                const size = Number.parseFloat(order.size);
                                 const width = Math.max(
                                   4,
-                                  (Number.parseFloat(order) /
-                                    Number.parseFloat(ask.max_order)) *
-                                    120
+                                  (size / Number.parseFloat(ask.max_order)) * 120
                                 );
-                                const size = Number.parseFloat(order);
-                                return `<span class="order-bar" title="Order ${
-                                  orderIndex + 1
-                                }: ${size.toFixed(
+                                return `<span class="order-bar" title="Order ${this.orderLabel(
+                                  order,
+                                  orderIndex
+                                )}: ${size.toFixed(
                                   2
-                                )}" style="width: ${width}px; background: #ff4444; display: inline-block; height: 8px; margin: 1px; border-radius: 2px;"></span>`;
+                                )}${this.fillLabel(ask, orderIndex)}" style="width: ${width}px; background: #ff4444; display: inline-block; height: 8px; margin: 1px; border-radius: 2px;"></span>`;
                               })
                               .join('')}
                         </div>
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// switchFirstTickTimeout bounds how long a switch waits for the new book's
+// first tick. Outside trading hours no tick arrives and the switch completes
+// with an empty book.
+var switchFirstTickTimeout = 5 * time.Second
+
+// Progress stages of a symbol switch, sent to clients as switch_progress
+const (
+	SwitchSubscribing = "subscribing" // Subscription request sent for the new symbol
+	SwitchSubscribed  = "subscribed"  // Subscription acknowledged by the front
+	SwitchFirstTick   = "first_tick"  // First tick applied to the new book
+	SwitchNoTick      = "no_tick"     // No tick within switchFirstTickTimeout
+	SwitchReady       = "ready"       // New book is active and the old one released
+)
+
+// switchSymbol hands the active book over to newSymbol, which may be
+// exchange-qualified (e.g. "SHFE.ag2510"). The new book is routed
+// and subscribed next to the old one, and becomes active once the front has
+// acknowledged the subscription and its first tick arrived. Only then is the
+// old subscription released, so neither book ever sees the other's ticks. On
+// failure the old book stays active. progress receives each stage and may be nil.
+func switchSymbol(newSymbol string, progress func(stage string)) error {
+	if progress == nil {
+		progress = func(string) {}
+	}
+
+	appState.switchMu.Lock()
+	defer appState.switchMu.Unlock()
+
+	old := appState.book.Load()
+	exchange, instrumentID := parseSymbol(newSymbol)
+	if old.Symbol() == instrumentID && (exchange == "" || exchange == old.Exchange()) {
+		return nil // Already on this symbol
+	}
+	if old.Symbol() == instrumentID {
+		// Same instrument on another exchange: the route and subscription
+		// are shared, so replace the book in place
+		next := NewBookActor(newSymbol)
+		appState.router.set(instrumentID, next)
+		appState.book.Store(next)
+		old.Stop()
+		syncTraderOrders()
+		progress(SwitchReady)
+		return nil
+	}
+
+	next := NewBookActor(newSymbol)
+	appState.router.set(instrumentID, next)
+	appState.mu.RLock()
+	md := appState.md
+	appState.mu.RUnlock()
+
+	// Before login there is nothing to hand off; connectCtpAsync subscribes
+	// the active symbol once logged in
+	live := md != nil && md.LoggedIn()
+	if live {
+		progress(SwitchSubscribing)
+		if err := md.SubscribeMarketData(instrumentID); err != nil {
+			appState.router.set(instrumentID, nil)
+			next.Stop()
+			return fmt.Errorf("subscribe %s: %w", newSymbol, err)
+		}
+		progress(SwitchSubscribed)
+
+		select {
+		case <-next.FirstTick():
+			progress(SwitchFirstTick)
+		case <-time.After(switchFirstTickTimeout):
+			engineLog.Warn("no tick before switching", "symbol", newSymbol, "timeout", switchFirstTickTimeout)
+			progress(SwitchNoTick)
+		}
+	}
+
+	appState.mu.Lock()
+	appState.book.Store(next)
+	appState.currentSymbol = instrumentID
+	appState.mu.Unlock()
+	appState.router.set(old.Symbol(), nil)
+	old.Stop()
+
+	if live {
+		if err := md.UnsubscribeMarketData(old.Symbol()); err != nil {
+			ctpLog.Warn("取消订阅失败", "symbol", old.Symbol(), "err", err)
+		}
+	}
+	syncTraderOrders()
+	progress(SwitchReady)
+	return nil
+}
+
+// syncTraderOrders places our live orders in the new book
+func syncTraderOrders() {
+	if traderOrders != nil {
+		traderOrders.Sync()
+	}
+}
+
+// subscribeActiveSymbol subscribes the symbol of the active book. It holds the
+// switch lock so it cannot interleave with a hand-off.
+func subscribeActiveSymbol(md *MdCtp) error {
+	appState.switchMu.Lock()
+	defer appState.switchMu.Unlock()
+	return md.SubscribeMarketData(appState.book.Load().Symbol())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// newSwitchTest routes the book of "test" as the active one and connects a
+// simulated front feeding the router when opts is not nil. Books the switch
+// creates are stopped at the end of the test.
+func newSwitchTest(t *testing.T, opts *SimOptions) (*BookActor, *SimMdApi) {
+	t.Helper()
+	old := newTestActor(t)
+	appState.book.Store(old)
+	appState.currentSymbol = old.Symbol()
+	t.Cleanup(func() { appState.book.Load().Stop() })
+	if opts == nil {
+		return old, nil
+	}
+
+	md := CreateSimMdCtp("u1", "9999", *opts)
+	md.RspTimeout = time.Second
+	router := &appState.router
+	md.OnRtnDepthMarketDataCallback = func(f *thost.CThostFtdcDepthMarketDataField) { router.dispatch(f) }
+	if err := md.Connect("sim://a"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(md.Release)
+	if err := md.Login(); err != nil {
+		t.Fatal(err)
+	}
+	if err := md.SubscribeMarketData(old.Symbol()); err != nil {
+		t.Fatal(err)
+	}
+	appState.md = md
+	return old, md.api().(*SimMdApi)
+}
+
+// switchStages switches to symbol and returns the progress stages
+func switchStages(t *testing.T, symbol string) []string {
+	t.Helper()
+	var stages []string
+	if err := switchSymbol(symbol, func(stage string) { stages = append(stages, stage) }); err != nil {
+		t.Fatal(err)
+	}
+	return stages
+}
+
+func TestSwitchSymbolOffline(t *testing.T) {
+	tests := []struct {
+		symbol, wantSymbol, wantExchange string
+		wantStages                       []string
+		replaced                         bool
+	}{
+		{"test", "test", "", nil, false},
+		{"SHFE.test", "test", "SHFE", []string{SwitchReady}, true}, // Same instrument, replaced in place
+		{"au2510", "au2510", "", []string{SwitchReady}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.symbol, func(t *testing.T) {
+			old, _ := newSwitchTest(t, nil)
+			stages := switchStages(t, tt.symbol)
+			if !slices.Equal(stages, tt.wantStages) {
+				t.Errorf("stages %v, want %v", stages, tt.wantStages)
+			}
+			book := appState.book.Load()
+			if book.Symbol() != tt.wantSymbol || book.Exchange() != tt.wantExchange {
+				t.Errorf("active book %s, want %s.%s", book.QualifiedSymbol(), tt.wantExchange, tt.wantSymbol)
+			}
+			if replaced := book != old; replaced != tt.replaced {
+				t.Errorf("book replaced %v, want %v", replaced, tt.replaced)
+			}
+			if tt.replaced && old.Do(func(*L3OrderBook) {}) {
+				t.Error("old book still running")
+			}
+			if routes := appState.router.Stats().Routes; !slices.Equal(routes, []string{book.QualifiedSymbol()}) {
+				t.Errorf("routes %v, want only the active book", routes)
+			}
+		})
+	}
+}
+
+func TestSwitchSymbolHandOff(t *testing.T) {
+	old, api := newSwitchTest(t, &SimOptions{Interval: 5 * time.Millisecond, BasePrice: 600, TickSize: 0.02, Seed: 1})
+
+	stages := switchStages(t, "au2510")
+	want := []string{SwitchSubscribing, SwitchSubscribed, SwitchFirstTick, SwitchReady}
+	if !slices.Equal(stages, want) {
+		t.Errorf("stages %v, want %v", stages, want)
+	}
+	book := appState.book.Load()
+	if book.Symbol() != "au2510" || appState.currentSymbol != "au2510" {
+		t.Fatalf("active book %s, current symbol %s", book.Symbol(), appState.currentSymbol)
+	}
+	if len(book.Snapshot().Bids) == 0 {
+		t.Error("first tick missing from the new book")
+	}
+	if old.Do(func(*L3OrderBook) {}) {
+		t.Error("old book still running")
+	}
+	if appState.router.book("test") != nil || appState.router.book("au2510") != book {
+		t.Errorf("routes %v after the switch", appState.router.Stats().Routes)
+	}
+	if api.isSubscribed("test") || !api.isSubscribed("au2510") {
+		t.Error("old subscription not released for the new one")
+	}
+}
+
+func TestSwitchSymbolNoTick(t *testing.T) {
+	timeout := switchFirstTickTimeout
+	switchFirstTickTimeout = 20 * time.Millisecond
+	t.Cleanup(func() { switchFirstTickTimeout = timeout })
+	// Replays a single tick of another instrument, so the front acknowledges
+	// the subscription but never sends a tick, as outside trading hours
+	newSwitchTest(t, &SimOptions{Ticks: []*SimTick{{InstrumentID: "other"}}, Interval: time.Millisecond})
+
+	stages := switchStages(t, "au2510")
+	want := []string{SwitchSubscribing, SwitchSubscribed, SwitchNoTick, SwitchReady}
+	if !slices.Equal(stages, want) {
+		t.Errorf("stages %v, want %v", stages, want)
+	}
+	book := appState.book.Load()
+	if book.Symbol() != "au2510" || len(book.Snapshot().Bids) != 0 {
+		t.Errorf("active book %s with %d bids, want an empty au2510", book.Symbol(), len(book.Snapshot().Bids))
+	}
+}
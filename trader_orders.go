@@ -0,0 +1,259 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// traderOrders is set when own orders are taken from the CTP trader API
+var traderOrders *TraderOrderBridge
+
+// maxForgottenOrders bounds the keys of finished orders kept to drop replays
+const maxForgottenOrders = 4096
+
+// TraderOrderBridge places the live orders reported by the CTP trader API
+// (OnRtnOrder) in the reconstructed queues and feeds our trades (OnRtnTrade)
+// back as ground-truth fills. Orders are keyed by exchange and OrderSysID,
+// which both callbacks carry.
+//
+// The books are updated after b.mu is released, so a busy book actor does not
+// hold up other callbacks. apply keeps the updates in the order they were
+// decided in.
+type TraderOrderBridge struct {
+	mu        sync.Mutex
+	apply     sync.Mutex              // Taken before mu is released, while running actions
+	attached  bool                    // Books exist; set once the app state is ready
+	orders    map[string]*traderOrder // "EXCHANGE.OrderSysID" -> order
+	trades    map[string]struct{}     // Trades already counted, resumed streams replay them
+	forgotten map[string]struct{}     // Finished orders dropped from orders
+	forgetLog []string                // Keys of forgotten, oldest first
+}
+
+// bookAction is a book update decided under b.mu
+type bookAction struct {
+	book *BookActor
+	fn   func(ob *L3OrderBook)
+}
+
+// traderOrder is the latest known state of one of our exchange orders
+type traderOrder struct {
+	instrumentID string
+	bid          bool
+	price        float64
+	qty          int64    // VolumeTotalOriginal, 0 until the order itself was reported
+	reported     int64    // VolumeTraded of the latest order report
+	tradeSum     int64    // Volume of our trades seen so far
+	traded       int64    // Highest of reported and tradeSum; both count the same fills
+	tradeKeys    []string // Keys of the counted trades, dropped with the order
+	finished     bool     // No longer queueing, kept until its trades are in
+	insertedAt   int64    // Unix milliseconds
+	ref          string   // OrderRef
+	status       thost.TThostFtdcOrderStatusType
+
+	book    *BookActor // Book tracking the order, nil until registered
+	id      uint64     // Own order ID in book
+	applied int64      // Traded volume already applied to book
+}
+
+// NewTraderOrderBridge creates a bridge that holds orders until Attach
+func NewTraderOrderBridge() *TraderOrderBridge {
+	return &TraderOrderBridge{
+		orders:    make(map[string]*traderOrder),
+		trades:    make(map[string]struct{}),
+		forgotten: make(map[string]struct{}),
+	}
+}
+
+// Attach starts placing orders in the routed books. Orders reported before,
+// such as those replayed at login, are placed now.
+func (b *TraderOrderBridge) Attach() {
+	b.mu.Lock()
+	b.attached = true
+	b.run(b.sync())
+}
+
+// Sync places orders whose instrument gained a book, e.g. after a symbol switch
+func (b *TraderOrderBridge) Sync() {
+	b.mu.Lock()
+	b.run(b.sync())
+}
+
+// run releases b.mu and applies actions. Must hold b.mu.
+func (b *TraderOrderBridge) run(actions []bookAction) {
+	b.apply.Lock()
+	defer b.apply.Unlock()
+	b.mu.Unlock()
+	for _, a := range actions {
+		a.book.Do(a.fn)
+	}
+}
+
+// orderKey identifies an exchange order; SHFE pads OrderSysID with spaces
+func orderKey(exchangeID, orderSysID string) string {
+	return exchangeID + "." + strings.TrimSpace(orderSysID)
+}
+
+// OnRtnOrder records an order report. Orders without an OrderSysID have not
+// reached the exchange yet and are skipped until they do.
+func (b *TraderOrderBridge) OnRtnOrder(f *thost.CThostFtdcOrderField) {
+	sysID := strings.TrimSpace(f.OrderSysID.String())
+	if sysID == "" {
+		return
+	}
+	key := orderKey(f.ExchangeID.String(), sysID)
+
+	b.mu.Lock()
+	if _, done := b.forgotten[key]; done {
+		b.mu.Unlock()
+		return // Replayed after the order finished
+	}
+	o := b.orders[key]
+	if o == nil {
+		o = &traderOrder{}
+		b.orders[key] = o
+	}
+	o.instrumentID = f.InstrumentID.String()
+	o.bid = f.Direction == thost.THOST_FTDC_D_Buy
+	o.price = float64(f.LimitPrice)
+	o.qty = int64(f.VolumeTotalOriginal)
+	o.reported = max64(o.reported, int64(f.VolumeTraded))
+	o.traded = max64(o.reported, o.tradeSum)
+	o.ref = strings.TrimSpace(f.OrderRef.String())
+	o.status = f.OrderStatus
+	if t, err := time.ParseInLocation("20060102 15:04:05", f.InsertDate.String()+" "+f.InsertTime.String(), exchangeLocation); err == nil {
+		o.insertedAt = t.UnixMilli()
+	}
+	b.run(b.syncOrder(key, o, nil))
+}
+
+// OnRtnTrade records one of our trades
+func (b *TraderOrderBridge) OnRtnTrade(f *thost.CThostFtdcTradeField) {
+	key := orderKey(f.ExchangeID.String(), f.OrderSysID.String())
+	tradeKey := key + "#" + strings.TrimSpace(f.TradeID.String()) + string(rune(f.Direction))
+
+	b.mu.Lock()
+	if _, seen := b.trades[tradeKey]; seen {
+		b.mu.Unlock()
+		return
+	}
+	if _, done := b.forgotten[key]; done {
+		b.mu.Unlock()
+		return // Counted before the order was forgotten
+	}
+	b.trades[tradeKey] = struct{}{}
+
+	o := b.orders[key]
+	if o == nil {
+		// The trade overtook its order report
+		o = &traderOrder{}
+		b.orders[key] = o
+	}
+	o.tradeKeys = append(o.tradeKeys, tradeKey)
+	o.tradeSum += int64(f.Volume)
+	o.traded = max64(o.reported, o.tradeSum)
+	b.run(b.syncOrder(key, o, nil))
+}
+
+// sync brings the books in line with all known orders and returns the book
+// updates to run. Must hold b.mu.
+func (b *TraderOrderBridge) sync() []bookAction {
+	var actions []bookAction
+	for key, o := range b.orders {
+		actions = b.syncOrder(key, o, actions)
+	}
+	return actions
+}
+
+// syncOrder brings the books in line with order o, appending the book updates
+// to run to actions. Must hold b.mu.
+func (b *TraderOrderBridge) syncOrder(key string, o *traderOrder, actions []bookAction) []bookAction {
+	if !b.attached || o.qty == 0 {
+		return actions // Only trades seen so far
+	}
+	if o.finished {
+		b.forgetFinished(key, o)
+		return actions
+	}
+	if o.book != nil && appState.router.book(o.instrumentID) != o.book {
+		// The book was replaced, its own orders went with it
+		o.book, o.id, o.applied = nil, 0, 0
+	}
+
+	queueing := o.status == thost.THOST_FTDC_OST_NoTradeQueueing || o.status == thost.THOST_FTDC_OST_PartTradedQueueing
+	if o.book == nil && queueing && o.traded < o.qty {
+		actions = b.register(o, actions)
+	}
+	if o.book != nil && o.traded > o.applied {
+		id, traded := o.id, o.traded
+		actions = append(actions, bookAction{o.book, func(ob *L3OrderBook) { ob.AnchorOwnFill(id, traded) }})
+		o.applied = traded
+	}
+
+	if queueing && o.traded < o.qty {
+		return actions
+	}
+	// Filled, cancelled or no longer queueing
+	if o.book != nil && o.traded < o.qty {
+		id := o.id
+		actions = append(actions, bookAction{o.book, func(ob *L3OrderBook) { ob.CancelOwnOrder(id) }})
+	}
+	o.book, o.id = nil, 0
+	o.finished = true
+	b.forgetFinished(key, o)
+	return actions
+}
+
+// forgetFinished drops a finished order once the trades behind its reported
+// volume are in, so trades following the final order report still find it.
+// Must hold b.mu.
+func (b *TraderOrderBridge) forgetFinished(key string, o *traderOrder) {
+	if o.tradeSum < o.reported {
+		return
+	}
+	for _, tradeKey := range o.tradeKeys {
+		delete(b.trades, tradeKey)
+	}
+	delete(b.orders, key)
+
+	b.forgotten[key] = struct{}{}
+	b.forgetLog = append(b.forgetLog, key)
+	if len(b.forgetLog) > maxForgottenOrders {
+		delete(b.forgotten, b.forgetLog[0])
+		b.forgetLog = b.forgetLog[1:]
+	}
+}
+
+// register places an order in the book of its instrument. The order takes
+// its book ID now, so later updates can refer to it before the book has it.
+// Must hold b.mu.
+func (b *TraderOrderBridge) register(o *traderOrder, actions []bookAction) []bookAction {
+	book := appState.router.book(o.instrumentID)
+	if book == nil {
+		return actions
+	}
+	req := OwnOrderRequest{
+		Symbol:     o.instrumentID,
+		Side:       "ask",
+		Price:      strconv.FormatFloat(o.price, 'f', -1, 64),
+		Qty:        o.qty,
+		Filled:     o.traded,
+		SubmitTime: strconv.FormatInt(o.insertedAt, 10),
+		Ref:        o.ref,
+		source:     OwnSourceTrader,
+		id:         orderIDs.Next(),
+	}
+	if o.bid {
+		req.Side = "bid"
+	}
+	o.book, o.id, o.applied = book, req.id, o.traded
+
+	return append(actions, bookAction{book, func(ob *L3OrderBook) {
+		if _, err := ob.RegisterOwnOrder(req); err != nil {
+			ctpLog.Warn("跟踪报单失败", "instrument", req.Symbol, "side", req.Side, "price", req.Price, "err", err)
+		}
+	}})
+}
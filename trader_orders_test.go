@@ -0,0 +1,179 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+func testOrderReport(qty, traded int, status thost.TThostFtdcOrderStatusType) *thost.CThostFtdcOrderField {
+	f := &thost.CThostFtdcOrderField{}
+	copy(f.InstrumentID[:], "test")
+	copy(f.ExchangeID[:], "SHFE")
+	copy(f.OrderSysID[:], "      1")
+	f.Direction = thost.THOST_FTDC_D_Buy
+	f.LimitPrice = 100
+	f.VolumeTotalOriginal = thost.TThostFtdcVolumeType(qty)
+	f.VolumeTraded = thost.TThostFtdcVolumeType(traded)
+	f.OrderStatus = status
+	return f
+}
+
+func testTrade(id string, volume int) *thost.CThostFtdcTradeField {
+	f := &thost.CThostFtdcTradeField{}
+	copy(f.ExchangeID[:], "SHFE")
+	copy(f.OrderSysID[:], "      1")
+	copy(f.TradeID[:], id)
+	f.Direction = thost.THOST_FTDC_D_Buy
+	f.Volume = thost.TThostFtdcVolumeType(volume)
+	return f
+}
+
+func TestTraderOrderBridgeTraded(t *testing.T) {
+	partial := thost.THOST_FTDC_OST_PartTradedQueueing
+	tests := []struct {
+		name   string
+		events []any // Order reports and trades in arrival order
+		traded int64
+	}{
+		{"order before trade", []any{testOrderReport(10, 2, partial), testTrade("t1", 2)}, 2},
+		{"trade before order", []any{testTrade("t1", 2), testOrderReport(10, 2, partial)}, 2},
+		{"replayed trade", []any{testTrade("t1", 2), testTrade("t1", 2), testOrderReport(10, 2, partial)}, 2},
+		{"trade ahead of report", []any{testOrderReport(10, 2, partial), testTrade("t1", 2), testTrade("t2", 3)}, 5},
+		{"two partial fills", []any{
+			testOrderReport(10, 2, partial), testTrade("t1", 2),
+			testOrderReport(10, 5, partial), testTrade("t2", 3),
+		}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewTraderOrderBridge()
+			for _, ev := range tt.events {
+				switch f := ev.(type) {
+				case *thost.CThostFtdcOrderField:
+					b.OnRtnOrder(f)
+				case *thost.CThostFtdcTradeField:
+					b.OnRtnTrade(f)
+				}
+			}
+			o := b.orders["SHFE.1"]
+			if o == nil {
+				t.Fatal("order not tracked")
+			}
+			if o.traded != tt.traded {
+				t.Errorf("traded = %d, want %d", o.traded, tt.traded)
+			}
+		})
+	}
+}
+
+func TestTraderOrderBridgePartialFill(t *testing.T) {
+	a := newTestActor(t)
+	a.Do(func(ob *L3OrderBook) { ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: 20}}) })
+
+	b := NewTraderOrderBridge()
+	b.Attach()
+	b.OnRtnOrder(testOrderReport(10, 0, thost.THOST_FTDC_OST_NoTradeQueueing))
+	own := func() (OwnOrderStatus, int64) {
+		var status OwnOrderStatus
+		var levelQty int64
+		a.Do(func(ob *L3OrderBook) {
+			status = ob.OwnOrders()[0]
+			level, _ := ob.bids.get(100)
+			levelQty = level.enhanced.GetTotalQty()
+		})
+		return status, levelQty
+	}
+	if status, _ := own(); status.State != OwnQueued || status.VolumeAhead != 10 {
+		t.Fatalf("registered as %s with %d ahead, want queued behind 10", status.State, status.VolumeAhead)
+	}
+
+	// CTP reports the order before the trade behind it
+	b.OnRtnOrder(testOrderReport(10, 2, thost.THOST_FTDC_OST_PartTradedQueueing))
+	b.OnRtnTrade(testTrade("t1", 2))
+	status, levelQty := own()
+	if status.Filled != 2 || levelQty != 8 {
+		t.Errorf("after 2 traded: filled %d with %d left at the level, want 2 and 8", status.Filled, levelQty)
+	}
+
+	b.OnRtnOrder(testOrderReport(10, 10, thost.THOST_FTDC_OST_AllTraded))
+	if len(b.orders) != 1 {
+		t.Fatal("filled order dropped before its trades arrived")
+	}
+	b.OnRtnTrade(testTrade("t2", 8))
+	if len(b.orders) != 0 || len(b.trades) != 0 {
+		t.Errorf("finished order left %d orders and %d trades behind", len(b.orders), len(b.trades))
+	}
+}
+
+func TestTraderOrderBridgeReplayAfterFinish(t *testing.T) {
+	b := NewTraderOrderBridge()
+	b.Attach()
+	b.OnRtnOrder(testOrderReport(10, 10, thost.THOST_FTDC_OST_AllTraded))
+	b.OnRtnTrade(testTrade("t1", 10))
+	if len(b.orders) != 0 {
+		t.Fatal("finished order kept")
+	}
+
+	// A reconnect replays the day's order reports and trades
+	b.OnRtnTrade(testTrade("t1", 10))
+	b.OnRtnOrder(testOrderReport(10, 10, thost.THOST_FTDC_OST_AllTraded))
+	if len(b.orders) != 0 || len(b.trades) != 0 {
+		t.Errorf("replay left %d orders and %d trades behind", len(b.orders), len(b.trades))
+	}
+
+	for i := range maxForgottenOrders + 10 {
+		b.forgetFinished(strconv.Itoa(i), &traderOrder{})
+	}
+	if len(b.forgotten) != maxForgottenOrders || len(b.forgetLog) != maxForgottenOrders {
+		t.Errorf("kept %d forgotten keys, want %d", len(b.forgotten), maxForgottenOrders)
+	}
+}
+
+func TestTraderOrderBridgeBusyBook(t *testing.T) {
+	a := newTestActor(t)
+	a.Do(func(ob *L3OrderBook) { ob.applyLevels(ob.bids, []depthLevel{{tick: 100, qty: 20}}) })
+	b := NewTraderOrderBridge()
+	b.Attach()
+
+	// Hold the actor so the registration waits for it
+	held, release := make(chan struct{}), make(chan struct{})
+	go a.Do(func(*L3OrderBook) {
+		close(held)
+		<-release
+	})
+	<-held
+	done := make(chan struct{})
+	go func() {
+		b.OnRtnOrder(testOrderReport(10, 0, thost.THOST_FTDC_OST_NoTradeQueueing))
+		close(done)
+	}()
+	for {
+		b.mu.Lock()
+		registered := len(b.orders) == 1 && b.orders["SHFE.1"].book != nil
+		b.mu.Unlock()
+		if registered {
+			break
+		}
+		runtime.Gosched()
+	}
+	select {
+	case <-done:
+		t.Fatal("registration did not wait for the book")
+	default:
+	}
+	close(release)
+	<-done
+
+	var states []string
+	a.Do(func(ob *L3OrderBook) {
+		for _, o := range ob.OwnOrders() {
+			states = append(states, o.State)
+		}
+	})
+	if len(states) != 1 || states[0] != OwnQueued {
+		t.Errorf("own orders %v, want one queued", states)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pseudocodes/go2ctp/ctp"
+	"github.com/pseudocodes/go2ctp/thost"
+)
+
+// TraderQueryApi 是 TdCtp 使用的 thost.TraderApi 子集，便于用本地替身测试
+type TraderQueryApi interface {
+	Init()
+	Release()
+	RegisterFront(frontAddress string)
+	RegisterSpi(spi thost.TraderSpi)
+	SubscribePrivateTopic(nResumeType thost.THOST_TE_RESUME_TYPE)
+	SubscribePublicTopic(nResumeType thost.THOST_TE_RESUME_TYPE)
+	ReqAuthenticate(pReqAuthenticateField *thost.CThostFtdcReqAuthenticateField, nRequestID int) int
+	ReqUserLogin(pReqUserLoginField *thost.CThostFtdcReqUserLoginField, nRequestID int) int
+	ReqQryInstrument(pQryInstrument *thost.CThostFtdcQryInstrumentField, nRequestID int) int
+}
+
+var _ TraderQueryApi = thost.TraderApi(nil)
+
+// InstrumentQuerier 按合约代码查询权威的合约信息
+type InstrumentQuerier interface {
+	QueryInstrument(instrumentID string) (*Instrument, error)
+}
+
+// TdCtp 封装交易 API，用于查询合约信息
+type TdCtp struct {
+	ctp.BaseTraderSpi
+	BrokerID   string
+	UserID     string
+	Password   string
+	AppID      string
+	AuthCode   string
+	RspTimeout time.Duration // 等待异步应答的超时时间
+	tdapi      TraderQueryApi
+
+	// 报单和成交回报回调，在 CTP 回调线程中执行，参数为副本
+	OnRtnOrderCallback func(order *thost.CThostFtdcOrderField)
+	OnRtnTradeCallback func(trade *thost.CThostFtdcTradeField)
+
+	requestID   atomic.Int32
+	queryMu     sync.Mutex // CTP 查询有流控，串行发送
+	mu          sync.Mutex
+	connectF    *rspFuture
+	pending     map[int]*rspFuture                         // nRequestID -> 请求
+	instruments map[int][]*thost.CThostFtdcInstrumentField // nRequestID -> 查询结果
+}
+
+var _ thost.TraderSpi = &TdCtp{}
+var _ InstrumentQuerier = &TdCtp{}
+
+// CreateTdCtpFromProfile 根据配置档案创建 TdCtp
+func CreateTdCtpFromProfile(profile *CtpProfile) *TdCtp {
+	flowPath := filepath.Join(profile.FlowPath, "td") + "/"
+	tdapi := ctp.CreateTraderApi(ctp.TraderFlowPath(flowPath))
+	return NewTdCtp(tdapi, profile)
+}
+
+// NewTdCtp 使用指定的交易 API 创建 TdCtp
+func NewTdCtp(tdapi TraderQueryApi, profile *CtpProfile) *TdCtp {
+	return &TdCtp{
+		BrokerID:    profile.BrokerID,
+		UserID:      profile.UserID,
+		Password:    profile.Password,
+		AppID:       profile.AppID,
+		AuthCode:    profile.AuthCode,
+		RspTimeout:  defaultRspTimeout,
+		tdapi:       tdapi,
+		pending:     make(map[int]*rspFuture),
+		instruments: make(map[int][]*thost.CThostFtdcInstrumentField),
+	}
+}
+
+// nextRequestID 生成递增的请求编号
+func (td *TdCtp) nextRequestID() int {
+	return int(td.requestID.Add(1))
+}
+
+// trackRequest 登记一个按 nRequestID 关联的请求
+func (td *TdCtp) trackRequest(requestID int) *rspFuture {
+	f := newRspFuture()
+	td.mu.Lock()
+	td.pending[requestID] = f
+	td.mu.Unlock()
+	return f
+}
+
+// resolveRequest 完成 nRequestID 对应的请求
+func (td *TdCtp) resolveRequest(requestID int, err error) bool {
+	td.mu.Lock()
+	f, ok := td.pending[requestID]
+	delete(td.pending, requestID)
+	td.mu.Unlock()
+	if ok {
+		f.resolve(err)
+	}
+	return ok
+}
+
+// Start 连接交易前置，完成认证和登录
+func (td *TdCtp) Start(frontAddrs ...string) error {
+	if len(frontAddrs) == 0 {
+		return fmt.Errorf("交易前置地址列表为空")
+	}
+	if err := td.Connect(frontAddrs...); err != nil {
+		return err
+	}
+	if td.AppID != "" {
+		if err := td.Authenticate(); err != nil {
+			return err
+		}
+	}
+	return td.Login()
+}
+
+// Connect 注册所有前置地址并等待 OnFrontConnected
+func (td *TdCtp) Connect(frontAddrs ...string) error {
+	f := newRspFuture()
+	td.mu.Lock()
+	td.connectF = f
+	td.mu.Unlock()
+
+	td.tdapi.RegisterSpi(td)
+	for _, addr := range frontAddrs {
+		td.tdapi.RegisterFront(addr)
+	}
+	td.tdapi.SubscribePublicTopic(thost.THOST_TERT_QUICK)
+	td.tdapi.SubscribePrivateTopic(thost.THOST_TERT_QUICK)
+	td.tdapi.Init()
+	if err := f.wait(td.RspTimeout); err != nil {
+		return fmt.Errorf("连接交易前置失败: %w", err)
+	}
+	ctpLog.Info("交易前置连接成功", "fronts", frontAddrs)
+	return nil
+}
+
+// Authenticate 客户端认证
+func (td *TdCtp) Authenticate() error {
+	req := &thost.CThostFtdcReqAuthenticateField{}
+	copy(req.BrokerID[:], td.BrokerID)
+	copy(req.UserID[:], td.UserID)
+	copy(req.AppID[:], td.AppID)
+	copy(req.AuthCode[:], td.AuthCode)
+
+	requestID := td.nextRequestID()
+	f := td.trackRequest(requestID)
+	if ret := td.tdapi.ReqAuthenticate(req, requestID); ret != 0 {
+		td.resolveRequest(requestID, nil)
+		return fmt.Errorf("认证请求发送失败，返回码: %d", ret)
+	}
+	if err := f.wait(td.RspTimeout); err != nil {
+		return fmt.Errorf("认证失败: %w", err)
+	}
+	return nil
+}
+
+// Login 用户登录
+func (td *TdCtp) Login() error {
+	req := &thost.CThostFtdcReqUserLoginField{}
+	copy(req.BrokerID[:], td.BrokerID)
+	copy(req.UserID[:], td.UserID)
+	copy(req.Password[:], td.Password)
+
+	requestID := td.nextRequestID()
+	f := td.trackRequest(requestID)
+	if ret := td.tdapi.ReqUserLogin(req, requestID); ret != 0 {
+		td.resolveRequest(requestID, nil)
+		return fmt.Errorf("登录请求发送失败，返回码: %d", ret)
+	}
+	ctpLog.Info("发送交易登录请求", "user_id", td.UserID, "broker_id", td.BrokerID, "request_id", requestID)
+	if err := f.wait(td.RspTimeout); err != nil {
+		return fmt.Errorf("交易登录失败: %w", err)
+	}
+	return nil
+}
+
+// QueryInstrument 通过 ReqQryInstrument 查询指定合约的最小变动价位、合约乘数、交易所和产品类型
+func (td *TdCtp) QueryInstrument(instrumentID string) (*Instrument, error) {
+	td.queryMu.Lock()
+	defer td.queryMu.Unlock()
+
+	req := &thost.CThostFtdcQryInstrumentField{}
+	copy(req.InstrumentID[:], instrumentID)
+
+	requestID := td.nextRequestID()
+	f := td.trackRequest(requestID)
+
+	// 查询流控：返回 -2/-3 时稍后重试
+	var ret int
+	for attempt := 0; attempt < 5; attempt++ {
+		if ret = td.tdapi.ReqQryInstrument(req, requestID); ret != -2 && ret != -3 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if ret != 0 {
+		td.resolveRequest(requestID, nil)
+		return nil, fmt.Errorf("合约查询请求发送失败，返回码: %d", ret)
+	}
+
+	err := f.wait(td.RspTimeout)
+	td.mu.Lock()
+	fields := td.instruments[requestID]
+	delete(td.instruments, requestID)
+	td.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("合约查询失败: %w", err)
+	}
+
+	for _, field := range fields {
+		if field.InstrumentID.String() == instrumentID {
+			return instrumentFromField(field), nil
+		}
+	}
+	return nil, fmt.Errorf("合约 %s 不存在", instrumentID)
+}
+
+// instrumentFromField 将 CTP 合约结构转换为 Instrument
+func instrumentFromField(f *thost.CThostFtdcInstrumentField) *Instrument {
+	inst := &Instrument{
+		ExchangeID:              f.ExchangeID.String(),
+		InstrumentID:            f.InstrumentID.String(),
+		InstrumentName:          f.InstrumentName.GBString(),
+		ProductClass:            charString(byte(f.ProductClass)),
+		ProductID:               f.ProductID.String(),
+		VolumeMultiple:          int(f.VolumeMultiple),
+		PriceTick:               float64(f.PriceTick),
+		LongMarginRatioByMoney:  float64(f.LongMarginRatio),
+		ShortMarginRatioByMoney: float64(f.ShortMarginRatio),
+		DeliveryYear:            int(f.DeliveryYear),
+		DeliveryMonth:           int(f.DeliveryMonth),
+		OpenDate:                f.OpenDate.String(),
+		ExpireDate:              f.ExpireDate.String(),
+		DeliveryDate:            f.EndDelivDate.String(),
+		UnderlyingInstrID:       f.UnderlyingInstrID.String(),
+		UnderlyingMultiple:      int(f.UnderlyingMultiple),
+		OptionsType:             charString(byte(f.OptionsType)),
+		InstLifePhase:           charString(byte(f.InstLifePhase)),
+	}
+	if inst.OptionsType != "" {
+		strike := float64(f.StrikePrice)
+		inst.StrikePrice = &strike
+	}
+	return inst
+}
+
+// charString 将 CTP 的单字符枚举转换为字符串，0 表示未设置
+func charString(c byte) string {
+	if c == 0 {
+		return ""
+	}
+	return string(rune(c))
+}
+
+func (td *TdCtp) OnFrontConnected() {
+	td.mu.Lock()
+	f := td.connectF
+	td.connectF = nil
+	td.mu.Unlock()
+
+	ctpLog.Info("TdCtp OnFrontConnected")
+	if f != nil {
+		f.resolve(nil)
+	}
+}
+
+func (td *TdCtp) OnFrontDisconnected(reason int) {
+	ctpLog.Warn("TdCtp OnFrontDisconnected", "reason", reason)
+}
+
+// OnRspAuthenticate 客户端认证响应
+func (td *TdCtp) OnRspAuthenticate(rspAuthenticate *thost.CThostFtdcRspAuthenticateField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("OnRspAuthenticate 失败", "err", err)
+	}
+	td.resolveRequest(nRequestID, err)
+}
+
+// OnRspUserLogin 登录请求响应
+func (td *TdCtp) OnRspUserLogin(userLogin *thost.CThostFtdcRspUserLoginField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
+	err := rspInfoError(rspInfo)
+	if err != nil {
+		ctpLog.Error("TdCtp OnRspUserLogin 失败", "err", err)
+	} else {
+		ctpLog.Info("TdCtp OnRspUserLogin 成功", "trading_day", userLogin.TradingDay.String())
+	}
+	td.resolveRequest(nRequestID, err)
+}
+
+// OnRspError 错误应答
+func (td *TdCtp) OnRspError(rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
+	err := rspInfoError(rspInfo)
+	if err == nil {
+		err = fmt.Errorf("OnRspError")
+	}
+	ctpLog.Error("TdCtp OnRspError", "err", err, "request_id", nRequestID)
+	td.resolveRequest(nRequestID, err)
+}
+
+// OnRspQryInstrument 请求查询合约响应，bIsLast 为 true 时完成请求
+func (td *TdCtp) OnRspQryInstrument(instrument *thost.CThostFtdcInstrumentField, rspInfo *thost.CThostFtdcRspInfoField, nRequestID int, bIsLast bool) {
+	if instrument != nil {
+		copied := *instrument
+		td.mu.Lock()
+		td.instruments[nRequestID] = append(td.instruments[nRequestID], &copied)
+		td.mu.Unlock()
+	}
+	if bIsLast {
+		td.resolveRequest(nRequestID, rspInfoError(rspInfo))
+	}
+}
+
+// OnRtnOrder 报单回报，包括登录时私有流重传的当日报单
+func (td *TdCtp) OnRtnOrder(order *thost.CThostFtdcOrderField) {
+	if order == nil {
+		return
+	}
+	ctpLog.Info("报单回报", "instrument", order.InstrumentID.String(), "exchange", order.ExchangeID.String(),
+		"order_sys_id", strings.TrimSpace(order.OrderSysID.String()), "price", float64(order.LimitPrice),
+		"traded", order.VolumeTraded, "volume", order.VolumeTotalOriginal, "status", string(byte(order.OrderStatus)))
+	if td.OnRtnOrderCallback != nil {
+		copied := *order
+		td.OnRtnOrderCallback(&copied)
+	}
+}
+
+// OnRtnTrade 成交回报
+func (td *TdCtp) OnRtnTrade(trade *thost.CThostFtdcTradeField) {
+	if trade == nil {
+		return
+	}
+	ctpLog.Info("成交回报", "instrument", trade.InstrumentID.String(), "exchange", trade.ExchangeID.String(),
+		"order_sys_id", strings.TrimSpace(trade.OrderSysID.String()), "price", float64(trade.Price),
+		"volume", trade.Volume, "time", trade.TradeTime.String())
+	if td.OnRtnTradeCallback != nil {
+		copied := *trade
+		td.OnRtnTradeCallback(&copied)
+	}
+}
+
+// Release 释放资源
+func (td *TdCtp) Release() {
+	if td.tdapi != nil {
+		td.tdapi.Release()
+		ctpLog.Info("TdCtp 资源已释放")
+	}
+}